@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/artkescha/hh-updater/config"
+	"github.com/artkescha/hh-updater/server"
+)
+
+var errUsage = errors.New("invalid usage")
+
+func runCommand(args []string) error {
+	switch args[0] {
+	case "serve":
+		return serve()
+	case "run-once":
+		return withServer(runOnce)
+	case "users":
+		return usersCommand(args[1:])
+	case "db":
+		return dbCommand(args[1:])
+	case "config":
+		if len(args) != 2 || args[1] != "validate" {
+			return errUsage
+		}
+		return validateConfig()
+	case "token":
+		if len(args) != 3 || args[1] != "refresh" {
+			return errUsage
+		}
+		return withUser(args[2], func(s *server.Server, user *server.User) error {
+			if err := s.RefreshToken(user); err != nil {
+				return err
+			}
+			fmt.Printf("Token of user %s refreshed, expires at %s\n", user.ID, user.Token.Expiry.Format(time.RFC3339))
+			return nil
+		})
+	case "resumes":
+		if len(args) != 3 || args[1] != "list" {
+			return errUsage
+		}
+		return withUser(args[2], listResumes)
+	}
+	return errUsage
+}
+
+func loadConfig() (*config.Config, error) {
+	c, err := config.ConfigFromFile(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	if *dryRun {
+		c.Update.DryRun = true
+	}
+	return c, nil
+}
+
+// loadConfigAndLogging loads the config and applies its logging settings.
+func loadConfigAndLogging() (*config.Config, error) {
+	c, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return c, c.ApplyLogging()
+}
+
+// withServer opens the database and loads the users for fn. The user list is
+// written back once fn succeeds.
+func withServer(fn func(s *server.Server) error) error {
+	c, err := loadConfigAndLogging()
+	if err != nil {
+		return err
+	}
+	s := server.NewServer(c)
+	if err := s.Init(); err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := s.RestoreUserList(); err != nil {
+		return err
+	}
+	if err := fn(s); err != nil {
+		return err
+	}
+	return s.SaveUserList()
+}
+
+func withUser(idOrEmail string, fn func(s *server.Server, user *server.User) error) error {
+	return withServer(func(s *server.Server) error {
+		user, err := s.FindUser(idOrEmail)
+		if err != nil {
+			return err
+		}
+		return fn(s, user)
+	})
+}
+
+func runOnce(s *server.Server) error {
+	results := s.RunOnce()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tRESUME\tSTATUS\tERROR")
+	for userID, outcomes := range results {
+		for _, outcome := range outcomes {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", userID, outcome.Title, outcome.Status, outcome.Error)
+			for _, change := range outcome.Changes {
+				fmt.Fprintf(w, "\t  %s\t-%q\t\n\t\t+%q\t\n", change.Field, change.Old, change.New)
+			}
+		}
+	}
+	return w.Flush()
+}
+
+func usersCommand(args []string) error {
+	if len(args) == 1 && args[0] == "list" {
+		return withServer(func(s *server.Server) error {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tEMAIL\tUPDATES\tUPDATED AT\tDISABLED\tTOKEN EXPIRY")
+			for _, user := range s.Users() {
+				var expiry string
+				if user.Token != nil {
+					expiry = user.Token.Expiry.Format(time.RFC3339)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%v\t%s\n", user.ID, user.Email, user.UpdateCount,
+					user.UpdatedAt.Format(time.RFC3339), user.Disabled, expiry)
+			}
+			return w.Flush()
+		})
+	}
+	if len(args) != 2 {
+		return errUsage
+	}
+	switch args[0] {
+	case "show":
+		return withUser(args[1], func(s *server.Server, user *server.User) error {
+			return printJSON(user.ToSafeUser())
+		})
+	case "disable", "enable":
+		return withUser(args[1], func(s *server.Server, user *server.User) error {
+			s.SetUserDisabled(user, args[0] == "disable")
+			fmt.Printf("User %s %sd\n", user.ID, args[0])
+			return nil
+		})
+	case "delete":
+		return withUser(args[1], func(s *server.Server, user *server.User) error {
+			s.DeleteUser(user)
+			fmt.Printf("User %s deleted\n", user.ID)
+			return nil
+		})
+	}
+	return errUsage
+}
+
+func dbCommand(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	switch {
+	case args[0] == "backup" && len(args) == 2:
+		f, err := os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		n, err := server.BackupDatabase(c.DatabasePath, f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(args[1])
+			return err
+		}
+		fmt.Printf("%d bytes written to %s\n", n, args[1])
+		return nil
+	case args[0] == "restore" && len(args) == 2:
+		if err := server.RestoreDatabase(c.DatabasePath, args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("%s restored from %s\n", c.DatabasePath, args[1])
+		return nil
+	case args[0] == "compact" && len(args) == 1:
+		before, after, err := server.CompactDatabase(c.DatabasePath)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s compacted: %d -> %d bytes\n", c.DatabasePath, before, after)
+		return nil
+	case args[0] == "migrate" && len(args) == 1:
+		// Init applies the migrations.
+		return withServer(func(s *server.Server) error {
+			_, version, err := s.Migrate()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Database schema version %d\n", version)
+			return nil
+		})
+	}
+	return errUsage
+}
+
+func validateConfig() error {
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if err := server.NewServer(c).ValidateConfig(); err != nil {
+		return err
+	}
+	fmt.Printf("%s is valid\n", *configFile)
+	return nil
+}
+
+func listResumes(s *server.Server, user *server.User) error {
+	resumes, err := s.UserResumes(user)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTITLE\tVIEWS\tNEW VIEWS\tNEXT PUBLISH AT")
+	for _, r := range resumes {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", r.ID, r.Title, r.TotalViews, r.NewViews, r.NextPublishAt)
+	}
+	return w.Flush()
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
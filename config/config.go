@@ -6,32 +6,149 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/url"
+	"os"
 	"strings"
 	"time"
 
+	"github.com/artkescha/hh-updater/logging"
+	"github.com/artkescha/hh-updater/schedule"
 	"github.com/sirupsen/logrus"
 
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
-	ClientID               string        `json:"client_id" yaml:"client_id"`
-	ClientSecret           string        `json:"client_secret" yaml:"client_secret"`
-	PublicURLRaw           string        `json:"public_url" yaml:"public_url"`
-	RedirectURL            string        `json:"redirect_url" yaml:"redirect_url"`
-	StateString            string        `json:"state_string" yaml:"state_string"`
-	UpdateInterval         time.Duration `json:"update_interval" yaml:"update_interval"`
-	DumpInterval           time.Duration `json:"dump_interval" yaml:"dump_interval"`
-	ListenAddress          string        `json:"listen_address" yaml:"listen_address"`
-	LogLevel               string        `json:"log_level" yaml:"log_level"`
-	DatabasePath           string        `json:"database_path" yaml:"database_path"`
-	PublicURL              *url.URL      `json:"-" yaml:"-"`
-	CookieName             string        `json:"cookie_name" yaml:"cookie_name"`
-	CookieHostname         string        `json:"-" yaml:"-"`
-	CookieSecure           bool          `json:"-" yaml:"-"`
-	CookieEncryptionKey    string        `json:"cookie_encryption_key" yaml:"cookie_encryption_key"`
-	CookieEncryptionCipher cipher.Block  `json:"-" yaml:"-"`
-	ExperienceDescSuffix   string        `json:"" yaml:"experience_description_suffix"`
+	ClientID                string                   `json:"client_id" yaml:"client_id"`
+	ClientSecret            string                   `json:"client_secret" yaml:"client_secret"`
+	ClientSecretFile        string                   `json:"client_secret_file" yaml:"client_secret_file"`
+	PublicURLRaw            string                   `json:"public_url" yaml:"public_url"`
+	RedirectURL             string                   `json:"redirect_url" yaml:"redirect_url"`
+	StateString             string                   `json:"state_string" yaml:"state_string"`
+	UpdateInterval          time.Duration            `json:"update_interval" yaml:"update_interval"`
+	DumpInterval            time.Duration            `json:"dump_interval" yaml:"dump_interval"`
+	ListenAddress           string                   `json:"listen_address" yaml:"listen_address"`
+	LogLevel                string                   `json:"log_level" yaml:"log_level"`
+	LogFormat               string                   `json:"log_format" yaml:"log_format"`
+	DatabasePath            string                   `json:"database_path" yaml:"database_path"`
+	PublicURL               *url.URL                 `json:"-" yaml:"-"`
+	CookieName              string                   `json:"cookie_name" yaml:"cookie_name"`
+	CookieHostname          string                   `json:"-" yaml:"-"`
+	CookieSecure            bool                     `json:"-" yaml:"-"`
+	CookieEncryptionKey     string                   `json:"cookie_encryption_key" yaml:"cookie_encryption_key"`
+	CookieEncryptionKeyFile string                   `json:"cookie_encryption_key_file" yaml:"cookie_encryption_key_file"`
+	CookieEncryptionCipher  cipher.Block             `json:"-" yaml:"-"`
+	ExperienceDescSuffix    string                   `json:"" yaml:"experience_description_suffix"`
+	TokenRefreshAhead       time.Duration            `json:"token_refresh_ahead" yaml:"token_refresh_ahead"`
+	TokenRefreshJitter      time.Duration            `json:"token_refresh_jitter" yaml:"token_refresh_jitter"`
+	Mutators                map[string]MutatorConfig `json:"mutators" yaml:"mutators"`
+	DefaultMutator          string                   `json:"default_mutator" yaml:"default_mutator"`
+	SnapshotLimit           int                      `json:"snapshot_limit" yaml:"snapshot_limit"`
+	ShutdownTimeout         time.Duration            `json:"shutdown_timeout" yaml:"shutdown_timeout"`
+	Update                  UpdateConfig             `json:"update" yaml:"update"`
+	TLS                     TLSConfig                `json:"tls" yaml:"tls"`
+	// Schedule is the default schedule of the updates, users may override
+	// it.
+	Schedule schedule.Spec  `json:"schedule" yaml:"schedule"`
+	SMTP     SMTPConfig     `json:"smtp" yaml:"smtp"`
+	Telegram TelegramConfig `json:"telegram" yaml:"telegram"`
+	Webhooks WebhooksConfig `json:"webhooks" yaml:"webhooks"`
+	// FailureAlertThreshold is the number of failed updates of a resume in
+	// a row after which the user is alerted.
+	FailureAlertThreshold int `json:"failure_alert_threshold" yaml:"failure_alert_threshold"`
+	// UpdateNowInterval is how often a user may ask for an immediate
+	// update.
+	UpdateNowInterval time.Duration `json:"update_now_interval" yaml:"update_now_interval"`
+	// AdminIDs are the hh IDs of the users allowed to use the admin console.
+	AdminIDs             []string `json:"admin_ids" yaml:"admin_ids"`
+	MetricsListenAddress string   `json:"metrics_listen_address" yaml:"metrics_listen_address"`
+	// AuthRateLimit is the number of /authorize and /callback requests
+	// allowed per minute from a single IP.
+	AuthRateLimit         int    `json:"auth_rate_limit" yaml:"auth_rate_limit"`
+	TrustForwardedFor     bool   `json:"trust_forwarded_for" yaml:"trust_forwarded_for"`
+	ContentSecurityPolicy string `json:"content_security_policy" yaml:"content_security_policy"`
+}
+
+type UpdateConfig struct {
+	// DryRun runs the update cycle without publishing or editing resumes.
+	DryRun bool `json:"dry_run" yaml:"dry_run"`
+}
+
+// TLSConfig enables serving https directly. The files are reloaded when
+// they change.
+type TLSConfig struct {
+	CertFile string `json:"cert_file" yaml:"cert_file"`
+	KeyFile  string `json:"key_file" yaml:"key_file"`
+	// RedirectListenAddress, if set, serves plain HTTP redirecting to the
+	// public URL.
+	RedirectListenAddress string `json:"redirect_listen_address" yaml:"redirect_listen_address"`
+}
+
+// SMTPConfig enables the email alerts and the weekly digest. Emails are not
+// sent unless Host is set.
+type SMTPConfig struct {
+	Host         string `json:"host" yaml:"host"`
+	Port         int    `json:"port" yaml:"port"`
+	Username     string `json:"username" yaml:"username"`
+	Password     string `json:"password" yaml:"password"`
+	PasswordFile string `json:"password_file" yaml:"password_file"`
+	// From is the sender address, e.g. "hh-updater <noreply@example.com>".
+	From string `json:"from" yaml:"from"`
+	// Language of the emails of the users who have not chosen one.
+	Language string `json:"language" yaml:"language"`
+	// TemplatesDir holds <language>/<name>.tmpl files replacing the built-in
+	// templates.
+	TemplatesDir string `json:"templates_dir" yaml:"templates_dir"`
+	// The digest is sent on DigestWeekday after DigestHour in
+	// DigestTimeZone.
+	DigestWeekday  string `json:"digest_weekday" yaml:"digest_weekday"`
+	DigestHour     int    `json:"digest_hour" yaml:"digest_hour"`
+	DigestTimeZone string `json:"digest_time_zone" yaml:"digest_time_zone"`
+}
+
+// Enabled reports whether the emails are sent.
+func (c *SMTPConfig) Enabled() bool {
+	return len(c.Host) != 0
+}
+
+// TelegramConfig enables the Telegram bot. It is off unless Token is set.
+type TelegramConfig struct {
+	Token     string `json:"token" yaml:"token"`
+	TokenFile string `json:"token_file" yaml:"token_file"`
+	// APIURL is the Bot API base URL, it may point to a fake in tests.
+	APIURL string `json:"api_url" yaml:"api_url"`
+	// LinkCodeTTL is how long the code linking a chat to a user is valid.
+	LinkCodeTTL time.Duration `json:"link_code_ttl" yaml:"link_code_ttl"`
+}
+
+// Enabled reports whether the bot runs.
+func (c *TelegramConfig) Enabled() bool {
+	return len(c.Token) != 0
+}
+
+// WebhooksConfig controls the delivery of the webhooks registered by the
+// users and the admins.
+type WebhooksConfig struct {
+	// Timeout is the time given to a webhook to respond.
+	Timeout time.Duration `json:"timeout" yaml:"timeout"`
+	// MaxAttempts is the number of deliveries tried before an event is
+	// dropped.
+	MaxAttempts int `json:"max_attempts" yaml:"max_attempts"`
+	// MaxPerUser is the number of webhooks a user may register, 0 leaves
+	// the webhooks to the admins.
+	MaxPerUser int `json:"max_per_user" yaml:"max_per_user"`
+	// AllowPrivateNetworks lets the webhooks of the users reach loopback and
+	// private addresses. The global webhooks of the admins always may.
+	AllowPrivateNetworks bool `json:"allow_private_networks" yaml:"allow_private_networks"`
+}
+
+// MutatorConfig describes a named resume mutator. Suffix is used by the
+// suffix type, Variants by the variants and title types and Char by the
+// invisible type.
+type MutatorConfig struct {
+	Type     string   `json:"type" yaml:"type"`
+	Suffix   string   `json:"suffix,omitempty" yaml:"suffix"`
+	Variants []string `json:"variants,omitempty" yaml:"variants"`
+	Char     string   `json:"char,omitempty" yaml:"char"`
 }
 
 func ConfigFromFile(file string) (*Config, error) {
@@ -39,16 +156,18 @@ func ConfigFromFile(file string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	var c *Config
-	if err := yaml.Unmarshal(configBytes, &c); err != nil {
+	c := Default()
+	if err := yaml.Unmarshal(configBytes, c); err != nil {
 		return nil, err
 	}
-	if len(c.LogLevel) != 0 {
-		level, err := logrus.ParseLevel(c.LogLevel)
-		if err != nil {
-			return nil, err
-		}
-		logrus.SetLevel(level)
+	if err := c.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := c.readSecretFiles(); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
 	}
 	url, err := url.Parse(c.PublicURLRaw)
 	if err != nil {
@@ -67,6 +186,46 @@ func ConfigFromFile(file string) (*Config, error) {
 	return c, nil
 }
 
+// readSecretFiles loads the secrets given as files, e.g. mounted by the
+// container orchestrator, in place of the values from the config.
+func (c *Config) readSecretFiles() error {
+	secrets := []struct {
+		file  string
+		value *string
+	}{
+		{c.ClientSecretFile, &c.ClientSecret},
+		{c.CookieEncryptionKeyFile, &c.CookieEncryptionKey},
+		{c.SMTP.PasswordFile, &c.SMTP.Password},
+		{c.Telegram.TokenFile, &c.Telegram.Token},
+	}
+	for _, secret := range secrets {
+		if len(secret.file) == 0 {
+			continue
+		}
+		data, err := ioutil.ReadFile(secret.file)
+		if err != nil {
+			return err
+		}
+		*secret.value = strings.TrimSpace(string(data))
+	}
+	return nil
+}
+
+// ApplyLogging sets the configured logging level and format and makes the
+// secrets redacted from the logs.
+func (c *Config) ApplyLogging() error {
+	level, err := logrus.ParseLevel(c.LogLevel)
+	if err != nil {
+		return err
+	}
+	if err := logging.SetFormat(c.LogFormat); err != nil {
+		return err
+	}
+	logrus.SetLevel(level)
+	logging.AddSecrets(c.ClientSecret, c.CookieEncryptionKey, c.StateString, c.SMTP.Password, c.Telegram.Token)
+	return nil
+}
+
 func domainFromHost(host string) string {
 	index := strings.Index(host, ":")
 	if index > 0 {
@@ -75,10 +234,34 @@ func domainFromHost(host string) string {
 	return host
 }
 
+// secretFields are replaced in the String output. Nested fields are joined
+// with a dot.
+var secretFields = []string{"client_secret", "cookie_encryption_key", "state_string", "smtp.password", "telegram.token"}
+
+// String returns the config as JSON with the secrets redacted, so it can be
+// logged.
 func (c *Config) String() string {
 	data, err := json.Marshal(c)
 	if err != nil {
 		return ""
 	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return ""
+	}
+	for _, field := range secretFields {
+		parent, key := fields, field
+		if idx := strings.LastIndex(field, "."); idx >= 0 {
+			parent, _ = fields[field[:idx]].(map[string]interface{})
+			key = field[idx+1:]
+		}
+		if value, ok := parent[key].(string); ok && len(value) != 0 {
+			parent[key] = logging.Redacted
+		}
+	}
+	data, err = json.Marshal(fields)
+	if err != nil {
+		return ""
+	}
 	return string(data)
 }
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadSecretFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hh-updater")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	c := Default()
+	c.ClientSecret = "from config"
+	c.CookieEncryptionKey = "from config"
+	c.ClientSecretFile = write("client_secret", "secret\n")
+	c.SMTP.PasswordFile = write("smtp_password", "  password  \n")
+	c.Telegram.TokenFile = write("telegram_token", "token")
+	if err := c.readSecretFiles(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, got, want string
+	}{
+		{"client_secret", c.ClientSecret, "secret"},
+		{"cookie_encryption_key", c.CookieEncryptionKey, "from config"},
+		{"smtp.password", c.SMTP.Password, "password"},
+		{"telegram.token", c.Telegram.Token, "token"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+
+	c = Default()
+	c.CookieEncryptionKeyFile = filepath.Join(dir, "missing")
+	if err := c.readSecretFiles(); !os.IsNotExist(err) {
+		t.Errorf("missing secret file: error %v, want not exist", err)
+	}
+}
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"time"
+)
+
+// Default returns the configuration used for the fields missing in the
+// config file.
+func Default() *Config {
+	return &Config{
+		UpdateInterval:     30 * time.Minute,
+		DumpInterval:       time.Hour,
+		ListenAddress:      "127.0.0.1:8090",
+		LogLevel:           "info",
+		LogFormat:          "text",
+		DatabasePath:       "./database.db",
+		CookieName:         "hhupd",
+		TokenRefreshAhead:  30 * time.Minute,
+		TokenRefreshJitter: 10 * time.Minute,
+		SnapshotLimit:      50,
+		ShutdownTimeout:    30 * time.Second,
+		AuthRateLimit:      20,
+		UpdateNowInterval:  10 * time.Minute,
+		SMTP: SMTPConfig{
+			Port:          587,
+			Language:      "ru",
+			DigestWeekday: "mon",
+			DigestHour:    9,
+		},
+		Telegram: TelegramConfig{
+			APIURL:      "https://api.telegram.org",
+			LinkCodeTTL: 10 * time.Minute,
+		},
+		Webhooks: WebhooksConfig{
+			Timeout:     10 * time.Second,
+			MaxAttempts: 10,
+			MaxPerUser:  5,
+		},
+		FailureAlertThreshold: 3,
+	}
+}
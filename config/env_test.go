@@ -0,0 +1,81 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func lookupMap(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		get   func(c *Config) interface{}
+		want  interface{}
+	}{
+		{"HHUPD_CLIENT_ID", "client", func(c *Config) interface{} { return c.ClientID }, "client"},
+		{"HHUPD_UPDATE_INTERVAL", "45m", func(c *Config) interface{} { return c.UpdateInterval }, 45 * time.Minute},
+		{"HHUPD_SNAPSHOT_LIMIT", "7", func(c *Config) interface{} { return c.SnapshotLimit }, 7},
+		{"HHUPD_TRUST_FORWARDED_FOR", "true", func(c *Config) interface{} { return c.TrustForwardedFor }, true},
+		{"HHUPD_ADMIN_IDS", " 1, 2,,3 ", func(c *Config) interface{} { return c.AdminIDs }, []string{"1", "2", "3"}},
+		{"HHUPD_UPDATE_DRY_RUN", "1", func(c *Config) interface{} { return c.Update.DryRun }, true},
+		{"HHUPD_SMTP_PORT", "2525", func(c *Config) interface{} { return c.SMTP.Port }, 2525},
+		{"HHUPD_TELEGRAM_API_URL", "http://127.0.0.1:8081", func(c *Config) interface{} { return c.Telegram.APIURL }, "http://127.0.0.1:8081"},
+		{"HHUPD_TELEGRAM_LINK_CODE_TTL", "1h", func(c *Config) interface{} { return c.Telegram.LinkCodeTTL }, time.Hour},
+		{"HHUPD_SCHEDULE_WEEKDAYS", "mon,fri", func(c *Config) interface{} { return c.Schedule.Weekdays }, []string{"mon", "fri"}},
+		{"HHUPD_WEBHOOKS_ALLOW_PRIVATE_NETWORKS", "false", func(c *Config) interface{} { return c.Webhooks.AllowPrivateNetworks }, false},
+	}
+	for _, tt := range tests {
+		c := Default()
+		c.Webhooks.AllowPrivateNetworks = true
+		if err := c.applyEnv(lookupMap(map[string]string{tt.name: tt.value})); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := tt.get(c); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s=%q: got %v, want %v", tt.name, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestApplyEnvKeepsUnset(t *testing.T) {
+	c := Default()
+	if err := c.applyEnv(lookupMap(map[string]string{"HHUPD_UNKNOWN": "x", "CLIENT_ID": "x"})); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, Default()) {
+		t.Errorf("config changed without its variables: %+v", c)
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"HHUPD_UPDATE_INTERVAL", "30"},
+		{"HHUPD_SNAPSHOT_LIMIT", "many"},
+		{"HHUPD_UPDATE_DRY_RUN", "yes please"},
+		{"HHUPD_SMTP_DIGEST_HOUR", "9.5"},
+		// Maps can only be set in the config file.
+		{"HHUPD_MUTATORS", "suffix"},
+	}
+	for _, tt := range tests {
+		err := Default().applyEnv(lookupMap(map[string]string{tt.name: tt.value}))
+		if err == nil {
+			t.Errorf("%s=%q: no error", tt.name, tt.value)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), tt.name+": ") {
+			t.Errorf("%s=%q: error %q does not name the variable", tt.name, tt.value, err)
+		}
+	}
+}
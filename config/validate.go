@@ -0,0 +1,202 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/artkescha/hh-updater/logging"
+	"github.com/artkescha/hh-updater/schedule"
+	"github.com/sirupsen/logrus"
+)
+
+const minUpdateInterval = time.Minute
+
+// FieldError is a problem with a single config field.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError lists every invalid field of the config.
+type ValidationError []*FieldError
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, fe := range e {
+		msgs = append(msgs, fe.Error())
+	}
+	return "Invalid configuration: " + strings.Join(msgs, "; ")
+}
+
+// Validate checks the config and returns a ValidationError listing all the
+// invalid fields.
+func (c *Config) Validate() error {
+	var errs ValidationError
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, &FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	required := map[string]string{
+		"client_id":     c.ClientID,
+		"client_secret": c.ClientSecret,
+		"state_string":  c.StateString,
+		"database_path": c.DatabasePath,
+		"cookie_name":   c.CookieName,
+	}
+	for _, field := range []string{"client_id", "client_secret", "state_string", "database_path", "cookie_name"} {
+		if len(required[field]) == 0 {
+			add(field, "is required")
+		}
+	}
+	validateURL := func(field, raw string) {
+		if len(raw) == 0 {
+			add(field, "is required")
+			return
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			add(field, "%v", err)
+			return
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			add(field, "must be an absolute http or https URL")
+		}
+	}
+	validateURL("public_url", c.PublicURLRaw)
+	validateURL("redirect_url", c.RedirectURL)
+	if c.UpdateInterval < minUpdateInterval {
+		add("update_interval", "must be at least %s", minUpdateInterval)
+	}
+	if c.DumpInterval < time.Second {
+		add("dump_interval", "must be at least 1s")
+	}
+	if _, _, err := net.SplitHostPort(c.ListenAddress); err != nil {
+		add("listen_address", "%v", err)
+	}
+	if len(c.MetricsListenAddress) != 0 {
+		if _, _, err := net.SplitHostPort(c.MetricsListenAddress); err != nil {
+			add("metrics_listen_address", "%v", err)
+		} else if c.MetricsListenAddress == c.ListenAddress {
+			add("metrics_listen_address", "must differ from listen_address")
+		}
+	}
+	if (len(c.TLS.CertFile) == 0) != (len(c.TLS.KeyFile) == 0) {
+		add("tls", "cert_file and key_file must be set together")
+	}
+	if len(c.TLS.CertFile) != 0 && !strings.HasPrefix(c.PublicURLRaw, "https://") {
+		add("public_url", "must be https when TLS is served")
+	}
+	if len(c.TLS.RedirectListenAddress) != 0 {
+		if len(c.TLS.CertFile) == 0 {
+			add("tls.redirect_listen_address", "requires cert_file and key_file")
+		} else if _, _, err := net.SplitHostPort(c.TLS.RedirectListenAddress); err != nil {
+			add("tls.redirect_listen_address", "%v", err)
+		} else if c.TLS.RedirectListenAddress == c.ListenAddress {
+			add("tls.redirect_listen_address", "must differ from listen_address")
+		}
+	}
+	if _, err := schedule.Parse(&c.Schedule); err != nil {
+		add("schedule", "%v", err)
+	}
+	if c.SMTP.Enabled() {
+		c.validateSMTP(add)
+	}
+	if c.Telegram.Enabled() {
+		validateURL("telegram.api_url", c.Telegram.APIURL)
+		if c.Telegram.LinkCodeTTL < time.Minute {
+			add("telegram.link_code_ttl", "must be at least 1m")
+		}
+	}
+	if c.Webhooks.Timeout <= 0 {
+		add("webhooks.timeout", "must be positive")
+	}
+	if c.Webhooks.MaxAttempts < 1 {
+		add("webhooks.max_attempts", "must be positive")
+	}
+	if c.Webhooks.MaxPerUser < 0 {
+		add("webhooks.max_per_user", "must not be negative")
+	}
+	if c.FailureAlertThreshold < 1 {
+		add("failure_alert_threshold", "must be positive")
+	}
+	if c.UpdateNowInterval < 0 {
+		add("update_now_interval", "must not be negative")
+	}
+	if c.AuthRateLimit < 0 {
+		add("auth_rate_limit", "must not be negative")
+	}
+	if c.LogFormat != logging.FormatText && c.LogFormat != logging.FormatJSON {
+		add("log_format", "must be %s or %s", logging.FormatText, logging.FormatJSON)
+	}
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		add("log_level", "%v", err)
+	}
+	switch len(c.CookieEncryptionKey) {
+	case 16, 24, 32:
+	default:
+		add("cookie_encryption_key", "must be 16, 24 or 32 bytes long, got %d", len(c.CookieEncryptionKey))
+	}
+	if c.TokenRefreshAhead < 0 {
+		add("token_refresh_ahead", "must not be negative")
+	}
+	if c.TokenRefreshJitter < 0 {
+		add("token_refresh_jitter", "must not be negative")
+	}
+	if c.SnapshotLimit < 1 {
+		add("snapshot_limit", "must be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		add("shutdown_timeout", "must be positive")
+	}
+	for name, m := range c.Mutators {
+		if len(m.Type) == 0 {
+			add("mutators."+name+".type", "is required")
+		}
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// Languages are the languages of the built-in email templates.
+var Languages = []string{"ru", "en"}
+
+func KnownLanguage(lang string) bool {
+	for _, known := range Languages {
+		if lang == known {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) validateSMTP(add func(field, format string, args ...interface{})) {
+	if c.SMTP.Port < 1 || c.SMTP.Port > 65535 {
+		add("smtp.port", "must be between 1 and 65535")
+	}
+	if len(c.SMTP.From) == 0 {
+		add("smtp.from", "is required")
+	} else if _, err := mail.ParseAddress(c.SMTP.From); err != nil {
+		add("smtp.from", "%v", err)
+	}
+	if !KnownLanguage(c.SMTP.Language) {
+		add("smtp.language", "must be one of %s", strings.Join(Languages, ", "))
+	}
+	if _, err := schedule.ParseWeekday(c.SMTP.DigestWeekday); err != nil {
+		add("smtp.digest_weekday", "%v", err)
+	}
+	if c.SMTP.DigestHour < 0 || c.SMTP.DigestHour > 23 {
+		add("smtp.digest_hour", "must be between 0 and 23")
+	}
+	if _, err := time.LoadLocation(c.SMTP.DigestTimeZone); err != nil {
+		add("smtp.digest_time_zone", "%v", err)
+	}
+}
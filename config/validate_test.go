@@ -0,0 +1,126 @@
+package config
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// validConfig returns the defaults with the required fields set.
+func validConfig() *Config {
+	c := Default()
+	c.ClientID = "client"
+	c.ClientSecret = "secret"
+	c.StateString = "state"
+	c.PublicURLRaw = "https://hh.example.com"
+	c.RedirectURL = "https://hh.example.com/callback"
+	c.CookieEncryptionKey = "0123456789abcdef0123456789abcdef"
+	return c
+}
+
+// withSMTP turns the emails on with a valid SMTP config.
+func withSMTP(c *Config) {
+	c.SMTP.Host = "smtp.example.com"
+	c.SMTP.From = "hh-updater <noreply@example.com>"
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		fields []string
+	}{
+		{"valid", func(c *Config) {}, nil},
+		{"valid with everything", func(c *Config) {
+			withSMTP(c)
+			c.Telegram.Token = "token"
+			c.TLS = TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem", RedirectListenAddress: ":80"}
+			c.MetricsListenAddress = "127.0.0.1:9090"
+			c.Mutators = map[string]MutatorConfig{"dot": {Type: "suffix", Suffix: "."}}
+		}, nil},
+		{"required", func(c *Config) {
+			c.ClientID, c.ClientSecret, c.StateString, c.DatabasePath, c.CookieName = "", "", "", "", ""
+		}, []string{"client_id", "client_secret", "cookie_name", "database_path", "state_string"}},
+		{"public url missing", func(c *Config) { c.PublicURLRaw = "" }, []string{"public_url"}},
+		{"public url relative", func(c *Config) { c.PublicURLRaw = "/hh" }, []string{"public_url"}},
+		{"public url malformed", func(c *Config) { c.PublicURLRaw = "http://[::1" }, []string{"public_url"}},
+		{"redirect url scheme", func(c *Config) { c.RedirectURL = "ftp://hh.example.com/callback" }, []string{"redirect_url"}},
+		{"update interval", func(c *Config) { c.UpdateInterval = 30 * time.Second }, []string{"update_interval"}},
+		{"dump interval", func(c *Config) { c.DumpInterval = 0 }, []string{"dump_interval"}},
+		{"listen address", func(c *Config) { c.ListenAddress = "localhost" }, []string{"listen_address"}},
+		{"metrics address", func(c *Config) { c.MetricsListenAddress = "9090" }, []string{"metrics_listen_address"}},
+		{"metrics address taken", func(c *Config) { c.MetricsListenAddress = c.ListenAddress }, []string{"metrics_listen_address"}},
+		{"tls key missing", func(c *Config) { c.TLS.CertFile = "cert.pem" }, []string{"tls"}},
+		{"tls over http", func(c *Config) {
+			c.TLS = TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem"}
+			c.PublicURLRaw = "http://hh.example.com"
+		}, []string{"public_url"}},
+		{"redirect without tls", func(c *Config) { c.TLS.RedirectListenAddress = ":80" }, []string{"tls.redirect_listen_address"}},
+		{"redirect address", func(c *Config) {
+			c.TLS = TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem", RedirectListenAddress: "80"}
+		}, []string{"tls.redirect_listen_address"}},
+		{"redirect address taken", func(c *Config) {
+			c.TLS = TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem", RedirectListenAddress: c.ListenAddress}
+		}, []string{"tls.redirect_listen_address"}},
+		{"schedule", func(c *Config) { c.Schedule.Weekdays = []string{"someday"} }, []string{"schedule"}},
+		{"smtp off", func(c *Config) { c.SMTP.Port, c.SMTP.Language = 0, "de" }, nil},
+		{"smtp port", func(c *Config) { withSMTP(c); c.SMTP.Port = 70000 }, []string{"smtp.port"}},
+		{"smtp from missing", func(c *Config) { withSMTP(c); c.SMTP.From = "" }, []string{"smtp.from"}},
+		{"smtp from malformed", func(c *Config) { withSMTP(c); c.SMTP.From = "hh-updater" }, []string{"smtp.from"}},
+		{"smtp language", func(c *Config) { withSMTP(c); c.SMTP.Language = "de" }, []string{"smtp.language"}},
+		{"smtp digest weekday", func(c *Config) { withSMTP(c); c.SMTP.DigestWeekday = "someday" }, []string{"smtp.digest_weekday"}},
+		{"smtp digest hour", func(c *Config) { withSMTP(c); c.SMTP.DigestHour = 24 }, []string{"smtp.digest_hour"}},
+		{"smtp digest time zone", func(c *Config) { withSMTP(c); c.SMTP.DigestTimeZone = "Nowhere/City" }, []string{"smtp.digest_time_zone"}},
+		{"telegram off", func(c *Config) { c.Telegram.APIURL, c.Telegram.LinkCodeTTL = "", 0 }, nil},
+		{"telegram api url", func(c *Config) { c.Telegram.Token = "token"; c.Telegram.APIURL = "api.telegram.org" }, []string{"telegram.api_url"}},
+		{"telegram link code ttl", func(c *Config) { c.Telegram.Token = "token"; c.Telegram.LinkCodeTTL = time.Second }, []string{"telegram.link_code_ttl"}},
+		{"webhooks timeout", func(c *Config) { c.Webhooks.Timeout = 0 }, []string{"webhooks.timeout"}},
+		{"webhooks max attempts", func(c *Config) { c.Webhooks.MaxAttempts = 0 }, []string{"webhooks.max_attempts"}},
+		{"webhooks max per user", func(c *Config) { c.Webhooks.MaxPerUser = -1 }, []string{"webhooks.max_per_user"}},
+		{"failure alert threshold", func(c *Config) { c.FailureAlertThreshold = 0 }, []string{"failure_alert_threshold"}},
+		{"update now interval", func(c *Config) { c.UpdateNowInterval = -time.Minute }, []string{"update_now_interval"}},
+		{"auth rate limit", func(c *Config) { c.AuthRateLimit = -1 }, []string{"auth_rate_limit"}},
+		{"log format", func(c *Config) { c.LogFormat = "xml" }, []string{"log_format"}},
+		{"log level", func(c *Config) { c.LogLevel = "loud" }, []string{"log_level"}},
+		{"cookie encryption key", func(c *Config) { c.CookieEncryptionKey = "short" }, []string{"cookie_encryption_key"}},
+		{"token refresh ahead", func(c *Config) { c.TokenRefreshAhead = -time.Minute }, []string{"token_refresh_ahead"}},
+		{"token refresh jitter", func(c *Config) { c.TokenRefreshJitter = -time.Minute }, []string{"token_refresh_jitter"}},
+		{"snapshot limit", func(c *Config) { c.SnapshotLimit = 0 }, []string{"snapshot_limit"}},
+		{"shutdown timeout", func(c *Config) { c.ShutdownTimeout = 0 }, []string{"shutdown_timeout"}},
+		{"mutator type", func(c *Config) {
+			c.Mutators = map[string]MutatorConfig{"dot": {Suffix: "."}}
+		}, []string{"mutators.dot.type"}},
+	}
+	for _, tt := range tests {
+		c := validConfig()
+		tt.change(c)
+		err := c.Validate()
+		var fields []string
+		if err != nil {
+			verr, ok := err.(ValidationError)
+			if !ok {
+				t.Errorf("%s: error %T, want ValidationError", tt.name, err)
+				continue
+			}
+			for _, fe := range verr {
+				fields = append(fields, fe.Field)
+			}
+			sort.Strings(fields)
+		}
+		if !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("%s: invalid fields %v, want %v (%v)", tt.name, fields, tt.fields, err)
+		}
+	}
+}
+
+func TestValidationErrorMessage(t *testing.T) {
+	err := ValidationError{
+		{Field: "client_id", Message: "is required"},
+		{Field: "smtp.port", Message: "must be between 1 and 65535"},
+	}
+	want := "Invalid configuration: client_id: is required; smtp.port: must be between 1 and 65535"
+	if err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+}
@@ -4,7 +4,6 @@ go 1.13
 
 require (
 	github.com/boltdb/bolt v1.3.1
-	github.com/gorilla/context v1.1.1
 	github.com/sirupsen/logrus v1.6.0
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	gopkg.in/yaml.v2 v2.3.0
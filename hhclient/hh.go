@@ -15,22 +15,46 @@ type Client struct {
 	BaseURL   *url.URL
 	UserAgent string
 
-	Me     *MeService
-	Resume *ResumeService
+	Me          *MeService
+	Resume      *ResumeService
+	Negotiation *NegotiationService
 }
 
 type service struct {
 	client *http.Client
 }
 
-func NewClient(token *oauth2.Token) *Client {
+// Option configures a Client.
+type Option func(t *TokenTransport)
+
+// WithObserver makes the client report every request to o.
+func WithObserver(o Observer) Option {
+	return func(t *TokenTransport) {
+		t.Observer = o
+	}
+}
+
+// WithTransport makes the client send the requests through rt, e.g. to a
+// fake hh in the tests.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(t *TokenTransport) {
+		t.Base = rt
+	}
+}
+
+func NewClient(token *oauth2.Token, opts ...Option) *Client {
+	transport := &TokenTransport{
+		AccessToken: token.AccessToken,
+	}
+	for _, opt := range opts {
+		opt(transport)
+	}
 	httpClient := &http.Client{
-		Transport: &TokenTransport{
-			AccessToken: token.AccessToken,
-		},
+		Transport: transport,
 	}
 	c := &Client{}
 	c.Me = &MeService{httpClient}
 	c.Resume = &ResumeService{httpClient}
+	c.Negotiation = &NegotiationService{httpClient}
 	return c
 }
@@ -0,0 +1,72 @@
+package hhclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+)
+
+// StateInvitation is the state of a negotiation the employer invited the
+// applicant to.
+const StateInvitation = "invitation"
+
+type NegotiationService service
+
+type NegotiationList struct {
+	Negotiations []*Negotiation `json:"items"`
+	Page         int            `json:"page"`
+	PerPage      int            `json:"per_page"`
+	Pages        int            `json:"pages"`
+	Found        int            `json:"found"`
+}
+
+type Negotiation struct {
+	ID        string           `json:"id"`
+	State     NegotiationState `json:"state"`
+	UpdatedAt string           `json:"updated_at"`
+	Vacancy   *Vacancy         `json:"vacancy"`
+}
+
+type NegotiationState struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type Vacancy struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	AlternateURL string   `json:"alternate_url"`
+	Employer     Employer `json:"employer"`
+}
+
+type Employer struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// NegotiationsRecent returns the first page of the applicant negotiations,
+// most recently updated first.
+func (n *NegotiationService) NegotiationsRecent() ([]*Negotiation, error) {
+	resp, err := n.client.Get(DefaultBaseURL + "negotiations?order_by=updated_at&per_page=50")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logrus.Debugf("close resp body fail %s", err)
+		}
+	}()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if code := resp.StatusCode; code < 200 || code > 299 {
+		return nil, fmt.Errorf("Incorrect status code (%s)", resp.Status)
+	}
+	var list NegotiationList
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, err
+	}
+	return list.Negotiations, nil
+}
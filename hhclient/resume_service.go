@@ -30,7 +30,35 @@ type Resume struct {
 	MiddleName    string    `json:"middle_name"`
 	Age           int       `json:"age"`
 	Experience    []Company `json:"experience"`
+	SkillSet      []string  `json:"skill_set,omitempty"`
 	NextPublishAt string    `json:"next_publish_at"`
+	// UpdatedAt is read-only on hh, so it is decoded by UnmarshalJSON and
+	// never sent back in an edit.
+	UpdatedAt string `json:"-"`
+	// ETag is the entity tag of the response the resume was read from.
+	ETag string `json:"-"`
+	// Raw is the resume as returned by hh, including the fields not
+	// decoded into the struct.
+	Raw json.RawMessage `json:"-"`
+}
+
+// resumeReadOnly are the fields of Resume that hh returns but does not
+// accept in an edit.
+type resumeReadOnly struct {
+	UpdatedAt string `json:"updated_at"`
+}
+
+func (r *Resume) UnmarshalJSON(data []byte) error {
+	type plain Resume
+	if err := json.Unmarshal(data, (*plain)(r)); err != nil {
+		return err
+	}
+	var readOnly resumeReadOnly
+	if err := json.Unmarshal(data, &readOnly); err != nil {
+		return err
+	}
+	r.UpdatedAt = readOnly.UpdatedAt
+	return nil
 }
 
 type Company struct {
@@ -78,7 +106,7 @@ func (r *ResumeService) ResumePublish(resume *Resume) error {
 		return err
 	}
 	if code := resp.StatusCode; code < 200 || code > 299 {
-		logrus.Debug("resumes publish fail status: %d", code)
+		logrus.Debugf("resumes publish fail status: %d", code)
 		return fmt.Errorf("Incorrect status code (%s)", resp.Status)
 	}
 	return nil
@@ -100,6 +128,55 @@ func (r *ResumeService) EditResume(resume *Resume) error {
 	return nil
 }
 
+// readOnlyResumeFields are the resume fields returned by hh that can not
+// be written back.
+var readOnlyResumeFields = []string{
+	"id", "url", "alternate_url", "created_at", "updated_at", "total_views", "new_views",
+	"views_url", "status", "actions", "download", "next_publish_at", "can_publish_or_update",
+	"paid_services", "moderation_note", "blocked", "finished", "marked", "tags",
+	"similar_vacancies", "negotiations_history", "progress",
+}
+
+// EditableResume returns the raw resume as returned by ReadResume without
+// the read-only fields.
+func EditableResume(raw json.RawMessage) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	for _, field := range readOnlyResumeFields {
+		delete(fields, field)
+	}
+	return json.Marshal(fields)
+}
+
+// EditResumeRaw replaces the resume with the raw body as returned by
+// ReadResume, leaving out the read-only fields. Unlike EditResume it keeps
+// every field not decoded into Resume.
+func (r *ResumeService) EditResumeRaw(resumeId string, raw json.RawMessage) error {
+	payload, err := EditableResume(raw)
+	if err != nil {
+		return fmt.Errorf("resume unmarshal fail %s", err)
+	}
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%sresumes/%s", DefaultBaseURL, resumeId), bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("do reqest fail %s", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			logrus.Debugf("close resp body fail %s", err)
+		}
+	}()
+	if code := resp.StatusCode; code < 200 || code > 299 {
+		return fmt.Errorf("Incorrect status code (%s)", resp.Status)
+	}
+	return nil
+}
+
 func (r *ResumeService) ReadResume(resumeId string) (*Resume, error) {
 	resp, err := r.client.Get(fmt.Sprintf("%sresumes/%s", DefaultBaseURL, resumeId))
 	if err != nil {
@@ -121,6 +198,8 @@ func (r *ResumeService) ReadResume(resumeId string) (*Resume, error) {
 	if err := json.Unmarshal(body, &resume); err != nil {
 		return nil, err
 	}
+	resume.Raw = body
+	resume.ETag = resp.Header.Get("ETag")
 	return &resume, nil
 }
 
@@ -139,7 +218,7 @@ func (r *ResumeService) ResumesStatus(resume *Resume) (*ResumeStatus, error) {
 		return nil, err
 	}
 	if code := resp.StatusCode; code < 200 || code > 299 {
-		logrus.Debug("resumes status: %v", code)
+		logrus.Debugf("resumes status: %v", code)
 		return nil, fmt.Errorf("Incorrect status code (%s)", resp.Status)
 	}
 	var resumeStatus *ResumeStatus
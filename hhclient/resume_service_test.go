@@ -0,0 +1,50 @@
+package hhclient
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestResumeUpdatedAtIsReadOnly(t *testing.T) {
+	body := `{"id":"r1","title":"Go developer","updated_at":"2024-01-15T10:00:00+0300"}`
+	var resume Resume
+	if err := json.Unmarshal([]byte(body), &resume); err != nil {
+		t.Fatal(err)
+	}
+	if resume.ID != "r1" || resume.Title != "Go developer" {
+		t.Errorf("decoded %+v, want the id and the title", resume)
+	}
+	if resume.UpdatedAt != "2024-01-15T10:00:00+0300" {
+		t.Errorf("UpdatedAt = %q, want the value from hh", resume.UpdatedAt)
+	}
+	payload, err := json.Marshal(&resume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(payload), "updated_at") {
+		t.Errorf("edit payload %s contains updated_at", payload)
+	}
+}
+
+func TestEditableResume(t *testing.T) {
+	raw := json.RawMessage(`{"id":"r1","title":"Go developer","updated_at":"x","total_views":3,"skill_set":["Go"]}`)
+	editable, err := EditableResume(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(editable, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"id", "updated_at", "total_views"} {
+		if _, ok := fields[field]; ok {
+			t.Errorf("editable resume keeps the read-only field %s", field)
+		}
+	}
+	for _, field := range []string{"title", "skill_set"} {
+		if _, ok := fields[field]; !ok {
+			t.Errorf("editable resume lost the field %s", field)
+		}
+	}
+}
@@ -3,15 +3,59 @@ package hhclient
 import (
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/artkescha/hh-updater/logging"
+	"github.com/sirupsen/logrus"
 )
 
+// Observer is notified of every request made to hh. endpoint is the request
+// path with the IDs replaced by "{id}", code is 0 if no response was
+// received.
+type Observer func(method, endpoint string, code int, duration time.Duration)
+
 type TokenTransport struct {
 	AccessToken string
+	Observer    Observer
+	// Base makes the requests, http.DefaultTransport if nil.
+	Base http.RoundTripper
 }
 
 func (t *TokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t.AccessToken))
-	return http.DefaultTransport.RoundTrip(req)
+	start := time.Now()
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if t.Observer != nil {
+		var code int
+		if resp != nil {
+			code = resp.StatusCode
+		}
+		t.Observer(req.Method, Endpoint(req.URL.Path), code, time.Since(start))
+	}
+	if resp != nil && resp.StatusCode >= http.StatusBadRequest {
+		// hh support asks for the request ID when investigating failures.
+		logrus.WithField(logging.FieldHHRequestID, resp.Header.Get("X-Request-Id")).
+			Warnf("hh request %s %s failed: %s", req.Method, Endpoint(req.URL.Path), resp.Status)
+	}
+	return resp, err
+}
+
+// Endpoint replaces the path segments containing digits, i.e. IDs, with
+// "{id}", so the path can be used to group requests.
+func Endpoint(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.IndexFunc(segment, unicode.IsDigit) >= 0 {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
 }
 
 func TokenHTTPClient(accessToken string) *http.Client {
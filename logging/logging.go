@@ -0,0 +1,108 @@
+// Package logging sets up the logrus output of hh-updater: the text or JSON
+// format and the redaction of emails, tokens and secrets.
+package logging
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+
+	// Fields logged consistently across the packages.
+	FieldUserID      = "user_id"
+	FieldResumeID    = "resume_id"
+	FieldCycleID     = "cycle_id"
+	FieldHHRequestID = "hh_request_id"
+	FieldRequestID   = "request_id"
+
+	Redacted = "[redacted]"
+
+	// minSecretLength keeps short values, which would match all over the
+	// logs, from being registered as secrets.
+	minSecretLength = 8
+)
+
+var (
+	emailRe = regexp.MustCompile(`([A-Za-z0-9._%+\-])[A-Za-z0-9._%+\-]*@([A-Za-z0-9.\-]+\.[A-Za-z]{2,})`)
+	tokenRe = regexp.MustCompile(`(?i)(bearer\s+|[?&](?:code|access_token|refresh_token)=|(?:access_token|refresh_token|client_secret)["']?\s*[=:]\s*["']?)[A-Za-z0-9._~+/\-]+=*`)
+
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+// SetFormat switches the logrus output to the given format, redacting every
+// entry.
+func SetFormat(format string) error {
+	var formatter logrus.Formatter
+	switch format {
+	case "", FormatText:
+		formatter = &logrus.TextFormatter{}
+	case FormatJSON:
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	logrus.SetFormatter(&RedactingFormatter{Formatter: formatter})
+	return nil
+}
+
+// AddSecrets makes the values redacted wherever they appear in the logs.
+// Values shorter than minSecretLength are ignored.
+func AddSecrets(values ...string) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, value := range values {
+		if len(value) < minSecretLength {
+			continue
+		}
+		known := false
+		for _, secret := range secrets {
+			known = known || secret == value
+		}
+		if !known {
+			secrets = append(secrets, value)
+		}
+	}
+}
+
+// Redact hides the emails, leaving their first letter and domain, the
+// tokens and the registered secrets in s.
+func Redact(s string) string {
+	secretsMu.RLock()
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, Redacted, -1)
+	}
+	secretsMu.RUnlock()
+	s = tokenRe.ReplaceAllString(s, "${1}"+Redacted)
+	return emailRe.ReplaceAllString(s, "${1}***@${2}")
+}
+
+// RedactingFormatter redacts the message and the string fields of the
+// entries before passing them to Formatter.
+type RedactingFormatter struct {
+	Formatter logrus.Formatter
+}
+
+func (f *RedactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	redacted := *entry
+	redacted.Message = Redact(entry.Message)
+	redacted.Data = make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			redacted.Data[key] = Redact(v)
+		case error:
+			redacted.Data[key] = Redact(v.Error())
+		default:
+			redacted.Data[key] = value
+		}
+	}
+	return f.Formatter.Format(&redacted)
+}
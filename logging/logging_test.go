@@ -0,0 +1,77 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRedact(t *testing.T) {
+	AddSecrets("s3cr3t-client-value", "short")
+	tests := []struct {
+		in, want string
+	}{
+		{"no secrets here", "no secrets here"},
+		{"mail ivan.petrov@example.com now", "mail i***@example.com now"},
+		{"to a@b.ru and olga@mail.example.org", "to a***@b.ru and o***@mail.example.org"},
+		{"Authorization: Bearer ABC.def-123_x", "Authorization: Bearer " + Redacted},
+		{"GET /callback?code=QWERTY123&state=x", "GET /callback?code=" + Redacted + "&state=x"},
+		{"url?access_token=abc123==", "url?access_token=" + Redacted},
+		{`{"access_token":"abc123","token_type":"bearer"}`, `{"access_token":"` + Redacted + `","token_type":"bearer"}`},
+		{"refresh_token = r3fr3sh", "refresh_token = " + Redacted},
+		{"client_secret: xyz789", "client_secret: " + Redacted},
+		{"secret is s3cr3t-client-value!", "secret is " + Redacted + "!"},
+		{"short values are not secrets", "short values are not secrets"},
+	}
+	for _, tt := range tests {
+		if got := Redact(tt.in); got != tt.want {
+			t.Errorf("Redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRedactingFormatter(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &out
+	logger.Formatter = &RedactingFormatter{Formatter: &logrus.JSONFormatter{}}
+	logger.WithFields(logrus.Fields{
+		"email":   "ivan@example.com",
+		"error":   errors.New("refresh_token=abc123 rejected"),
+		"attempt": 2,
+	}).Info("Bearer abc.def")
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("decode %q: %v", out.String(), err)
+	}
+	tests := []struct {
+		key  string
+		want interface{}
+	}{
+		{"msg", "Bearer " + Redacted},
+		{"email", "i***@example.com"},
+		{"error", "refresh_token=" + Redacted + " rejected"},
+		{"attempt", float64(2)},
+	}
+	for _, tt := range tests {
+		if got := entry[tt.key]; got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestSetFormat(t *testing.T) {
+	defer logrus.SetFormatter(&logrus.TextFormatter{})
+	for _, format := range []string{"", FormatText, FormatJSON} {
+		if err := SetFormat(format); err != nil {
+			t.Errorf("SetFormat(%q): %v", format, err)
+		}
+	}
+	if err := SetFormat("xml"); err == nil || !strings.Contains(err.Error(), "xml") {
+		t.Errorf("SetFormat(%q) = %v, want an unknown format error", "xml", err)
+	}
+}
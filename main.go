@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"github.com/artkescha/hh-updater/config"
+	"fmt"
+	"github.com/artkescha/hh-updater/logging"
 	"github.com/artkescha/hh-updater/server"
 	"github.com/sirupsen/logrus"
 	"os"
@@ -12,24 +14,63 @@ import (
 
 var (
 	configFile = flag.String("config-file", "./config.yaml", "Configuration file")
+	dryRun     = flag.Bool("dry-run", false, "Log the planned publishes and edits instead of making them")
 	errChan    = make(chan error, 10)
 	signalChan = make(chan os.Signal, 1)
 )
 
+const usage = `Usage: hh-updater [-config-file FILE] [-dry-run] [COMMAND]
+
+Commands:
+  serve                            run the server (default)
+  run-once                         run a single update cycle
+  users list                       list users
+  users show|disable|enable|delete USER
+  db backup FILE                   write a copy of the database
+  db restore FILE                  replace the database with a backup
+  db compact                       rewrite the database to reclaim space
+  db migrate                       apply pending database migrations
+  config validate                  check the configuration file
+  token refresh USER               refresh the user token
+  resumes list USER                list the user resumes on hh
+
+USER is a user ID or email.
+`
+
 func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
+	// Redact the logs written before the config is loaded as well.
+	if err := logging.SetFormat(logging.FormatText); err != nil {
+		logrus.Fatal(err)
+	}
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+	if err := runCommand(args); err != nil {
+		if err == errUsage {
+			flag.Usage()
+			os.Exit(2)
+		}
+		logrus.Fatal(err)
+	}
+}
+
+func serve() error {
 	logrus.Info("Starting hh-updater...")
 
-	config, err := config.ConfigFromFile(*configFile)
+	config, err := loadConfigAndLogging()
 	if err != nil {
-		logrus.Fatal(err)
-		return
+		return err
 	}
 
 	server := server.NewServer(config)
 	if err := server.Init(); err != nil {
-		logrus.Fatal(err)
-		return
+		return err
 	}
 
 	logrus.Debugf("Configuration: %s", config.String())
@@ -38,22 +79,37 @@ func main() {
 		errChan <- server.Start()
 	}()
 
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	for {
 		select {
 		case err := <-errChan:
 			if err != nil {
-				logrus.Fatal(err)
+				return err
 			}
 		case signal := <-signalChan:
+			if signal == syscall.SIGHUP {
+				logrus.Info("Captured SIGHUP. Reloading configuration...")
+				newConfig, err := loadConfig()
+				if err == nil {
+					err = server.Reload(newConfig)
+				}
+				if err != nil {
+					logrus.Errorf("Configuration rejected, keeping the current one: %v", err)
+					continue
+				}
+				config = newConfig
+				continue
+			}
 			logrus.Infof("Captured %v. Exiting...", signal)
-			if err := server.Stop(); err != nil {
-				logrus.Fatal(err)
+			ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+			err := server.Stop(ctx)
+			cancel()
+			if err != nil {
+				return err
 			}
 			logrus.Info("Bye")
-			os.Exit(0)
+			return nil
 		}
 	}
-
 }
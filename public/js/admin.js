@@ -0,0 +1,197 @@
+var UsersPage = 1;
+
+var StateNames = {
+    'active': 'Активен',
+    'disabled': 'Отключен',
+    'paused': 'Приостановлен'
+};
+
+function AdminRequest(method, url, onload, body) {
+    var xhr = new XMLHttpRequest();
+    xhr.open(method, url, true);
+    xhr.setRequestHeader('Content-Type', 'application/x-www-form-urlencoded');
+    xhr.onload = function() {
+        var error = document.getElementById('admin-error');
+        if (xhr.status == 401 || xhr.status == 403) {
+            location = '/';
+            return
+        }
+        if (xhr.status != 200) {
+            error.textContent = xhr.responseText;
+            error.className = 'alert alert-danger';
+            return
+        }
+        error.className = 'alert alert-danger hidden';
+        onload(JSON.parse(xhr.responseText));
+    }
+    xhr.send(body);
+};
+
+function FormatDate(value) {
+    if (!value || value.indexOf('0001-') == 0) {
+        return '';
+    }
+    return new Date(value).toLocaleString();
+};
+
+function ShowPager(id, page, load) {
+    var pager = document.getElementById(id);
+    pager.innerHTML = '';
+    var items = [['Назад', page.page - 1, page.page > 1],
+        ['Вперёд', page.page + 1, page.page * page.per_page < page.total]];
+    for (var i = 0; i < items.length; i++) {
+        var li = document.createElement('li');
+        var link = document.createElement('a');
+        link.href = '#';
+        link.textContent = items[i][0];
+        if (items[i][2]) {
+            link.onclick = (function(target) {
+                return function() {
+                    load(target);
+                    return false;
+                };
+            })(items[i][1]);
+        } else {
+            li.className = 'disabled';
+        }
+        li.appendChild(link);
+        pager.appendChild(li);
+    }
+};
+
+function UserAction(action, id, confirmation) {
+    if (confirmation && !confirm(confirmation)) {
+        return
+    }
+    AdminRequest('POST', '/admin/users/' + action + '?id=' + encodeURIComponent(id), function() {
+        LoadUsers(UsersPage);
+        LoadAudit(1);
+    });
+};
+
+function ActionButton(title, action, id, confirmation) {
+    var button = document.createElement('button');
+    button.className = 'btn btn-default btn-xs';
+    button.textContent = title;
+    button.onclick = function() {
+        UserAction(action, id, confirmation);
+    };
+    return button;
+};
+
+function LoadUsers(page) {
+    AdminRequest('GET', '/admin/users?page=' + page, function(data) {
+        UsersPage = data.page;
+        var tbody = document.querySelector('#users tbody');
+        tbody.innerHTML = '';
+        for (var i = 0; i < data.items.length; i++) {
+            var user = data.items[i];
+            var row = tbody.insertRow();
+            row.insertCell().textContent = user.id;
+            row.insertCell().textContent = user.email;
+            row.insertCell().textContent = StateNames[user.state] || user.state;
+            row.insertCell().textContent = FormatDate(user.updated_at);
+            row.insertCell().textContent = user.update_count;
+            row.insertCell().textContent = FormatDate(user.token_expiry);
+            row.insertCell().textContent = user.last_error || '';
+            var actions = row.insertCell();
+            actions.appendChild(ActionButton('Обновить', 'update', user.id));
+            if (user.state == 'disabled' || user.state == 'paused') {
+                actions.appendChild(ActionButton('Возобновить', 'resume', user.id));
+            } else {
+                actions.appendChild(ActionButton('Приостановить', 'pause', user.id));
+            }
+            actions.appendChild(ActionButton('Сбросить сессии', 'revoke', user.id,
+                'Завершить все сессии пользователя ' + user.id + '?'));
+            actions.appendChild(ActionButton('Удалить', 'delete', user.id,
+                'Удалить пользователя ' + user.id + '?'));
+        }
+        ShowPager('users-pager', data, LoadUsers);
+    });
+};
+
+function LoadAudit(page) {
+    AdminRequest('GET', '/admin/audit?page=' + page, function(data) {
+        var tbody = document.querySelector('#audit tbody');
+        tbody.innerHTML = '';
+        for (var i = 0; i < data.items.length; i++) {
+            var entry = data.items[i];
+            var row = tbody.insertRow();
+            row.insertCell().textContent = FormatDate(entry.at);
+            row.insertCell().textContent = entry.admin_id;
+            row.insertCell().textContent = entry.action;
+            row.insertCell().textContent = entry.target_id;
+        }
+        ShowPager('audit-pager', data, LoadAudit);
+    });
+};
+
+function ShowWebhooks(webhooks) {
+    var tbody = document.querySelector('#webhooks tbody');
+    tbody.innerHTML = '';
+    for (var i = 0; i < webhooks.length; i++) {
+        var hook = webhooks[i];
+        var row = tbody.insertRow();
+        row.insertCell().textContent = hook.url;
+        row.insertCell().textContent = (hook.events || []).join(', ') || 'все';
+        row.insertCell().textContent = hook.secret;
+        row.insertCell().textContent = FormatDate(hook.created_at);
+        var actions = row.insertCell();
+        var log = document.createElement('button');
+        log.className = 'btn btn-default btn-xs';
+        log.textContent = 'Доставки';
+        log.onclick = (function(id) {
+            return function() {
+                LoadDeliveries(id);
+            };
+        })(hook.id);
+        actions.appendChild(log);
+        var remove = document.createElement('button');
+        remove.className = 'btn btn-default btn-xs';
+        remove.textContent = 'Удалить';
+        remove.onclick = (function(id) {
+            return function() {
+                if (!confirm('Удалить вебхук ' + id + '?')) {
+                    return
+                }
+                AdminRequest('DELETE', '/admin/webhooks?id=' + encodeURIComponent(id), function(data) {
+                    ShowWebhooks(data);
+                    LoadAudit(1);
+                });
+            };
+        })(hook.id);
+        actions.appendChild(remove);
+    }
+};
+
+function LoadWebhooks() {
+    AdminRequest('GET', '/admin/webhooks', ShowWebhooks);
+};
+
+function AddWebhook() {
+    AdminRequest('POST', '/admin/webhooks', function(data) {
+        ShowWebhooks(data);
+        LoadAudit(1);
+    }, 'url=' + encodeURIComponent(document.getElementById('webhook-url').value) +
+        '&events=' + encodeURIComponent(document.getElementById('webhook-events').value));
+};
+
+function LoadDeliveries(id) {
+    AdminRequest('GET', '/admin/webhooks/deliveries?id=' + encodeURIComponent(id), function(data) {
+        var tbody = document.querySelector('#deliveries tbody');
+        tbody.innerHTML = '';
+        for (var i = 0; i < data.length; i++) {
+            var delivery = data[i];
+            var row = tbody.insertRow();
+            row.insertCell().textContent = FormatDate(delivery.at);
+            row.insertCell().textContent = delivery.event_type;
+            row.insertCell().textContent = delivery.attempt;
+            row.insertCell().textContent = delivery.status;
+            row.insertCell().textContent = delivery.status_code || '';
+            row.insertCell().textContent = delivery.error || '';
+            row.insertCell().textContent = delivery.duration;
+        }
+        document.getElementById('deliveries-title').classList.remove('hidden');
+        document.getElementById('deliveries').classList.remove('hidden');
+    });
+};
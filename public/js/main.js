@@ -33,3 +33,416 @@ function Delete() {
     }
     xhr.send();
 };
+
+var OutcomeNames = {
+    'published': 'Опубликовано',
+    'edited': 'Опубликовано и изменено',
+    'skipped_not_allowed': 'Пропущено: обновление пока недоступно',
+    'skipped_blocked': 'Пропущено: резюме заблокировано',
+    'failed': 'Ошибка'
+};
+
+function LoadStatus() {
+    var xhr = new XMLHttpRequest();
+    xhr.open('GET', '/me', true);
+    xhr.onload = function() {
+        if (xhr.status != 200) {
+            return
+        }
+        var me = JSON.parse(xhr.responseText);
+        ShowNotifications(me.notifications || []);
+        ShowPause(me.pause);
+        LoadSchedule();
+        LoadEmailSettings();
+        SendTelegram('GET');
+        SendWebhooks('GET', '', null);
+        var tbody = document.querySelector('#resumes tbody');
+        tbody.innerHTML = '';
+        for (var id in me.resumes || {}) {
+            var outcome = me.resumes[id].last_outcome;
+            if (!outcome) {
+                continue
+            }
+            var row = tbody.insertRow();
+            row.insertCell().textContent = outcome.title;
+            var result = OutcomeNames[outcome.status] || outcome.status;
+            if (outcome.error) {
+                result += ' (' + outcome.error + ')';
+            }
+            if (me.resumes[id].moderation && me.resumes[id].moderation.publish_url) {
+                result += ' ';
+                var link = document.createElement('a');
+                link.href = me.resumes[id].moderation.publish_url;
+                link.textContent = 'Исправить';
+                row.insertCell().appendChild(document.createTextNode(result));
+                row.cells[1].appendChild(link);
+                row.insertCell().textContent = new Date(outcome.at).toLocaleString();
+                row.insertCell().appendChild(PauseButton(id, me.resumes[id].pause));
+                continue
+            }
+            row.insertCell().textContent = result;
+            row.insertCell().textContent = new Date(outcome.at).toLocaleString();
+            row.insertCell().appendChild(PauseButton(id, me.resumes[id].pause));
+        }
+    }
+    xhr.send();
+};
+
+function ShowNotifications(notifications) {
+    var container = document.getElementById('notifications');
+    container.innerHTML = '';
+    for (var i = notifications.length - 1; i >= 0; i--) {
+        var n = notifications[i];
+        var div = document.createElement('div');
+        div.className = n.type == 'resume.blocked' ? 'alert alert-danger' : 'alert alert-info';
+        div.textContent = new Date(n.at).toLocaleString() + ': ' + n.message + ' ';
+        if (n.url) {
+            var link = document.createElement('a');
+            link.href = n.url;
+            link.className = 'alert-link';
+            link.textContent = 'Перейти к резюме';
+            div.appendChild(link);
+        }
+        container.appendChild(div);
+    }
+};
+
+var JobStatusNames = {
+    'queued': 'Обновление в очереди...',
+    'running': 'Обновляем резюме...',
+    'done': 'Резюме обновлены',
+    'failed': 'Ошибка обновления'
+};
+
+function ShowJob(job) {
+    var status = document.getElementById('update-status');
+    status.textContent = JobStatusNames[job.status] || job.status;
+    if (job.error) {
+        status.textContent += ': ' + job.error;
+    }
+    if (job.status == 'queued' || job.status == 'running') {
+        setTimeout(function() {
+            PollJob(job.id);
+        }, 2000);
+        return
+    }
+    document.getElementById('update-now').disabled = false;
+    LoadStatus();
+};
+
+function PollJob(id) {
+    var xhr = new XMLHttpRequest();
+    xhr.open('GET', '/update/job?id=' + encodeURIComponent(id), true);
+    xhr.onload = function() {
+        if (xhr.status != 200) {
+            document.getElementById('update-now').disabled = false;
+            return
+        }
+        ShowJob(JSON.parse(xhr.responseText));
+    }
+    xhr.send();
+};
+
+function UpdateNow() {
+    var button = document.getElementById('update-now');
+    button.disabled = true;
+    var xhr = new XMLHttpRequest();
+    xhr.open('POST', '/update', true);
+    xhr.onload = function() {
+        if (xhr.status != 200 && xhr.status != 202) {
+            document.getElementById('update-status').textContent = xhr.responseText;
+            button.disabled = false;
+            return
+        }
+        ShowJob(JSON.parse(xhr.responseText));
+    }
+    xhr.send();
+};
+
+function PauseActive(pause) {
+    return pause && (!pause.resume_on || new Date(pause.resume_on) > new Date());
+};
+
+function ShowPause(pause) {
+    var status = document.getElementById('pause-status');
+    if (!PauseActive(pause)) {
+        status.textContent = 'Резюме обновляются автоматически.';
+        return
+    }
+    status.textContent = 'Обновление приостановлено';
+    if (pause.resume_on) {
+        status.textContent += ' до ' + new Date(pause.resume_on).toLocaleDateString();
+    }
+    status.textContent += '.';
+};
+
+function PauseButton(resumeID, pause) {
+    var button = document.createElement('button');
+    button.className = 'btn btn-default btn-xs';
+    if (PauseActive(pause)) {
+        button.textContent = 'Возобновить';
+        button.onclick = function() {
+            Unpause(resumeID);
+        };
+    } else {
+        button.textContent = 'Приостановить';
+        button.onclick = function() {
+            Pause(resumeID);
+        };
+    }
+    return button;
+};
+
+function SendPause(method, resumeID, resumeOn) {
+    var xhr = new XMLHttpRequest();
+    xhr.open(method, '/settings/pause?resume_id=' + encodeURIComponent(resumeID) +
+        '&resume_on=' + encodeURIComponent(resumeOn), true);
+    xhr.onload = function() {
+        if (xhr.status != 200) {
+            document.getElementById('pause-status').textContent = xhr.responseText;
+            return
+        }
+        LoadStatus();
+    }
+    xhr.send();
+};
+
+function Pause(resumeID) {
+    SendPause('POST', resumeID, document.getElementById('resume-on').value);
+};
+
+function Unpause(resumeID) {
+    SendPause('DELETE', resumeID, '');
+};
+
+function ShowSchedule(info) {
+    var spec = info.user || info.default || {};
+    document.getElementById('schedule-time-zone').value = spec.time_zone || '';
+    document.getElementById('schedule-weekdays').value = (spec.weekdays || []).join(', ');
+    document.getElementById('schedule-windows').value = (spec.windows || []).join(', ');
+    document.getElementById('schedule-cron').value = spec.cron || '';
+    var next = document.getElementById('schedule-next');
+    next.textContent = info.user ? '(своё)' : '(по умолчанию)';
+    if (info.next) {
+        next.textContent += ', ближайшее: ' + new Date(info.next).toLocaleString();
+    }
+};
+
+function SendSchedule(method, body) {
+    var xhr = new XMLHttpRequest();
+    xhr.open(method, '/settings/schedule', true);
+    xhr.setRequestHeader('Content-Type', 'application/x-www-form-urlencoded');
+    xhr.onload = function() {
+        var status = document.getElementById('schedule-status');
+        if (xhr.status != 200) {
+            status.textContent = xhr.responseText;
+            return
+        }
+        status.textContent = '';
+        ShowSchedule(JSON.parse(xhr.responseText));
+    }
+    xhr.send(body);
+};
+
+function LoadSchedule() {
+    SendSchedule('GET', null);
+};
+
+function SaveSchedule() {
+    var fields = ['time_zone', 'weekdays', 'windows', 'cron'];
+    var body = fields.map(function(field) {
+        var value = document.getElementById('schedule-' + field.replace('_', '-')).value;
+        return field + '=' + encodeURIComponent(value);
+    }).join('&');
+    SendSchedule('POST', body);
+};
+
+function ResetSchedule() {
+    SendSchedule('DELETE', null);
+};
+
+function ShowEmailSettings(settings) {
+    var well = document.getElementById('email-settings');
+    if (!settings.enabled) {
+        well.classList.add('hidden');
+        return
+    }
+    well.classList.remove('hidden');
+    document.getElementById('email-address').textContent = settings.email;
+    document.getElementById('email-alerts').checked = settings.alerts;
+    document.getElementById('email-digest').checked = settings.digest;
+    var select = document.getElementById('email-language');
+    select.innerHTML = '';
+    settings.languages.forEach(function(lang) {
+        var option = document.createElement('option');
+        option.value = lang;
+        option.textContent = lang;
+        option.selected = lang == settings.language;
+        select.appendChild(option);
+    });
+};
+
+function SendEmailSettings(method, body) {
+    var xhr = new XMLHttpRequest();
+    xhr.open(method, '/settings/email', true);
+    xhr.setRequestHeader('Content-Type', 'application/x-www-form-urlencoded');
+    xhr.onload = function() {
+        var status = document.getElementById('email-status');
+        if (xhr.status != 200) {
+            status.textContent = xhr.responseText;
+            return
+        }
+        status.textContent = '';
+        ShowEmailSettings(JSON.parse(xhr.responseText));
+    }
+    xhr.send(body);
+};
+
+function LoadEmailSettings() {
+    SendEmailSettings('GET', null);
+};
+
+function SaveEmailSettings() {
+    SendEmailSettings('POST', 'language=' + encodeURIComponent(document.getElementById('email-language').value) +
+        '&alerts=' + document.getElementById('email-alerts').checked +
+        '&digest=' + document.getElementById('email-digest').checked);
+};
+
+function ShowTelegram(settings) {
+    var well = document.getElementById('telegram-settings');
+    if (!settings.enabled) {
+        well.classList.add('hidden');
+        return
+    }
+    well.classList.remove('hidden');
+    document.getElementById('telegram-status').textContent = settings.linked ?
+        'Telegram подключён: бот присылает публикации, ошибки и приглашения' : 'Telegram не подключён';
+    document.getElementById('telegram-unlink').classList.toggle('hidden', !settings.linked);
+    var code = document.getElementById('telegram-code');
+    code.innerHTML = '';
+    if (!settings.code) {
+        return
+    }
+    code.textContent = 'Отправьте боту /start ' + settings.code + ' до ' +
+        new Date(settings.expires_at).toLocaleTimeString() + ' ';
+    if (settings.link) {
+        var link = document.createElement('a');
+        link.href = settings.link;
+        link.textContent = 'или откройте ссылку';
+        code.appendChild(link);
+    }
+};
+
+function SendTelegram(method) {
+    var xhr = new XMLHttpRequest();
+    xhr.open(method, '/settings/telegram', true);
+    xhr.onload = function() {
+        if (xhr.status != 200) {
+            document.getElementById('telegram-status').textContent = xhr.responseText;
+            return
+        }
+        ShowTelegram(JSON.parse(xhr.responseText));
+    }
+    xhr.send();
+};
+
+function LinkTelegram() {
+    SendTelegram('POST');
+};
+
+function UnlinkTelegram() {
+    SendTelegram('DELETE');
+};
+
+var DeliveryNames = {
+    'delivered': 'Доставлено',
+    'retrying': 'Повтор',
+    'failed': 'Не доставлено'
+};
+
+function ShowWebhooks(webhooks) {
+    var tbody = document.querySelector('#webhooks tbody');
+    tbody.innerHTML = '';
+    for (var i = 0; i < webhooks.length; i++) {
+        var hook = webhooks[i];
+        var row = tbody.insertRow();
+        row.insertCell().textContent = hook.url;
+        row.insertCell().textContent = (hook.events || []).join(', ') || 'все события';
+        var secret = row.insertCell();
+        secret.textContent = 'Секрет: ';
+        var code = document.createElement('code');
+        code.textContent = hook.secret;
+        secret.appendChild(code);
+        var actions = row.insertCell();
+        var log = document.createElement('button');
+        log.className = 'btn btn-default btn-xs';
+        log.textContent = 'Журнал';
+        log.onclick = (function(id) {
+            return function() {
+                LoadDeliveries(id);
+            };
+        })(hook.id);
+        actions.appendChild(log);
+        var remove = document.createElement('button');
+        remove.className = 'btn btn-default btn-xs';
+        remove.textContent = 'Удалить';
+        remove.onclick = (function(id) {
+            return function() {
+                if (confirm('Удалить вебхук?')) {
+                    SendWebhooks('DELETE', '?id=' + encodeURIComponent(id), null);
+                }
+            };
+        })(hook.id);
+        actions.appendChild(remove);
+    }
+};
+
+function SendWebhooks(method, query, body) {
+    var xhr = new XMLHttpRequest();
+    xhr.open(method, '/settings/webhooks' + query, true);
+    xhr.setRequestHeader('Content-Type', 'application/x-www-form-urlencoded');
+    xhr.onload = function() {
+        var status = document.getElementById('webhook-status');
+        if (xhr.status != 200) {
+            status.textContent = xhr.responseText;
+            return
+        }
+        status.textContent = '';
+        if (method != 'GET') {
+            document.getElementById('webhook-deliveries').classList.add('hidden');
+        }
+        ShowWebhooks(JSON.parse(xhr.responseText));
+    }
+    xhr.send(body);
+};
+
+function AddWebhook() {
+    SendWebhooks('POST', '', 'url=' + encodeURIComponent(document.getElementById('webhook-url').value) +
+        '&events=' + encodeURIComponent(document.getElementById('webhook-events').value));
+};
+
+function LoadDeliveries(id) {
+    var xhr = new XMLHttpRequest();
+    xhr.open('GET', '/settings/webhooks/deliveries?id=' + encodeURIComponent(id), true);
+    xhr.onload = function() {
+        if (xhr.status != 200) {
+            document.getElementById('webhook-status').textContent = xhr.responseText;
+            return
+        }
+        var deliveries = JSON.parse(xhr.responseText);
+        var table = document.getElementById('webhook-deliveries');
+        var tbody = table.querySelector('tbody');
+        tbody.innerHTML = '';
+        for (var i = 0; i < deliveries.length; i++) {
+            var delivery = deliveries[i];
+            var row = tbody.insertRow();
+            row.insertCell().textContent = new Date(delivery.at).toLocaleString();
+            row.insertCell().textContent = delivery.event_type;
+            row.insertCell().textContent = delivery.attempt;
+            row.insertCell().textContent = DeliveryNames[delivery.status] || delivery.status;
+            row.insertCell().textContent = delivery.error || delivery.status_code;
+        }
+        table.classList.remove('hidden');
+    }
+    xhr.send();
+};
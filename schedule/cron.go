@@ -0,0 +1,144 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is due once a fire time of the expression has passed since
+// the last run.
+type cronSchedule struct {
+	loc                                *time.Location
+	minutes, hours, days, months, dows []bool
+	// anyDay and anyDow keep the cron rule that the day is matched by
+	// either field when both are restricted. A field is unrestricted when it
+	// covers its whole range, so "1-31" counts the same as "*".
+	anyDay, anyDow bool
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+func parseCron(expr string, loc *time.Location) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("want %d fields, got %d", len(cronFields), len(fields))
+	}
+	sets := make([][]bool, len(fields))
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", cronFields[i].name, err)
+		}
+		sets[i] = set
+	}
+	// Sunday is both 0 and 7.
+	sets[4][0] = sets[4][0] || sets[4][7]
+	return &cronSchedule{
+		loc:     loc,
+		minutes: sets[0], hours: sets[1], days: sets[2], months: sets[3], dows: sets[4],
+		anyDay: covers(sets[2], 1, 31), anyDow: covers(sets[4], 0, 6),
+	}, nil
+}
+
+// covers reports whether every value from min to max is in the set.
+func covers(set []bool, min, max int) bool {
+	for v := min; v <= max; v++ {
+		if !set[v] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseCronField parses lists of values, ranges and steps like "1-5",
+// "*/15" or "0,30".
+func parseCronField(field string, min, max int) ([]bool, error) {
+	set := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[idx+1:]); err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:idx]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", part)
+				}
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	day, dow := c.days[t.Day()], c.dows[int(t.Weekday())]
+	switch {
+	case c.anyDay && c.anyDow:
+		return true
+	case c.anyDay:
+		return dow
+	case c.anyDow:
+		return day
+	}
+	return day || dow
+}
+
+// Next returns the first fire time after now. It gives up after searching
+// for five years, which only happens for dates like February 30.
+func (c *cronSchedule) Next(now time.Time) time.Time {
+	t := now.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !c.months[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.loc)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.loc)
+			continue
+		}
+		if !c.hours[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.loc)
+			continue
+		}
+		if !c.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (c *cronSchedule) Due(last, now time.Time) bool {
+	next := c.Next(last)
+	return !next.IsZero() && !next.After(now)
+}
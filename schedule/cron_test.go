@@ -0,0 +1,109 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []string{
+		"0 10 * *",
+		"0 10 * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-a * * * *",
+	}
+	for _, expr := range tests {
+		if _, err := parseCron(expr, time.UTC); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		expr      string
+		now, want time.Time
+	}{
+		// 2024-01-13 is a Saturday.
+		{"0 10 * * 1-5", time.Date(2024, 1, 13, 12, 0, 0, 0, time.UTC), time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)},
+		{"0 10 * * 1-5", time.Date(2024, 1, 15, 9, 59, 30, 0, time.UTC), time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)},
+		{"0 10 * * 1-5", time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC), time.Date(2024, 1, 16, 10, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 15, 10, 7, 0, 0, time.UTC), time.Date(2024, 1, 15, 10, 15, 0, 0, time.UTC)},
+		{"0,30 9-10 * * *", time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC), time.Date(2024, 1, 16, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 */3 *", time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC), time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		// Sunday is both 0 and 7.
+		{"0 12 * * 7", time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 21, 12, 0, 0, 0, time.UTC)},
+		{"0 12 * * 0", time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 21, 12, 0, 0, 0, time.UTC)},
+		// Both day fields restricted: either one matches.
+		{"0 0 1 * 1", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 1", time.Date(2024, 1, 29, 1, 0, 0, 0, time.UTC), time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		// A day field covering its whole range does not restrict the day.
+		{"0 0 1-31 * 1", time.Date(2024, 1, 30, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 */1 * 1", time.Date(2024, 1, 30, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 15 * 0-6", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 15 * 1-7,0", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)},
+		// A restricted day of week with a step still restricts.
+		{"0 0 15 * */2", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Time{}},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr, time.UTC)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.expr, err)
+		}
+		if got := c.Next(tt.now); !got.Equal(tt.want) {
+			t.Errorf("%q: Next(%s) = %s, want %s", tt.expr, tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestCronTimeZone(t *testing.T) {
+	tests := []struct {
+		zone      string
+		now, want time.Time
+	}{
+		// Moscow is UTC+3 the whole year.
+		{"Europe/Moscow", time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 15, 6, 0, 0, 0, time.UTC)},
+		{"Europe/Moscow", time.Date(2024, 1, 15, 6, 0, 0, 0, time.UTC), time.Date(2024, 1, 16, 6, 0, 0, 0, time.UTC)},
+		// 09:00 in Berlin is 08:00 UTC before and 07:00 UTC after the
+		// clocks are moved forward on 2024-03-31.
+		{"Europe/Berlin", time.Date(2024, 3, 30, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 30, 8, 0, 0, 0, time.UTC)},
+		{"Europe/Berlin", time.Date(2024, 3, 30, 12, 0, 0, 0, time.UTC), time.Date(2024, 3, 31, 7, 0, 0, 0, time.UTC)},
+		{"Europe/Berlin", time.Date(2024, 10, 26, 12, 0, 0, 0, time.UTC), time.Date(2024, 10, 27, 8, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		s := mustParse(t, &Spec{TimeZone: loadLocation(t, tt.zone).String(), Cron: "0 9 * * *"})
+		if got := s.Next(tt.now); !got.Equal(tt.want) {
+			t.Errorf("%s: Next(%s) = %s, want %s", tt.zone, tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestCronDue(t *testing.T) {
+	c, err := parseCron("*/15 * * * *", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		now  time.Time
+		want bool
+	}{
+		{time.Date(2024, 1, 15, 10, 14, 59, 0, time.UTC), false},
+		{time.Date(2024, 1, 15, 10, 15, 0, 0, time.UTC), true},
+		{time.Date(2024, 1, 15, 13, 0, 0, 0, time.UTC), true},
+	}
+	for _, tt := range tests {
+		if got := c.Due(last, tt.now); got != tt.want {
+			t.Errorf("Due(%s, %s) = %v, want %v", last, tt.now, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Package schedule decides when the resumes of a user may be updated:
+// inside weekday and hour windows or at the times of a cron expression, in
+// the time zone of the user.
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Spec is a schedule as written in the config or the user settings. Cron,
+// if set, takes the place of Weekdays and Windows. An empty spec allows
+// updates at any time.
+type Spec struct {
+	// TimeZone is an IANA time zone name, UTC if empty.
+	TimeZone string `json:"time_zone,omitempty" yaml:"time_zone"`
+	// Weekdays are the three letter day names, e.g. "mon". Empty means every
+	// day.
+	Weekdays []string `json:"weekdays,omitempty" yaml:"weekdays"`
+	// Windows are the hour ranges like "09:00-12:00". Empty means the whole
+	// day.
+	Windows []string `json:"windows,omitempty" yaml:"windows"`
+	// Cron is a five field cron expression: minute, hour, day of month,
+	// month and day of week.
+	Cron string `json:"cron,omitempty" yaml:"cron"`
+}
+
+// IsZero reports whether the spec has no restrictions.
+func (s *Spec) IsZero() bool {
+	return s == nil || (len(s.TimeZone) == 0 && len(s.Weekdays) == 0 && len(s.Windows) == 0 && len(s.Cron) == 0)
+}
+
+// Schedule is a parsed spec.
+type Schedule interface {
+	// Due reports whether an update should run at now, given the time of
+	// the last scheduled run.
+	Due(last, now time.Time) bool
+	// Next returns the first moment after now the schedule becomes due, or
+	// the zero time if it never does.
+	Next(now time.Time) time.Time
+}
+
+// Always is the schedule of an empty spec.
+type Always struct{}
+
+func (Always) Due(last, now time.Time) bool {
+	return true
+}
+
+func (Always) Next(now time.Time) time.Time {
+	return now
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseWeekday reads a three letter day name, e.g. "mon".
+func ParseWeekday(name string) (time.Weekday, error) {
+	day, ok := weekdays[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return 0, fmt.Errorf("unknown day %q", name)
+	}
+	return day, nil
+}
+
+// Parse checks the spec and returns its schedule.
+func Parse(spec *Spec) (Schedule, error) {
+	if spec.IsZero() {
+		return Always{}, nil
+	}
+	loc := time.UTC
+	if len(spec.TimeZone) != 0 {
+		var err error
+		if loc, err = time.LoadLocation(spec.TimeZone); err != nil {
+			return nil, fmt.Errorf("time_zone: %v", err)
+		}
+	}
+	if len(spec.Cron) != 0 {
+		if len(spec.Weekdays) != 0 || len(spec.Windows) != 0 {
+			return nil, fmt.Errorf("cron can not be combined with weekdays and windows")
+		}
+		c, err := parseCron(spec.Cron, loc)
+		if err != nil {
+			return nil, fmt.Errorf("cron: %v", err)
+		}
+		return c, nil
+	}
+	w := &windowSchedule{loc: loc}
+	for _, name := range spec.Weekdays {
+		day, err := ParseWeekday(name)
+		if err != nil {
+			return nil, fmt.Errorf("weekdays: %v", err)
+		}
+		w.days[day] = true
+	}
+	if len(spec.Weekdays) == 0 {
+		for day := range w.days {
+			w.days[day] = true
+		}
+	}
+	for _, raw := range spec.Windows {
+		win, err := parseWindow(raw)
+		if err != nil {
+			return nil, fmt.Errorf("windows: %v", err)
+		}
+		w.windows = append(w.windows, win)
+	}
+	if len(w.windows) == 0 {
+		w.windows = []window{{from: 0, to: 24 * time.Hour}}
+	}
+	return w, nil
+}
+
+// window is a time of day range, as offsets from the midnight.
+type window struct {
+	from, to time.Duration
+}
+
+func parseClock(raw string) (time.Duration, error) {
+	if raw == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", raw)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseWindow(raw string) (window, error) {
+	parts := strings.Split(strings.TrimSpace(raw), "-")
+	if len(parts) != 2 {
+		return window{}, fmt.Errorf("invalid window %q, want HH:MM-HH:MM", raw)
+	}
+	from, err := parseClock(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return window{}, err
+	}
+	to, err := parseClock(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return window{}, err
+	}
+	if to <= from {
+		return window{}, fmt.Errorf("window %q ends before it starts", raw)
+	}
+	return window{from: from, to: to}, nil
+}
+
+// windowSchedule is due on the allowed weekdays inside the windows.
+type windowSchedule struct {
+	loc     *time.Location
+	days    [7]bool
+	windows []window
+}
+
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// clock returns the wall clock time of day as an offset from the midnight,
+// which differs from the time elapsed since the midnight on the days the
+// clocks are moved.
+func clock(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+}
+
+// at returns the moment of the wall clock offset on the date.
+func at(date time.Time, offset time.Duration, loc *time.Location) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, int(offset), loc)
+}
+
+func (w *windowSchedule) Due(last, now time.Time) bool {
+	now = now.In(w.loc)
+	if !w.days[now.Weekday()] {
+		return false
+	}
+	offset := clock(now)
+	for _, win := range w.windows {
+		if offset >= win.from && offset < win.to {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *windowSchedule) Next(now time.Time) time.Time {
+	if w.Due(time.Time{}, now) {
+		return now
+	}
+	local := now.In(w.loc)
+	var next time.Time
+	for day := 0; day <= 7; day++ {
+		date := midnight(local.AddDate(0, 0, day))
+		if !w.days[date.Weekday()] {
+			continue
+		}
+		for _, win := range w.windows {
+			start := at(date, win.from, w.loc)
+			if start.After(now) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+		if !next.IsZero() {
+			return next
+		}
+	}
+	return next
+}
@@ -0,0 +1,161 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone %s not available: %v", name, err)
+	}
+	return loc
+}
+
+func mustParse(t *testing.T, spec *Spec) Schedule {
+	s, err := Parse(spec)
+	if err != nil {
+		t.Fatalf("Parse(%+v): %v", spec, err)
+	}
+	return s
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		spec Spec
+	}{
+		{"unknown weekday", Spec{Weekdays: []string{"monday"}}},
+		{"window without end", Spec{Windows: []string{"09:00"}}},
+		{"window ends before start", Spec{Windows: []string{"12:00-09:00"}}},
+		{"empty window", Spec{Windows: []string{"09:00-09:00"}}},
+		{"invalid clock", Spec{Windows: []string{"9-12"}}},
+		{"unknown time zone", Spec{TimeZone: "Mars/Olympus"}},
+		{"cron with windows", Spec{Cron: "0 10 * * *", Windows: []string{"09:00-12:00"}}},
+		{"invalid cron", Spec{Cron: "0 10 * *"}},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(&tt.spec); err == nil {
+			t.Errorf("%s: Parse(%+v) succeeded, want an error", tt.name, tt.spec)
+		}
+	}
+}
+
+func TestEmptySpecIsAlways(t *testing.T) {
+	s := mustParse(t, &Spec{})
+	if _, ok := s.(Always); !ok {
+		t.Fatalf("Parse of an empty spec = %T, want Always", s)
+	}
+	now := time.Date(2024, 1, 15, 3, 0, 0, 0, time.UTC)
+	if !s.Due(time.Time{}, now) || !s.Next(now).Equal(now) {
+		t.Errorf("Always is not due at %s", now)
+	}
+}
+
+func TestWindowDue(t *testing.T) {
+	s := mustParse(t, &Spec{
+		Weekdays: []string{"mon", "Tue", "wed", "thu", "fri"},
+		Windows:  []string{"09:00-12:00", "14:00-16:00"},
+	})
+	tests := []struct {
+		now  time.Time
+		want bool
+	}{
+		// 2024-01-15 is a Monday.
+		{time.Date(2024, 1, 15, 8, 59, 0, 0, time.UTC), false},
+		{time.Date(2024, 1, 15, 9, 0, 0, 0, time.UTC), true},
+		{time.Date(2024, 1, 15, 11, 59, 59, 0, time.UTC), true},
+		{time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC), false},
+		{time.Date(2024, 1, 15, 15, 30, 0, 0, time.UTC), true},
+		{time.Date(2024, 1, 19, 10, 0, 0, 0, time.UTC), true},
+		{time.Date(2024, 1, 20, 10, 0, 0, 0, time.UTC), false},
+		{time.Date(2024, 1, 21, 15, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		if got := s.Due(time.Time{}, tt.now); got != tt.want {
+			t.Errorf("Due(%s) = %v, want %v", tt.now.Format(time.RFC1123), got, tt.want)
+		}
+	}
+}
+
+func TestWindowNext(t *testing.T) {
+	s := mustParse(t, &Spec{
+		Weekdays: []string{"mon", "tue", "wed", "thu", "fri"},
+		Windows:  []string{"09:00-12:00", "14:00-16:00", "22:00-24:00"},
+	})
+	tests := []struct {
+		now, want time.Time
+	}{
+		{time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC), time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 1, 15, 12, 30, 0, 0, time.UTC), time.Date(2024, 1, 15, 14, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 1, 15, 16, 0, 0, 0, time.UTC), time.Date(2024, 1, 15, 22, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 1, 15, 23, 59, 0, 0, time.UTC), time.Date(2024, 1, 15, 23, 59, 0, 0, time.UTC)},
+		{time.Date(2024, 1, 19, 16, 0, 0, 0, time.UTC), time.Date(2024, 1, 19, 22, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 1, 20, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 22, 9, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := s.Next(tt.now); !got.Equal(tt.want) {
+			t.Errorf("Next(%s) = %s, want %s", tt.now.Format(time.RFC1123), got, tt.want)
+		}
+	}
+}
+
+func TestWindowTimeZone(t *testing.T) {
+	loadLocation(t, "Europe/Moscow")
+	s := mustParse(t, &Spec{TimeZone: "Europe/Moscow", Weekdays: []string{"mon"}, Windows: []string{"09:00-10:00"}})
+	tests := []struct {
+		now  time.Time
+		want bool
+	}{
+		// Moscow is UTC+3, so 09:00-10:00 there is 06:00-07:00 UTC.
+		{time.Date(2024, 1, 15, 6, 30, 0, 0, time.UTC), true},
+		{time.Date(2024, 1, 15, 9, 30, 0, 0, time.UTC), false},
+		// Monday 02:00 in Moscow is still Sunday in UTC.
+		{time.Date(2024, 1, 14, 23, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		if got := s.Due(time.Time{}, tt.now); got != tt.want {
+			t.Errorf("Due(%s) = %v, want %v", tt.now, got, tt.want)
+		}
+	}
+	now := time.Date(2024, 1, 15, 7, 0, 0, 0, time.UTC)
+	if got, want := s.Next(now), time.Date(2024, 1, 22, 6, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Next(%s) = %s, want %s", now, got, want)
+	}
+}
+
+func TestWindowDaylightSaving(t *testing.T) {
+	loadLocation(t, "Europe/Berlin")
+	s := mustParse(t, &Spec{TimeZone: "Europe/Berlin", Windows: []string{"09:00-10:00"}})
+	tests := []struct {
+		name string
+		now  time.Time
+		want bool
+	}{
+		// On 2024-03-31 the clocks go from 02:00 CET to 03:00 CEST.
+		{"spring forward inside", time.Date(2024, 3, 31, 7, 30, 0, 0, time.UTC), true},
+		{"spring forward before", time.Date(2024, 3, 31, 6, 30, 0, 0, time.UTC), false},
+		{"spring forward after", time.Date(2024, 3, 31, 8, 30, 0, 0, time.UTC), false},
+		// On 2024-10-27 the clocks go from 03:00 CEST back to 02:00 CET.
+		{"fall back inside", time.Date(2024, 10, 27, 8, 30, 0, 0, time.UTC), true},
+		{"fall back before", time.Date(2024, 10, 27, 7, 30, 0, 0, time.UTC), false},
+		{"fall back after", time.Date(2024, 10, 27, 9, 30, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		if got := s.Due(time.Time{}, tt.now); got != tt.want {
+			t.Errorf("%s: Due(%s) = %v, want %v", tt.name, tt.now, got, tt.want)
+		}
+	}
+	nexts := []struct {
+		now, want time.Time
+	}{
+		{time.Date(2024, 3, 30, 23, 30, 0, 0, time.UTC), time.Date(2024, 3, 31, 7, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 10, 26, 22, 30, 0, 0, time.UTC), time.Date(2024, 10, 27, 8, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range nexts {
+		if got := s.Next(tt.now); !got.Equal(tt.want) {
+			t.Errorf("Next(%s) = %s, want %s", tt.now, got, tt.want)
+		}
+	}
+}
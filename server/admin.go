@@ -0,0 +1,297 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/artkescha/hh-updater/logging"
+	"github.com/boltdb/bolt"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultAdminPageSize = 50
+	MaxAdminPageSize     = 500
+
+	AuditForceUpdate = "user.update"
+	AuditPause       = "user.pause"
+	AuditResume      = "user.resume"
+	AuditRevoke      = "user.revoke_sessions"
+	AuditDelete      = "user.delete"
+
+	AuditWebhookCreate = "webhook.create"
+	AuditWebhookDelete = "webhook.delete"
+)
+
+var AuditBucket = []byte("auditv1")
+
+// AuditEntry records an action of an admin.
+type AuditEntry struct {
+	ID       uint64    `json:"id"`
+	At       time.Time `json:"at"`
+	AdminID  string    `json:"admin_id"`
+	Action   string    `json:"action"`
+	TargetID string    `json:"target_id"`
+}
+
+// AdminUser is a user as listed in the admin console.
+type AdminUser struct {
+	ID          string     `json:"id"`
+	Email       string     `json:"email"`
+	State       string     `json:"state"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	UpdateCount int        `json:"update_count"`
+	Resumes     int        `json:"resumes"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	TokenExpiry *time.Time `json:"token_expiry,omitempty"`
+}
+
+// AdminStatus is the state of the server shown in the admin console.
+type AdminStatus struct {
+	Users          map[string]float64 `json:"users"`
+	TokenRefresher RefresherStats     `json:"token_refresher"`
+}
+
+// Page is a page of a list returned by the admin API.
+type Page struct {
+	Items   interface{} `json:"items"`
+	Total   int         `json:"total"`
+	Page    int         `json:"page"`
+	PerPage int         `json:"per_page"`
+}
+
+func (s *Server) isAdmin(user *User) bool {
+	for _, id := range s.conf().AdminIDs {
+		if id == user.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// Admin lets only the users listed in admin_ids through. The requests
+// changing something must come from the pages of the public URL.
+func (s *Server) Admin(next http.HandlerFunc) http.HandlerFunc {
+	return s.Auth(func(w http.ResponseWriter, r *http.Request) {
+		user := GetUserFromContext(r)
+		if user == nil || !s.isAdmin(user) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !s.sameOrigin(r) {
+			requestLog(r).Warnf("Cross-origin admin request from %q", r.Header.Get("Origin"))
+			http.Error(w, "Cross-origin request", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// pagination reads the 1-based page and the page size of the request.
+func pagination(r *http.Request) (page, perPage int) {
+	page, _ = strconv.Atoi(r.FormValue("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ = strconv.Atoi(r.FormValue("per_page"))
+	if perPage < 1 {
+		perPage = DefaultAdminPageSize
+	}
+	if perPage > MaxAdminPageSize {
+		perPage = MaxAdminPageSize
+	}
+	return page, perPage
+}
+
+func pageBounds(total, page, perPage int) (from, to int) {
+	from = (page - 1) * perPage
+	if from > total {
+		from = total
+	}
+	to = from + perPage
+	if to > total {
+		to = total
+	}
+	return from, to
+}
+
+func (s *Server) adminUser(user *User) *AdminUser {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	au := &AdminUser{
+		ID:          user.ID,
+		Email:       user.Email,
+		UpdatedAt:   user.UpdatedAt,
+		UpdateCount: user.UpdateCount,
+		Resumes:     len(user.Resumes),
+		LastError:   user.LastError,
+		LastErrorAt: user.LastErrorAt,
+		State:       userState(user, time.Now()),
+	}
+	if user.Token != nil && !user.Token.Expiry.IsZero() {
+		expiry := user.Token.Expiry
+		au.TokenExpiry = &expiry
+	}
+	return au
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, fmt.Sprintf("Cannot encode response data: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// AdminUsersHandler lists the users sorted by ID.
+func (s *Server) AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	page, perPage := pagination(r)
+	users := s.Users()
+	from, to := pageBounds(len(users), page, perPage)
+	items := make([]*AdminUser, 0, to-from)
+	for _, user := range users[from:to] {
+		items = append(items, s.adminUser(user))
+	}
+	writeJSON(w, &Page{Items: items, Total: len(users), Page: page, PerPage: perPage})
+}
+
+// AdminStatusHandler shows the users by state and the token refresh counts
+// since the start.
+func (s *Server) AdminStatusHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, &AdminStatus{Users: s.usersByState(), TokenRefresher: s.refresher.Stats()})
+}
+
+// AdminActionHandler applies an action to the user given by the id form
+// value and writes it to the audit log.
+func (s *Server) AdminActionHandler(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin := GetUserFromContext(r)
+		if admin == nil {
+			http.Error(w, "Empty user data", http.StatusInternalServerError)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, ok := s.getUser(r.FormValue("id"))
+		if !ok {
+			http.Error(w, ErrUserNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		// The action is logged first, so none goes unrecorded.
+		if err := s.audit(admin, action, user.ID); err != nil {
+			requestLog(r).Errorf("Error writing audit log: %v", err)
+			http.Error(w, fmt.Sprintf("Cannot write audit log: %v", err), http.StatusInternalServerError)
+			return
+		}
+		switch action {
+		case AuditForceUpdate:
+			if _, err := s.StartUpdateJob(user, true); err != nil {
+				http.Error(w, err.Error(), jobErrorStatus(err))
+				return
+			}
+		case AuditPause:
+			// A pause keeps the token refreshed, unlike disabling.
+			s.SetPause(user, "", &Pause{Since: time.Now().UTC()})
+		case AuditResume:
+			s.SetPause(user, "", nil)
+			s.SetUserDisabled(user, false)
+		case AuditRevoke:
+			s.RevokeSessions(user)
+		case AuditDelete:
+			s.DeleteUser(user)
+		}
+		writeJSON(w, s.adminUser(user))
+	}
+}
+
+// AdminAuditHandler lists the audit log, newest first.
+func (s *Server) AdminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	page, perPage := pagination(r)
+	entries, total, err := s.auditLog(page, perPage)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Cannot read audit log: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, &Page{Items: entries, Total: total, Page: page, PerPage: perPage})
+}
+
+func (s *Server) audit(admin *User, action, targetID string) error {
+	entry := &AuditEntry{At: time.Now().UTC(), AdminID: admin.ID, Action: action, TargetID: targetID}
+	logrus.WithFields(logrus.Fields{"admin_id": admin.ID, logging.FieldUserID: targetID}).
+		Infof("Admin action %s", action)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(AuditBucket)
+		if b == nil {
+			return fmt.Errorf("bucket %s not found", AuditBucket)
+		}
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		entry.ID = id
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return b.Put(itob(id), encoded)
+	})
+}
+
+func (s *Server) auditLog(page, perPage int) ([]*AuditEntry, int, error) {
+	entries := []*AuditEntry{}
+	var total int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(AuditBucket)
+		total = b.Stats().KeyN
+		from, to := pageBounds(total, page, perPage)
+		c := b.Cursor()
+		idx := 0
+		for k, v := c.Last(); k != nil && idx < to; k, v = c.Prev() {
+			if idx >= from {
+				var entry AuditEntry
+				if err := json.Unmarshal(v, &entry); err != nil {
+					return err
+				}
+				entries = append(entries, &entry)
+			}
+			idx++
+		}
+		return nil
+	})
+	return entries, total, err
+}
+
+func (s *Server) sessionEpoch(user *User) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return user.SessionEpoch
+}
+
+// recordUserError keeps the error of the last update for the admin console.
+func (s *Server) recordUserError(user *User, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil || err == ErrEmptyResumeList {
+		user.LastError = ""
+		user.LastErrorAt = nil
+	} else {
+		now := time.Now().UTC()
+		user.LastError = err.Error()
+		user.LastErrorAt = &now
+	}
+	s.userListChanged = true
+}
+
+// RevokeSessions invalidates the cookies issued to the user so far.
+func (s *Server) RevokeSessions(user *User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user.SessionEpoch++
+	s.userListChanged = true
+}
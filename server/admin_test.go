@@ -0,0 +1,114 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestAdminRefusesCrossOrigin(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	s.c.PublicURLRaw = "https://hh.example.com"
+	s.c.PublicURL, _ = url.Parse(s.c.PublicURLRaw)
+	s.c.AdminIDs = []string{"admin"}
+	for _, id := range []string{"admin", "user"} {
+		s.userList[id] = &User{ID: id}
+	}
+	session := func(id string) string {
+		cookie, err := s.Encrypt(&SafeUser{ID: id, Purpose: sessionPurpose})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cookie
+	}
+	tests := []struct {
+		name    string
+		user    string
+		method  string
+		headers map[string]string
+		want    int
+	}{
+		{"read without origin", "admin", http.MethodGet, nil, http.StatusOK},
+		{"same origin", "admin", http.MethodPost, map[string]string{"Origin": "https://hh.example.com"}, http.StatusOK},
+		{"same origin referer", "admin", http.MethodPost, map[string]string{"Referer": "https://hh.example.com/admin"}, http.StatusOK},
+		{"no origin", "admin", http.MethodPost, nil, http.StatusForbidden},
+		{"other origin", "admin", http.MethodPost, map[string]string{"Origin": "https://evil.example.com"}, http.StatusForbidden},
+		{"suffixed host", "admin", http.MethodPost, map[string]string{"Origin": "https://hh.example.com.evil.com"}, http.StatusForbidden},
+		{"plain http", "admin", http.MethodPost, map[string]string{"Origin": "http://hh.example.com"}, http.StatusForbidden},
+		{"null origin", "admin", http.MethodPost, map[string]string{"Origin": "null"}, http.StatusForbidden},
+		{"other referer", "admin", http.MethodDelete, map[string]string{"Referer": "https://evil.example.com/hh.example.com"}, http.StatusForbidden},
+		{"origin wins over referer", "admin", http.MethodPost, map[string]string{
+			"Origin": "https://evil.example.com", "Referer": "https://hh.example.com/admin",
+		}, http.StatusForbidden},
+		{"not an admin", "user", http.MethodPost, map[string]string{"Origin": "https://hh.example.com"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		called := false
+		handler := s.Admin(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		})
+		r := httptest.NewRequest(tt.method, "/admin/users/delete?id=user", nil)
+		r.AddCookie(&http.Cookie{Name: s.conf().CookieName, Value: session(tt.user)})
+		for name, value := range tt.headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != tt.want || called != (tt.want == http.StatusOK) {
+			t.Errorf("%s: status %d, handler called %v, want %d", tt.name, w.Code, called, tt.want)
+		}
+	}
+}
+
+func TestAdminActionAuditFirst(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	admin := &User{ID: "admin"}
+	user := &User{ID: "u1"}
+	s.userList[user.ID] = user
+	action := func(name string) int {
+		r := httptest.NewRequest(http.MethodPost, "/admin/users?id="+user.ID, nil)
+		w := httptest.NewRecorder()
+		s.AdminActionHandler(name)(w, SetUserToContext(r, admin))
+		return w.Code
+	}
+	if code := action(AuditRevoke); code != http.StatusOK {
+		t.Fatalf("revoke: status %d", code)
+	}
+	entries, _, err := s.auditLog(1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Action != AuditRevoke || entries[0].AdminID != admin.ID || entries[0].TargetID != user.ID {
+		t.Errorf("audit log %+v, want the revoke", entries)
+	}
+
+	// Without the audit log the actions are refused.
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(AuditBucket)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{AuditForceUpdate, AuditPause, AuditRevoke, AuditDelete} {
+		if code := action(name); code != http.StatusInternalServerError {
+			t.Errorf("%s without the audit log: status %d, want %d", name, code, http.StatusInternalServerError)
+		}
+	}
+	if _, ok := s.getUser(user.ID); !ok {
+		t.Error("user deleted without an audit entry")
+	}
+	if user.Pause != nil || user.SessionEpoch != 1 {
+		t.Errorf("user changed without an audit entry: pause %+v, session epoch %d", user.Pause, user.SessionEpoch)
+	}
+	s.jobs.mu.Lock()
+	started := len(s.jobs.byID)
+	s.jobs.mu.Unlock()
+	if started != 0 {
+		t.Error("update started without an audit entry")
+	}
+}
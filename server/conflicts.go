@@ -0,0 +1,34 @@
+package server
+
+import (
+	"errors"
+	"time"
+
+	"github.com/artkescha/hh-updater/hhclient"
+)
+
+const maxEditAttempts = 3
+
+var ErrResumeConflict = errors.New("Resume keeps changing on hh, edit aborted")
+
+// checkConflict re-reads the resume and reports whether it was modified on hh
+// after it had been read for the edit.
+func checkConflict(client *hhclient.Client, read *hhclient.Resume) (bool, error) {
+	current, err := client.Resume.ReadResume(read.ID)
+	if err != nil {
+		return false, err
+	}
+	if len(read.ETag) != 0 && len(current.ETag) != 0 {
+		return read.ETag != current.ETag, nil
+	}
+	return read.UpdatedAt != current.UpdatedAt, nil
+}
+
+func (s *Server) recordConflict(user *User, resumeID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := user.resumeState(resumeID)
+	state.Conflicts++
+	state.LastConflictAt = time.Now().UTC()
+	s.userListChanged = true
+}
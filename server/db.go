@@ -0,0 +1,212 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	MetaBucket       = []byte("meta")
+	SchemaVersionKey = []byte("schema_version")
+)
+
+// migrations bring the database to the current schema. The schema version
+// stored in the database is the number of migrations applied, so new
+// migrations must only be appended.
+var migrations = []func(tx *bolt.Tx) error{
+	// 1: initial buckets.
+	func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{UsersBucket, SnapshotsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 2: admin audit log.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(AuditBucket)
+		return err
+	},
+	// 3: webhooks, their outbox and delivery logs.
+	func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{WebhooksBucket, OutboxBucket, DeliveriesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+var dbOptions = &bolt.Options{
+	// Fail instead of hanging if another process has the database open.
+	Timeout: time.Second,
+}
+
+func schemaVersion(tx *bolt.Tx) int {
+	b := tx.Bucket(MetaBucket)
+	if b == nil {
+		return 0
+	}
+	v := b.Get(SchemaVersionKey)
+	if len(v) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(v))
+}
+
+// Migrate applies the pending migrations and returns the schema versions
+// before and after.
+func (s *Server) Migrate() (int, int, error) {
+	var from, to int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		from = schemaVersion(tx)
+		meta, err := tx.CreateBucketIfNotExists(MetaBucket)
+		if err != nil {
+			return err
+		}
+		for to = from; to < len(migrations); to++ {
+			if err := migrations[to](tx); err != nil {
+				return fmt.Errorf("migration %d: %v", to+1, err)
+			}
+		}
+		return meta.Put(SchemaVersionKey, itob(uint64(to)))
+	})
+	if err == nil && from != to {
+		logrus.Infof("Database migrated from version %d to %d", from, to)
+	}
+	return from, to, err
+}
+
+// BackupDatabase writes a consistent copy of the database at path to w. The
+// database is opened read-only, so it is neither migrated nor written.
+func BackupDatabase(path string, w io.Writer) (int64, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: dbOptions.Timeout, ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	var n int64
+	err = db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// RestoreDatabase replaces the database at path with the backup. The
+// database must not be in use.
+func RestoreDatabase(path, backup string) error {
+	// Make sure the backup is a valid database before touching anything.
+	db, err := bolt.Open(backup, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("invalid backup: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+	lock, err := bolt.Open(path, 0600, dbOptions)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	return copyFile(backup, path)
+}
+
+// CompactDatabase rewrites the database at path dropping the free pages.
+// The database must not be in use.
+func CompactDatabase(path string) (int64, int64, error) {
+	src, err := bolt.Open(path, 0600, dbOptions)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer src.Close()
+	tmp := path + ".compact"
+	// A copy left by an interrupted run would be reopened with its buckets.
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return 0, 0, err
+	}
+	dst, err := bolt.Open(tmp, 0600, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = src.View(func(stx *bolt.Tx) error {
+		return dst.Update(func(dtx *bolt.Tx) error {
+			return stx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				nb, err := dtx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(b, nb)
+			})
+		})
+	})
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, 0, err
+	}
+	before, after := fileSize(path), fileSize(tmp)
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, 0, err
+	}
+	return before, after, nil
+}
+
+func copyBucket(src, dst *bolt.Bucket) error {
+	dst.FillPercent = 1
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		nb, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(src.Bucket(k), nb)
+	})
+}
+
+func copyFile(from, to string) error {
+	data, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(to), filepath.Base(to)+".restore")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), to)
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"crypto/aes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/artkescha/hh-updater/config"
+	"github.com/boltdb/bolt"
+)
+
+// newTestServer returns a server with the default config and an empty
+// database in a temporary directory, migrated to the current schema.
+func newTestServer(t *testing.T) (*Server, func()) {
+	dir, err := ioutil.TempDir("", "hh-updater")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := config.Default()
+	conf.DatabasePath = filepath.Join(dir, "database.db")
+	conf.CookieEncryptionKey = "0123456789abcdef0123456789abcdef"
+	if conf.CookieEncryptionCipher, err = aes.NewCipher([]byte(conf.CookieEncryptionKey)); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(conf)
+	if err := s.Init(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, func() {
+		s.db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hh-updater")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	buckets := [][]byte{UsersBucket, SnapshotsBucket, AuditBucket, WebhooksBucket, OutboxBucket, DeliveriesBucket}
+	for start := 0; start <= len(migrations); start++ {
+		db, err := bolt.Open(filepath.Join(dir, "database.db"), 0600, dbOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Bring the database to the start version as an older release
+		// would have left it, with a user stored.
+		err = db.Update(func(tx *bolt.Tx) error {
+			for _, migrate := range migrations[:start] {
+				if err := migrate(tx); err != nil {
+					return err
+				}
+			}
+			if start == 0 {
+				return nil
+			}
+			if err := tx.Bucket(UsersBucket).Put([]byte("u1"), []byte("{}")); err != nil {
+				return err
+			}
+			meta, err := tx.CreateBucketIfNotExists(MetaBucket)
+			if err != nil {
+				return err
+			}
+			return meta.Put(SchemaVersionKey, itob(uint64(start)))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{db: db}
+		for run := 0; run < 2; run++ {
+			from, to, err := s.Migrate()
+			if err != nil {
+				t.Fatalf("start %d, run %d: Migrate: %v", start, run, err)
+			}
+			wantFrom := start
+			if run == 1 {
+				wantFrom = len(migrations)
+			}
+			if from != wantFrom || to != len(migrations) {
+				t.Errorf("start %d, run %d: Migrate = %d, %d, want %d, %d", start, run, from, to, wantFrom, len(migrations))
+			}
+		}
+		err = db.View(func(tx *bolt.Tx) error {
+			if got := schemaVersion(tx); got != len(migrations) {
+				t.Errorf("start %d: schema version %d, want %d", start, got, len(migrations))
+			}
+			for _, name := range buckets {
+				if tx.Bucket(name) == nil {
+					t.Errorf("start %d: bucket %s missing", start, name)
+				}
+			}
+			if start != 0 && tx.Bucket(UsersBucket).Get([]byte("u1")) == nil {
+				t.Errorf("start %d: stored user lost", start)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		os.Remove(filepath.Join(dir, "database.db"))
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	tests := []struct {
+		name  string
+		value []byte
+		want  int
+	}{
+		{"current", itob(uint64(len(migrations))), len(migrations)},
+		{"malformed", []byte("3"), 0},
+		{"empty", []byte{}, 0},
+	}
+	for _, tt := range tests {
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			if err := tx.Bucket(MetaBucket).Put(SchemaVersionKey, tt.value); err != nil {
+				return err
+			}
+			if got := schemaVersion(tx); got != tt.want {
+				t.Errorf("%s: schemaVersion = %d, want %d", tt.name, got, tt.want)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestDatabase creates a database with a legacy bucket holding a key and
+// no schema version, as the oldest release left it.
+func newTestDatabase(t *testing.T, path, bucket string) {
+	db, err := bolt.Open(path, 0600, dbOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("key"), []byte("value"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// databaseBuckets lists the top level buckets of the database at path.
+func databaseBuckets(t *testing.T, path string) []string {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var names []string
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			names = append(names, string(name))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestBackupDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hh-updater")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "database.db")
+	newTestDatabase(t, path, "legacy")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backup := filepath.Join(dir, "backup.db")
+	f, err := os.Create(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := BackupDatabase(path, f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backupInfo, err := os.Stat(backup); err != nil || backupInfo.Size() != n {
+		t.Errorf("%d bytes written, backup %+v: %v", n, backupInfo, err)
+	}
+	for _, p := range []string{path, backup} {
+		if got := databaseBuckets(t, p); !reflect.DeepEqual(got, []string{"legacy"}) {
+			t.Errorf("%s: buckets %v, want only the legacy one", p, got)
+		}
+	}
+	if after, err := os.Stat(path); err != nil || !after.ModTime().Equal(info.ModTime()) {
+		t.Errorf("database written by the backup: %v", err)
+	}
+}
+
+func TestCompactDatabaseLeftover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hh-updater")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "database.db")
+	newTestDatabase(t, path, "current")
+	// An interrupted compaction left its copy behind.
+	newTestDatabase(t, path+".compact", "stale")
+
+	if _, _, err := CompactDatabase(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := databaseBuckets(t, path); !reflect.DeepEqual(got, []string{"current"}) {
+		t.Errorf("buckets %v, want only the current one", got)
+	}
+	if _, err := os.Stat(path + ".compact"); !os.IsNotExist(err) {
+		t.Errorf("compact copy left: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"time"
+
+	"github.com/artkescha/hh-updater/hhclient"
+	"github.com/artkescha/hh-updater/logging"
+	"github.com/artkescha/hh-updater/schedule"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	digestCheckInterval = time.Hour
+	// digestMinPeriod keeps the users who have just signed up from getting
+	// an empty digest.
+	digestMinPeriod = 24 * time.Hour
+	// digestGap is the least time between two digests of a user, less than
+	// a week so the digest hour does not drift.
+	digestGap = 6 * 24 * time.Hour
+)
+
+// Digest collects what happened to the user resumes since the last weekly
+// digest.
+type Digest struct {
+	Since   time.Time                `json:"since"`
+	Resumes map[string]*DigestResume `json:"resumes"`
+}
+
+// DigestResume is the resume part of the digest. StartViews is the view
+// count when the digest period started.
+type DigestResume struct {
+	Title      string `json:"title"`
+	Publishes  int    `json:"publishes"`
+	StartViews int    `json:"start_views"`
+	TotalViews int    `json:"total_views"`
+	NewViews   int    `json:"new_views"`
+}
+
+func (d *DigestResume) ViewsGained() int {
+	if d.StartViews < 0 {
+		return 0
+	}
+	return d.TotalViews - d.StartViews
+}
+
+// digestResume returns the digest of the resume, starting the digest if
+// needed. The caller must hold s.mu for writing.
+func (u *User) digestResume(resumeID string) *DigestResume {
+	if u.Digest == nil {
+		u.Digest = &Digest{Since: time.Now().UTC()}
+	}
+	if u.Digest.Resumes == nil {
+		u.Digest.Resumes = map[string]*DigestResume{}
+	}
+	d, ok := u.Digest.Resumes[resumeID]
+	if !ok {
+		d = &DigestResume{StartViews: -1}
+		u.Digest.Resumes[resumeID] = d
+	}
+	return d
+}
+
+// recordViews keeps the view counters of the resume for the digest.
+func (s *Server) recordViews(user *User, r *hhclient.Resume) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := user.digestResume(r.ID)
+	if d.StartViews < 0 {
+		d.StartViews = r.TotalViews
+	}
+	d.Title = r.Title
+	d.TotalViews = r.TotalViews
+	d.NewViews = r.NewViews
+	s.userListChanged = true
+}
+
+// DigestLoop sends the weekly digests. It runs whether or not the emails
+// are enabled, since a reload may enable them.
+func (s *Server) DigestLoop() {
+	for {
+		s.health.beat(LoopDigest)
+		s.sendDigests(time.Now())
+		if !s.sleep(digestCheckInterval) {
+			return
+		}
+	}
+}
+
+// sendDigests sends the digests due at now, i.e. on the digest weekday
+// after the digest hour.
+func (s *Server) sendDigests(now time.Time) {
+	conf := s.conf().SMTP
+	if !conf.Enabled() {
+		return
+	}
+	loc, err := time.LoadLocation(conf.DigestTimeZone)
+	if err != nil {
+		logrus.Errorf("Error loading digest time zone: %v", err)
+		return
+	}
+	day, err := schedule.ParseWeekday(conf.DigestWeekday)
+	if err != nil {
+		logrus.Errorf("Error reading digest weekday: %v", err)
+		return
+	}
+	local := now.In(loc)
+	if local.Weekday() != day || local.Hour() < conf.DigestHour {
+		return
+	}
+	for _, user := range s.users() {
+		if s.stopping() {
+			return
+		}
+		data := s.digestData(user, now)
+		if data == nil {
+			continue
+		}
+		if err := s.sendEmail(user, EmailDigest, data); err != nil {
+			logrus.WithField(logging.FieldUserID, user.ID).Errorf("Error sending digest: %v", err)
+			continue
+		}
+		s.digestSent(user, now)
+	}
+}
+
+// digestData returns the digest of the user if it is due at now, nil
+// otherwise.
+func (s *Server) digestData(user *User, now time.Time) *DigestData {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	digest := user.Digest
+	switch {
+	case user.Disabled, user.UnsubscribedDigest, len(user.Email) == 0:
+		return nil
+	case digest == nil || len(digest.Resumes) == 0 || now.Sub(digest.Since) < digestMinPeriod:
+		return nil
+	case user.LastDigestAt != nil && now.Sub(*user.LastDigestAt) < digestGap:
+		return nil
+	}
+	data := &DigestData{Since: digest.Since, Until: now}
+	for _, d := range digest.Resumes {
+		resume := *d
+		data.Resumes = append(data.Resumes, &resume)
+		data.Publishes += d.Publishes
+		data.ViewsGained += d.ViewsGained()
+		data.NewViews += d.NewViews
+	}
+	return data
+}
+
+// digestSent starts the next digest period, carrying the view counters
+// over.
+func (s *Server) digestSent(user *User, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	at := now.UTC()
+	user.LastDigestAt = &at
+	next := &Digest{Since: at, Resumes: map[string]*DigestResume{}}
+	if user.Digest != nil {
+		for id, d := range user.Digest.Resumes {
+			next.Resumes[id] = &DigestResume{
+				Title:      d.Title,
+				StartViews: d.TotalViews,
+				TotalViews: d.TotalViews,
+				NewViews:   d.NewViews,
+			}
+		}
+	}
+	user.Digest = next
+	s.userListChanged = true
+}
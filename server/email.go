@@ -0,0 +1,498 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	textTemplate "text/template"
+	"time"
+
+	"github.com/artkescha/hh-updater/config"
+	"github.com/artkescha/hh-updater/logging"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	EmailAlert  = "alert"
+	EmailDigest = "digest"
+
+	smtpTimeout = 30 * time.Second
+	// emailQueueSize is how many alerts may wait for the email loop.
+	emailQueueSize = 100
+	// emailIdleInterval is how often the idle email loop reports a
+	// heartbeat.
+	emailIdleInterval = time.Minute
+	// unsubscribeTokenTTL is how long the unsubscribe link of an email
+	// stays valid.
+	unsubscribeTokenTTL = 90 * 24 * time.Hour
+)
+
+var (
+	ErrNoEmail            = errors.New("User has no email")
+	ErrInvalidUnsubscribe = errors.New("Invalid unsubscribe link")
+	ErrExpiredUnsubscribe = errors.New("Unsubscribe link expired")
+	ErrEmailQueueFull     = errors.New("Email queue full")
+)
+
+// alertEvents are the events sent by email right away, the others only go
+// to the UI.
+var alertEvents = map[string]bool{
+	EventResumeBlocked: true,
+	EventResumeFailing: true,
+	EventTokenExpired:  true,
+}
+
+// EmailNotifier queues the alerts for the email loop, which sends them by
+// SMTP, so a slow SMTP server does not hold the update. The config is read
+// on every email, so a reload applies at once.
+type EmailNotifier struct {
+	s *Server
+}
+
+func (n *EmailNotifier) Notify(user *User, event *Event) error {
+	if !n.s.conf().SMTP.Enabled() || !alertEvents[event.Type] {
+		return nil
+	}
+	n.s.mu.RLock()
+	unsubscribed := user.UnsubscribedAlerts
+	n.s.mu.RUnlock()
+	if unsubscribed {
+		return nil
+	}
+	select {
+	case n.s.emails <- &queuedEmail{user: user, kind: EmailAlert, data: &AlertData{Event: event}}:
+		return nil
+	default:
+		return ErrEmailQueueFull
+	}
+}
+
+// queuedEmail is an email waiting for the email loop, the arguments of
+// sendEmail.
+type queuedEmail struct {
+	user *User
+	kind string
+	data interface{}
+}
+
+// EmailLoop sends the queued alerts. The alerts still queued on stop are
+// dropped.
+func (s *Server) EmailLoop() {
+	ticker := time.NewTicker(emailIdleInterval)
+	defer ticker.Stop()
+	for {
+		s.health.beat(LoopEmail)
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		case email := <-s.emails:
+			if err := s.sendEmail(email.user, email.kind, email.data); err != nil {
+				logrus.WithField(logging.FieldUserID, email.user.ID).Errorf("Error sending email: %v", err)
+			}
+		}
+	}
+}
+
+// AlertData is available to the alert templates.
+type AlertData struct {
+	Event          *Event
+	PublicURL      string
+	UnsubscribeURL string
+}
+
+// DigestData is available to the digest templates.
+type DigestData struct {
+	Since          time.Time
+	Until          time.Time
+	Publishes      int
+	ViewsGained    int
+	NewViews       int
+	Resumes        []*DigestResume
+	PublicURL      string
+	UnsubscribeURL string
+}
+
+// unsubscribeToken is signed into the unsubscribe links. It is not
+// encrypted with the cookie cipher, so it can never pass for a session.
+type unsubscribeToken struct {
+	ID      string `json:"id"`
+	Kind    string `json:"kind"`
+	Expires int64  `json:"exp"`
+}
+
+// unsubscribeKey is the key of the unsubscribe link signatures, derived
+// from the cookie encryption key.
+func (s *Server) unsubscribeKey() []byte {
+	mac := hmac.New(sha256.New, []byte(s.conf().CookieEncryptionKey))
+	mac.Write([]byte("unsubscribe"))
+	return mac.Sum(nil)
+}
+
+// signUnsubscribe returns the token of an unsubscribe link: the payload and
+// its signature, both base64url encoded and joined by a dot.
+func (s *Server) signUnsubscribe(t *unsubscribeToken) (string, error) {
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, s.unsubscribeKey())
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyUnsubscribe checks the signature and the expiry of an unsubscribe
+// token made by signUnsubscribe.
+func (s *Server) verifyUnsubscribe(token string, now time.Time) (*unsubscribeToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalidUnsubscribe
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidUnsubscribe
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidUnsubscribe
+	}
+	mac := hmac.New(sha256.New, s.unsubscribeKey())
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrInvalidUnsubscribe
+	}
+	var t unsubscribeToken
+	if err := json.Unmarshal(payload, &t); err != nil {
+		return nil, ErrInvalidUnsubscribe
+	}
+	if t.Kind != EmailAlert && t.Kind != EmailDigest {
+		return nil, ErrInvalidUnsubscribe
+	}
+	if now.Unix() > t.Expires {
+		return nil, ErrExpiredUnsubscribe
+	}
+	return &t, nil
+}
+
+// userLanguage returns the language of the user emails.
+func (s *Server) userLanguage(user *User) string {
+	s.mu.RLock()
+	lang := user.Language
+	s.mu.RUnlock()
+	if len(lang) == 0 {
+		return s.conf().SMTP.Language
+	}
+	return lang
+}
+
+// sendEmail renders the kind template in the user language and sends it.
+// data must be a *AlertData or a *DigestData.
+func (s *Server) sendEmail(user *User, kind string, data interface{}) error {
+	s.mu.RLock()
+	to := user.Email
+	s.mu.RUnlock()
+	if len(to) == 0 {
+		return ErrNoEmail
+	}
+	conf := s.conf()
+	publicURL, unsubscribeURL, err := s.emailLinks(user, kind)
+	if err != nil {
+		return err
+	}
+	switch d := data.(type) {
+	case *AlertData:
+		d.PublicURL, d.UnsubscribeURL = publicURL, unsubscribeURL
+	case *DigestData:
+		d.PublicURL, d.UnsubscribeURL = publicURL, unsubscribeURL
+	}
+	tmpl, err := emailTemplate(&conf.SMTP, s.userLanguage(user), kind)
+	if err != nil {
+		return err
+	}
+	var subject, body bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return err
+	}
+	if err := tmpl.ExecuteTemplate(&body, "body", data); err != nil {
+		return err
+	}
+	msg, err := buildEmail(conf.SMTP.From, to, strings.TrimSpace(subject.String()), body.String(), unsubscribeURL)
+	if err != nil {
+		return err
+	}
+	if err := sendSMTP(&conf.SMTP, to, msg); err != nil {
+		return fmt.Errorf("sending %s email: %v", kind, err)
+	}
+	logrus.WithField(logging.FieldUserID, user.ID).Infof("Email %s sent", kind)
+	return nil
+}
+
+// emailLinks returns the public URL without the trailing slash and the
+// unsubscribe link of the kind of emails of the user.
+func (s *Server) emailLinks(user *User, kind string) (string, string, error) {
+	token, err := s.signUnsubscribe(&unsubscribeToken{
+		ID: user.ID, Kind: kind, Expires: time.Now().Add(unsubscribeTokenTTL).Unix(),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	publicURL := strings.TrimSuffix(s.conf().PublicURLRaw, "/")
+	return publicURL, publicURL + "/unsubscribe?token=" + url.QueryEscape(token), nil
+}
+
+var emailFuncs = textTemplate.FuncMap{
+	"date": func(t time.Time) string {
+		return t.Format("02.01.2006")
+	},
+}
+
+// emailTemplate parses the template from the templates dir of the config
+// or the built-in one. The template defines "subject" and "body".
+func emailTemplate(conf *config.SMTPConfig, lang, kind string) (*textTemplate.Template, error) {
+	source, ok := emailTemplates[lang][kind]
+	if !ok {
+		source = emailTemplates[conf.Language][kind]
+	}
+	if len(conf.TemplatesDir) != 0 {
+		data, err := ioutil.ReadFile(filepath.Join(conf.TemplatesDir, lang, kind+".tmpl"))
+		switch {
+		case err == nil:
+			source = string(data)
+		case !os.IsNotExist(err):
+			return nil, err
+		}
+	}
+	return textTemplate.New(kind).Funcs(emailFuncs).Parse(source)
+}
+
+// buildEmail returns the message with the headers, the body is quoted
+// printable UTF-8 text.
+func buildEmail(from, to, subject, body, unsubscribeURL string) ([]byte, error) {
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, err
+	}
+	var msg bytes.Buffer
+	headers := [][2]string{
+		{"From", sender.String()},
+		{"To", (&mail.Address{Address: to}).String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+		{"List-Unsubscribe", "<" + unsubscribeURL + ">"},
+		{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"},
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&msg, "%s: %s\r\n", h[0], h[1])
+	}
+	msg.WriteString("\r\n")
+	w := quotedprintable.NewWriter(&msg)
+	if _, err := w.Write([]byte(strings.Replace(body, "\n", "\r\n", -1))); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+// sendSMTP delivers the message, using STARTTLS when the server offers it
+// and implicit TLS on port 465.
+func sendSMTP(conf *config.SMTPConfig, to string, msg []byte) error {
+	addr := net.JoinHostPort(conf.Host, strconv.Itoa(conf.Port))
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	var conn net.Conn
+	var err error
+	if conf.Port == 465 {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: conf.Host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, conf.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: conf.Host}); err != nil {
+			return err
+		}
+	}
+	if len(conf.Username) != 0 {
+		if err := c.Auth(smtp.PlainAuth("", conf.Username, conf.Password, conf.Host)); err != nil {
+			return err
+		}
+	}
+	sender, err := mail.ParseAddress(conf.From)
+	if err != nil {
+		return err
+	}
+	if err := c.Mail(sender.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="utf-8">
+    <title>HH.ru: Автоматическое обновление резюме</title>
+</head>
+<body>
+{{if .Done}}
+    <p>Вы отписались от {{.What}}. Подписку можно вернуть в настройках на странице <a href="/logged.html">hh-updater</a>.</p>
+{{else}}
+    <form method="post">
+        <input type="hidden" name="token" value="{{.Token}}">
+        <p>Отписаться от {{.What}}?</p>
+        <button type="submit">Отписаться</button>
+    </form>
+{{end}}
+</body>
+</html>
+`))
+
+// UnsubscribeHandler turns off the kind of emails given by the token of an
+// unsubscribe link. GET asks to confirm, so link scanners do not
+// unsubscribe the user, POST is also used by the one-click unsubscribe of
+// the mail clients.
+func (s *Server) UnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	t, err := s.verifyUnsubscribe(token, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, ok := s.getUser(t.ID)
+	if !ok {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	what := "уведомлений"
+	if t.Kind == EmailDigest {
+		what = "еженедельной сводки"
+	}
+	page := struct {
+		Done  bool
+		What  string
+		Token string
+	}{What: what, Token: token}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		s.mu.Lock()
+		if t.Kind == EmailDigest {
+			user.UnsubscribedDigest = true
+		} else {
+			user.UnsubscribedAlerts = true
+		}
+		s.userListChanged = true
+		s.mu.Unlock()
+		requestLog(r).WithField(logging.FieldUserID, user.ID).Infof("Unsubscribed from %s emails", t.Kind)
+		page.Done = true
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := unsubscribePage.Execute(w, page); err != nil {
+		requestLog(r).Error(err)
+	}
+}
+
+// EmailSettings are the email preferences of the user.
+type EmailSettings struct {
+	Enabled   bool     `json:"enabled"`
+	Email     string   `json:"email"`
+	Language  string   `json:"language"`
+	Languages []string `json:"languages"`
+	Alerts    bool     `json:"alerts"`
+	Digest    bool     `json:"digest"`
+}
+
+// EmailSettingsHandler shows the email preferences on GET and sets the
+// language and the alerts and digest subscriptions on POST.
+func (s *Server) EmailSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromContext(r)
+	if user == nil {
+		http.Error(w, "Empty user data", http.StatusInternalServerError)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		lang := r.FormValue("language")
+		if len(lang) != 0 && !config.KnownLanguage(lang) {
+			http.Error(w, fmt.Sprintf("Unknown language %s", lang), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		user.Language = lang
+		user.UnsubscribedAlerts = r.FormValue("alerts") != "true"
+		user.UnsubscribedDigest = r.FormValue("digest") != "true"
+		s.userListChanged = true
+		s.mu.Unlock()
+		requestLog(r).WithField(logging.FieldUserID, user.ID).Info("Email settings changed")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	lang := s.userLanguage(user)
+	s.mu.RLock()
+	settings := &EmailSettings{
+		Enabled:   s.conf().SMTP.Enabled(),
+		Email:     user.SafeMail(),
+		Language:  lang,
+		Languages: config.Languages,
+		Alerts:    !user.UnsubscribedAlerts,
+		Digest:    !user.UnsubscribedDigest,
+	}
+	s.mu.RUnlock()
+	if err := json.NewEncoder(w).Encode(settings); err != nil {
+		http.Error(w, fmt.Sprintf("Cannot encode response data: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+// emailTemplates are the built-in email templates by language and kind.
+// Each defines "subject" and "body".
+var emailTemplates = map[string]map[string]string{
+	"ru": {
+		EmailAlert: `{{define "subject"}}
+{{- if eq .Event.Type "token.expired"}}hh-updater: нужно войти снова
+{{- else if eq .Event.Type "resume.blocked"}}hh-updater: резюме «{{.Event.Title}}» не обновляется
+{{- else}}hh-updater: ошибки обновления резюме «{{.Event.Title}}»{{end}}
+{{- end}}
+{{- define "body"}}Здравствуйте!
+
+{{if eq .Event.Type "token.expired"}}Доступ hh-updater к вашему аккаунту на hh.ru отозван или истёк, поэтому резюме больше не обновляются. Чтобы возобновить обновления, войдите снова: {{.PublicURL}}
+{{else}}{{.Event.Message}}
+{{if .Event.URL}}
+Подробнее: {{.Event.URL}}
+{{end}}
+Настройки обновления: {{.PublicURL}}
+{{end}}
+--
+Отписаться от уведомлений: {{.UnsubscribeURL}}
+{{end}}`,
+		EmailDigest: `{{define "subject"}}hh-updater: итоги недели с {{date .Since}}{{end}}
+{{- define "body"}}Здравствуйте!
+
+С {{date .Since}} по {{date .Until}} резюме обновлены {{.Publishes}} раз, получено просмотров: {{.ViewsGained}}, новых просмотров работодателями: {{.NewViews}}.
+{{range .Resumes}}
+«{{.Title}}»: обновлений {{.Publishes}}, просмотров {{.ViewsGained}}, новых просмотров {{.NewViews}}
+{{- end}}
+
+Настройки обновления: {{.PublicURL}}
+--
+Отписаться от сводки: {{.UnsubscribeURL}}
+{{end}}`,
+	},
+	"en": {
+		EmailAlert: `{{define "subject"}}
+{{- if eq .Event.Type "token.expired"}}hh-updater: please log in again
+{{- else if eq .Event.Type "resume.blocked"}}hh-updater: resume "{{.Event.Title}}" is not updated
+{{- else}}hh-updater: resume "{{.Event.Title}}" fails to update{{end}}
+{{- end}}
+{{- define "body"}}Hello!
+
+{{if eq .Event.Type "token.expired"}}The access of hh-updater to your hh.ru account was revoked or has expired, so your resumes are no longer updated. Log in again to resume the updates: {{.PublicURL}}
+{{else if eq .Event.Type "resume.blocked"}}Your resume "{{.Event.Title}}" is blocked by the moderators or not filled in completely, its updates are stopped.
+{{if .Event.URL}}
+Details: {{.Event.URL}}
+{{end}}
+Update settings: {{.PublicURL}}
+{{else}}Your resume "{{.Event.Title}}" failed to update several times in a row.
+
+Update settings: {{.PublicURL}}
+{{end}}
+--
+Unsubscribe from the alerts: {{.UnsubscribeURL}}
+{{end}}`,
+		EmailDigest: `{{define "subject"}}hh-updater: your week since {{date .Since}}{{end}}
+{{- define "body"}}Hello!
+
+From {{date .Since}} to {{date .Until}} your resumes were published {{.Publishes}} times and gained {{.ViewsGained}} views, {{.NewViews}} new views by employers.
+{{range .Resumes}}
+"{{.Title}}": {{.Publishes}} publishes, {{.ViewsGained}} views, {{.NewViews}} new views
+{{- end}}
+
+Update settings: {{.PublicURL}}
+--
+Unsubscribe from the digest: {{.UnsubscribeURL}}
+{{end}}`,
+	},
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnsubscribeToken(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	other, cleanupOther := newTestServer(t)
+	defer cleanupOther()
+	other.c.CookieEncryptionKey = "fedcba9876543210fedcba9876543210"
+
+	now := time.Now()
+	valid := &unsubscribeToken{ID: "u1", Kind: EmailDigest, Expires: now.Add(time.Hour).Unix()}
+	token, err := s.signUnsubscribe(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	sign := func(s *Server, t *unsubscribeToken) string {
+		token, _ := s.signUnsubscribe(t)
+		return token
+	}
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"valid", token, nil},
+		{"expired", sign(s, &unsubscribeToken{ID: "u1", Kind: EmailAlert, Expires: now.Add(-time.Minute).Unix()}), ErrExpiredUnsubscribe},
+		{"unknown kind", sign(s, &unsubscribeToken{ID: "u1", Kind: "session", Expires: valid.Expires}), ErrInvalidUnsubscribe},
+		{"other key", sign(other, valid), ErrInvalidUnsubscribe},
+		{"other payload", strings.Split(sign(s, &unsubscribeToken{ID: "u2", Kind: EmailDigest, Expires: valid.Expires}), ".")[0] + "." + parts[1], ErrInvalidUnsubscribe},
+		{"no signature", parts[0], ErrInvalidUnsubscribe},
+		{"empty", "", ErrInvalidUnsubscribe},
+		{"not base64", "!!!." + parts[1], ErrInvalidUnsubscribe},
+	}
+	for _, tt := range tests {
+		got, err := s.verifyUnsubscribe(tt.token, now)
+		if err != tt.want {
+			t.Errorf("%s: verifyUnsubscribe error = %v, want %v", tt.name, err, tt.want)
+			continue
+		}
+		if err == nil && *got != *valid {
+			t.Errorf("%s: verifyUnsubscribe = %+v, want %+v", tt.name, got, valid)
+		}
+	}
+}
+
+func TestAuthAcceptsOnlySessions(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	s.userList["u1"] = &User{ID: "u1"}
+
+	encrypt := func(v interface{}) string {
+		token, err := s.Encrypt(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	unsubscribe, err := s.signUnsubscribe(&unsubscribeToken{ID: "u1", Kind: EmailAlert, Expires: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		cookie string
+		want   int
+	}{
+		{"session", encrypt(&SafeUser{ID: "u1", Purpose: sessionPurpose}), http.StatusOK},
+		{"no purpose", encrypt(&SafeUser{ID: "u1"}), http.StatusUnauthorized},
+		{"other purpose", encrypt(&SafeUser{ID: "u1", Purpose: "unsubscribe"}), http.StatusUnauthorized},
+		{"encrypted unsubscribe token", encrypt(&unsubscribeToken{ID: "u1", Kind: EmailAlert}), http.StatusUnauthorized},
+		{"unsubscribe link token", unsubscribe, http.StatusUnauthorized},
+		{"revoked session", encrypt(&SafeUser{ID: "u1", Epoch: 1, Purpose: sessionPurpose}), http.StatusUnauthorized},
+		{"unknown user", encrypt(&SafeUser{ID: "u2", Purpose: sessionPurpose}), http.StatusUnauthorized},
+		{"null", encrypt(nil), http.StatusUnauthorized},
+	}
+	handler := s.Auth(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/me", nil)
+		r.AddCookie(&http.Cookie{Name: s.conf().CookieName, Value: tt.cookie})
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestEmailLinks(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	user := &User{ID: "u1"}
+	for _, raw := range []string{"https://hh.example.com", "https://hh.example.com/"} {
+		s.c.PublicURLRaw = raw
+		publicURL, unsubscribeURL, err := s.emailLinks(user, EmailAlert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if publicURL != "https://hh.example.com" {
+			t.Errorf("%s: public URL %s", raw, publicURL)
+		}
+		if !strings.HasPrefix(unsubscribeURL, "https://hh.example.com/unsubscribe?token=") {
+			t.Errorf("%s: unsubscribe URL %s", raw, unsubscribeURL)
+		}
+	}
+}
+
+func TestEmailNotifierQueues(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	// Nothing listens on the port, the notifier must not connect anyway.
+	s.c.SMTP.Host = "127.0.0.1"
+	s.c.SMTP.Port = 1
+	user := &User{ID: "u1", Email: "user@example.com"}
+	n := &EmailNotifier{s: s}
+	for i := 0; i < emailQueueSize; i++ {
+		if err := n.Notify(user, &Event{Type: EventResumeBlocked}); err != nil {
+			t.Fatalf("alert %d: %v", i, err)
+		}
+	}
+	if err := n.Notify(user, &Event{Type: EventResumePublished}); err != nil {
+		t.Errorf("event without email: %v", err)
+	}
+	if err := n.Notify(user, &Event{Type: EventTokenExpired}); err != ErrEmailQueueFull {
+		t.Errorf("alert to a full queue: %v, want %v", err, ErrEmailQueueFull)
+	}
+	email := <-s.emails
+	if email.user != user || email.kind != EmailAlert {
+		t.Errorf("queued email %+v", email)
+	}
+	if data, ok := email.data.(*AlertData); !ok || data.Event.Type != EventResumeBlocked {
+		t.Errorf("queued email data %+v", email.data)
+	}
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/artkescha/hh-updater/hhclient"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	LoopUpdate    = "update"
+	LoopDump      = "dump"
+	LoopRefresher = "token_refresher"
+	LoopMetrics   = "metrics"
+	LoopRedirect  = "redirect"
+	LoopDigest    = "digest"
+	LoopTelegram  = "telegram"
+	LoopWebhooks  = "webhooks"
+	LoopEmail     = "email"
+
+	CheckOK   = "ok"
+	CheckFail = "fail"
+
+	// hhCheckTTL is how long a successful hh request proves hh reachable,
+	// so the probes do not hit hh on every call.
+	hhCheckTTL     = time.Minute
+	hhCheckTimeout = 5 * time.Second
+	// minCycleWindow is the least time allowed between finished update
+	// cycles before the server is reported not ready.
+	minCycleWindow = 5 * time.Minute
+	// loopStallGrace is added to twice the loop interval before a loop
+	// without a heartbeat is reported stalled.
+	loopStallGrace = 5 * time.Minute
+	// readyCheckTTL is how long the /readyz checks are reused, so the
+	// unauthenticated probe can not be used to load the database or hh.
+	readyCheckTTL = 10 * time.Second
+	// dbCheckTimeout is how long the database check waits for the write
+	// lock, held by a stuck writer otherwise.
+	dbCheckTimeout = 5 * time.Second
+)
+
+// HealthKey stores the time of the last database check in MetaBucket.
+var HealthKey = []byte("health")
+
+// Check is the result of a single health check.
+type Check struct {
+	Status  string      `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// HealthReport is returned by /healthz and /readyz.
+type HealthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]*Check `json:"checks"`
+}
+
+// LoopState is the state of a background loop.
+type LoopState struct {
+	Running   bool       `json:"running"`
+	StartedAt time.Time  `json:"started_at"`
+	LastBeat  *time.Time `json:"last_beat,omitempty"`
+}
+
+// health keeps what the probes look at. Loops report a heartbeat on every
+// iteration.
+type health struct {
+	mu            sync.Mutex
+	startedAt     time.Time
+	loops         map[string]*LoopState
+	lastCycle     time.Time
+	lastHHSuccess time.Time
+
+	// readyMu is held while the /readyz checks run, so concurrent probes
+	// share a single run.
+	readyMu      sync.Mutex
+	readyChecks  map[string]*Check
+	readyCheckAt time.Time
+}
+
+func newHealth() *health {
+	return &health{startedAt: time.Now(), loops: map[string]*LoopState{}}
+}
+
+func (h *health) loopStarted(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.loops[name] = &LoopState{Running: true, StartedAt: time.Now().UTC()}
+}
+
+func (h *health) loopExited(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if loop, ok := h.loops[name]; ok {
+		loop.Running = false
+	}
+}
+
+func (h *health) beat(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if loop, ok := h.loops[name]; ok {
+		now := time.Now().UTC()
+		loop.LastBeat = &now
+	}
+}
+
+func (h *health) cycleFinished() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastCycle = time.Now()
+}
+
+func (h *health) hhSucceeded() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastHHSuccess = time.Now()
+}
+
+// observeRequest is passed to the hh clients to feed both the metrics and
+// the hh check.
+func (s *Server) observeRequest(method, endpoint string, code int, d time.Duration) {
+	s.metrics.observeRequest(method, endpoint, code, d)
+	if code != 0 && code < http.StatusInternalServerError {
+		s.health.hhSucceeded()
+	}
+}
+
+// loopInterval returns the longest time the loop may go without a
+// heartbeat when it works normally, zero for the loops not reporting them.
+func (s *Server) loopInterval(name string) time.Duration {
+	conf := s.conf()
+	switch name {
+	case LoopUpdate:
+		return conf.UpdateInterval
+	case LoopDump:
+		return conf.DumpInterval
+	case LoopRefresher:
+		return tokenRefreshCheckInterval
+	case LoopDigest:
+		return digestCheckInterval
+	case LoopTelegram:
+		return telegramIdleDelay
+	case LoopWebhooks:
+		return webhookPollInterval
+	case LoopEmail:
+		return emailIdleInterval
+	}
+	return 0
+}
+
+// checkLoops fails if a loop has exited or has not reported a heartbeat for
+// more than twice its interval plus loopStallGrace.
+func (s *Server) checkLoops() *Check {
+	now := time.Now()
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+	loops := make(map[string]LoopState, len(s.health.loops))
+	check := &Check{Status: CheckOK, Details: loops}
+	for name, loop := range s.health.loops {
+		loops[name] = *loop
+		if !loop.Running {
+			check.Status = CheckFail
+			check.Error = fmt.Sprintf("loop %s exited", name)
+			continue
+		}
+		interval := s.loopInterval(name)
+		if interval <= 0 {
+			continue
+		}
+		last := loop.StartedAt
+		if loop.LastBeat != nil {
+			last = *loop.LastBeat
+		}
+		if now.Sub(last) > 2*interval+loopStallGrace {
+			check.Status = CheckFail
+			check.Error = fmt.Sprintf("loop %s stalled since %s", name, last.Format(time.RFC3339))
+		}
+	}
+	if len(loops) == 0 {
+		check.Status = CheckFail
+		check.Error = "loops not started"
+	}
+	return check
+}
+
+// checkDB writes the time of the check to the meta bucket, proving the
+// database open and writable, and gives up if the write does not finish in
+// dbCheckTimeout.
+func (s *Server) checkDB() *Check {
+	done := make(chan error, 1)
+	go func() {
+		done <- s.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(MetaBucket)
+			if b == nil {
+				return fmt.Errorf("bucket %s not found", MetaBucket)
+			}
+			if b.Get(SchemaVersionKey) == nil {
+				return errors.New("schema version not found")
+			}
+			return b.Put(HealthKey, []byte(time.Now().UTC().Format(time.RFC3339)))
+		})
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(dbCheckTimeout):
+		err = fmt.Errorf("write not finished in %s", dbCheckTimeout)
+	}
+	if err != nil {
+		return &Check{Status: CheckFail, Error: err.Error()}
+	}
+	return &Check{Status: CheckOK}
+}
+
+// checkCycle fails if no update cycle has finished for twice the update
+// interval, counting from the start before the first one.
+func (s *Server) checkCycle() *Check {
+	window := 2 * s.conf().UpdateInterval
+	if window < minCycleWindow {
+		window = minCycleWindow
+	}
+	s.health.mu.Lock()
+	last := s.health.lastCycle
+	s.health.mu.Unlock()
+	since := last
+	if since.IsZero() {
+		since = s.health.startedAt
+	}
+	details := map[string]interface{}{"window": window.String()}
+	if !last.IsZero() {
+		details["last_finished_at"] = last.UTC()
+	}
+	check := &Check{Status: CheckOK, Details: details}
+	if time.Since(since) > window {
+		check.Status = CheckFail
+		check.Error = fmt.Sprintf("no update cycle finished in %s", window)
+	}
+	return check
+}
+
+// checkHH relies on the recent requests to hh and only probes it when there
+// were none.
+func (s *Server) checkHH() *Check {
+	s.health.mu.Lock()
+	last := s.health.lastHHSuccess
+	s.health.mu.Unlock()
+	if time.Since(last) < hhCheckTTL {
+		return &Check{Status: CheckOK, Details: map[string]interface{}{"last_success_at": last.UTC()}}
+	}
+	client := &http.Client{Timeout: hhCheckTimeout}
+	resp, err := client.Get(hhclient.DefaultBaseURL + "dictionaries")
+	if err != nil {
+		return &Check{Status: CheckFail, Error: err.Error()}
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return &Check{Status: CheckFail, Error: resp.Status}
+	}
+	s.health.hhSucceeded()
+	return &Check{Status: CheckOK}
+}
+
+func writeHealthReport(w http.ResponseWriter, checks map[string]*Check) {
+	report := &HealthReport{Status: CheckOK, Checks: checks}
+	for _, check := range checks {
+		if check.Status != CheckOK {
+			report.Status = CheckFail
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != CheckOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		http.Error(w, fmt.Sprintf("Cannot encode response data: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// HealthzHandler reports whether the background loops are alive.
+func (s *Server) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, map[string]*Check{"loops": s.checkLoops()})
+}
+
+// ReadyzHandler reports whether the server can do its job: the database is
+// readable, update cycles finish in time and hh is reachable. The checks
+// are reused for readyCheckTTL.
+func (s *Server) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	s.health.readyMu.Lock()
+	defer s.health.readyMu.Unlock()
+	if s.health.readyChecks == nil || time.Since(s.health.readyCheckAt) >= readyCheckTTL {
+		s.health.readyChecks = map[string]*Check{
+			"loops": s.checkLoops(),
+			"db":    s.checkDB(),
+			"cycle": s.checkCycle(),
+			"hh":    s.checkHH(),
+		}
+		s.health.readyCheckAt = time.Now()
+	}
+	writeHealthReport(w, s.health.readyChecks)
+}
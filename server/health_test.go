@@ -0,0 +1,52 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestCheckDB(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	if check := s.checkDB(); check.Status != CheckOK {
+		t.Fatalf("checkDB of a writable database = %+v, want ok", check)
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(MetaBucket).Get(HealthKey) == nil {
+			t.Error("checkDB did not write the health key")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen the database read-only, as on a read-only mount.
+	path := s.db.Path()
+	if err := s.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s.db, err = bolt.Open(path, 0600, &bolt.Options{ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	if check := s.checkDB(); check.Status != CheckFail || len(check.Error) == 0 {
+		t.Errorf("checkDB of a read-only database = %+v, want fail", check)
+	}
+}
+
+func TestCheckDBStuckWriter(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for dbCheckTimeout")
+	}
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	tx, err := s.db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if check := s.checkDB(); check.Status != CheckFail {
+		t.Errorf("checkDB with the write lock held = %+v, want fail", check)
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/artkescha/hh-updater/hhclient"
+	"github.com/sirupsen/logrus"
+)
+
+// hhTimeLayout is the layout of the times returned by hh.
+const hhTimeLayout = "2006-01-02T15:04:05-0700"
+
+// checkInvitations notifies the user of the invitations updated since the
+// last check. The first check only remembers the time, so the user is not
+// flooded with the old invitations.
+func (s *Server) checkInvitations(log *logrus.Entry, client *hhclient.Client, user *User) {
+	s.mu.RLock()
+	checked := user.InvitationsCheckedAt
+	s.mu.RUnlock()
+	negotiations, err := client.Negotiation.NegotiationsRecent()
+	if err != nil {
+		log.Warnf("Error getting negotiations: %v", err)
+		return
+	}
+	watermark := time.Now().UTC()
+	if checked != nil {
+		watermark = *checked
+	}
+	latest := watermark
+	for _, n := range negotiations {
+		updated, err := time.Parse(hhTimeLayout, n.UpdatedAt)
+		if err != nil || !updated.After(watermark) {
+			continue
+		}
+		if updated.After(latest) {
+			latest = updated.UTC()
+		}
+		if checked == nil || n.State.ID != hhclient.StateInvitation || n.Vacancy == nil {
+			continue
+		}
+		s.notify(user, &Event{
+			Type:    EventInvitation,
+			Title:   n.Vacancy.Name,
+			Message: fmt.Sprintf("Приглашение от %s на вакансию \"%s\"", n.Vacancy.Employer.Name, n.Vacancy.Name),
+			URL:     n.Vacancy.AlternateURL,
+		})
+	}
+	s.mu.Lock()
+	user.InvitationsCheckedAt = &latest
+	s.userListChanged = true
+	s.mu.Unlock()
+}
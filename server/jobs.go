@@ -0,0 +1,268 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/artkescha/hh-updater/logging"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+
+	// jobTTL is how long finished jobs can be polled.
+	jobTTL = time.Hour
+)
+
+var (
+	ErrUpdateInProgress = errors.New("Update already in progress")
+	ErrJobNotFound      = errors.New("Job not found")
+	ErrUserDisabled     = errors.New("Updates are disabled by the administrator")
+	ErrUserPaused       = errors.New("Updates are paused")
+	ErrTokenExpired     = errors.New("Access to hh.ru has expired, log in again")
+)
+
+// TooSoonError is returned when the user asks for an update again before
+// the update now interval has passed.
+type TooSoonError struct {
+	RetryAfter time.Duration
+}
+
+func (e *TooSoonError) Error() string {
+	return fmt.Sprintf("Update was requested recently, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+// Job is an update of a single user run on demand.
+type Job struct {
+	ID         string           `json:"id"`
+	UserID     string           `json:"user_id"`
+	Status     string           `json:"status"`
+	CreatedAt  time.Time        `json:"created_at"`
+	FinishedAt *time.Time       `json:"finished_at,omitempty"`
+	Outcomes   []*ResumeOutcome `json:"outcomes,omitempty"`
+	Error      string           `json:"error,omitempty"`
+}
+
+// jobs keeps the on-demand updates in memory. A user has at most one job
+// queued or running at a time.
+type jobs struct {
+	mu       sync.Mutex
+	byID     map[string]*Job
+	active   map[string]*Job
+	lastRun  map[string]time.Time
+	updating map[string]*userUpdate
+}
+
+// userUpdate is an update of a user in progress. done is closed once the
+// outcomes and the error are set.
+type userUpdate struct {
+	done     chan struct{}
+	outcomes []*ResumeOutcome
+	err      error
+}
+
+func newJobs() *jobs {
+	return &jobs{
+		byID:     map[string]*Job{},
+		active:   map[string]*Job{},
+		lastRun:  map[string]time.Time{},
+		updating: map[string]*userUpdate{},
+	}
+}
+
+// claimUser marks the user as being updated, so the update loop and the
+// jobs do not update the same user at once.
+func (s *Server) claimUser(user *User) bool {
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+	if _, ok := s.jobs.updating[user.ID]; ok {
+		return false
+	}
+	s.jobs.updating[user.ID] = &userUpdate{done: make(chan struct{})}
+	return true
+}
+
+// releaseUser ends the update of the user claimed by claimUser with its
+// result, passing it to the jobs waiting for the update.
+func (s *Server) releaseUser(user *User, outcomes []*ResumeOutcome, err error) {
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+	update, ok := s.jobs.updating[user.ID]
+	if !ok {
+		return
+	}
+	update.outcomes, update.err = outcomes, err
+	close(update.done)
+	delete(s.jobs.updating, user.ID)
+}
+
+// updateOrWait updates the user, or, if the update loop is updating the
+// user already, waits for that update and returns its result.
+func (s *Server) updateOrWait(log *logrus.Entry, user *User) ([]*ResumeOutcome, error) {
+	for {
+		s.jobs.mu.Lock()
+		update, ok := s.jobs.updating[user.ID]
+		s.jobs.mu.Unlock()
+		if ok {
+			<-update.done
+			return update.outcomes, update.err
+		}
+		outcomes, err := s.updateUser(log, user)
+		if err != ErrUpdateInProgress {
+			return outcomes, err
+		}
+		// The loop claimed the user in the meantime, wait for it.
+	}
+}
+
+func newJobID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(id)
+}
+
+// StartUpdateJob queues an update of the user and returns its job. If the
+// user already has a job queued or running, that job is returned. Unless
+// force is set, the user can only start a job once per update now
+// interval. The disabled and paused users and those who must log in again
+// can not be updated, forced or not.
+func (s *Server) StartUpdateJob(user *User, force bool) (*Job, error) {
+	switch {
+	case s.userDisabled(user):
+		return nil, ErrUserDisabled
+	case s.userPaused(user, time.Now()):
+		return nil, ErrUserPaused
+	case s.userTokenExpired(user):
+		return nil, ErrTokenExpired
+	}
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+	if job, ok := s.jobs.active[user.ID]; ok {
+		return job.copy(), nil
+	}
+	now := time.Now()
+	if last, ok := s.jobs.lastRun[user.ID]; ok && !force {
+		if wait := s.conf().UpdateNowInterval - now.Sub(last); wait > 0 {
+			return nil, &TooSoonError{RetryAfter: wait}
+		}
+	}
+	for id, job := range s.jobs.byID {
+		if job.FinishedAt != nil && now.Sub(*job.FinishedAt) > jobTTL {
+			delete(s.jobs.byID, id)
+		}
+	}
+	job := &Job{ID: newJobID(), UserID: user.ID, Status: JobQueued, CreatedAt: now.UTC()}
+	s.jobs.byID[job.ID] = job
+	s.jobs.active[user.ID] = job
+	s.jobs.lastRun[user.ID] = now
+	s.goTask(func() {
+		s.runJob(job, user)
+	})
+	return job.copy(), nil
+}
+
+// jobErrorStatus returns the HTTP status of an error starting a job.
+func jobErrorStatus(err error) int {
+	switch err {
+	case ErrUserDisabled, ErrUserPaused, ErrTokenExpired:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func (s *Server) runJob(job *Job, user *User) {
+	s.jobs.mu.Lock()
+	job.Status = JobRunning
+	s.jobs.mu.Unlock()
+	log := newCycleLog().WithField("job_id", job.ID)
+	outcomes, err := s.updateOrWait(log, user)
+	if err != nil && err != ErrEmptyResumeList {
+		log.WithField(logging.FieldUserID, user.ID).Error(err)
+	}
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+	job.Outcomes = outcomes
+	job.Status = JobDone
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+	}
+	finished := time.Now().UTC()
+	job.FinishedAt = &finished
+	delete(s.jobs.active, user.ID)
+}
+
+// copy returns a copy of the job safe to use without holding jobs.mu.
+func (j *Job) copy() *Job {
+	c := *j
+	return &c
+}
+
+// job returns the job of the user.
+func (s *Server) job(user *User, id string) (*Job, error) {
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+	job, ok := s.jobs.byID[id]
+	if !ok || job.UserID != user.ID {
+		return nil, ErrJobNotFound
+	}
+	return job.copy(), nil
+}
+
+// UpdateNowHandler queues an immediate update of the current user and
+// returns the job to poll with JobHandler.
+func (s *Server) UpdateNowHandler(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromContext(r)
+	if user == nil {
+		http.Error(w, "Empty user data", http.StatusInternalServerError)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	job, err := s.StartUpdateJob(user, false)
+	if err != nil {
+		if tooSoon, ok := err.(*TooSoonError); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(tooSoon.RetryAfter.Seconds())+1))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		http.Error(w, err.Error(), jobErrorStatus(err))
+		return
+	}
+	// writeJSON can not set the header once the status is written.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		requestLog(r).Errorf("Cannot encode response data: %v", err)
+	}
+}
+
+// JobHandler returns the state of an update job of the current user.
+func (s *Server) JobHandler(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromContext(r)
+	if user == nil {
+		http.Error(w, "Empty user data", http.StatusInternalServerError)
+		return
+	}
+	job, err := s.job(user, r.FormValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, job)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitJob polls the job until it finishes.
+func waitJob(t *testing.T, s *Server, user *User, id string) *Job {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := s.job(user, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.FinishedAt != nil {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s not finished", id)
+	return nil
+}
+
+func TestJobWaitsForLoopUpdate(t *testing.T) {
+	tests := []struct {
+		name       string
+		loopErr    error
+		wantStatus string
+	}{
+		{"loop update succeeds", nil, JobDone},
+		{"loop update fails", errors.New("hh is down"), JobFailed},
+	}
+	for _, tt := range tests {
+		s, cleanup := newTestServer(t)
+		user := &User{ID: "u1"}
+		s.userList[user.ID] = user
+		// The update loop holds the user.
+		if !s.claimUser(user) {
+			t.Fatal("claimUser of a free user failed")
+		}
+		job, err := s.StartUpdateJob(user, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if got, _ := s.job(user, job.ID); got.FinishedAt != nil {
+			t.Errorf("%s: job finished while the loop holds the user: %+v", tt.name, got)
+		}
+		outcomes := []*ResumeOutcome{{ResumeID: "r1"}}
+		s.releaseUser(user, outcomes, tt.loopErr)
+		finished := waitJob(t, s, user, job.ID)
+		if finished.Status != tt.wantStatus {
+			t.Errorf("%s: job status %s, want %s", tt.name, finished.Status, tt.wantStatus)
+		}
+		if len(finished.Outcomes) != 1 || finished.Outcomes[0].ResumeID != "r1" {
+			t.Errorf("%s: job outcomes %+v, want those of the loop update", tt.name, finished.Outcomes)
+		}
+		if s.claimUser(user) {
+			s.releaseUser(user, nil, nil)
+		} else {
+			t.Errorf("%s: user still claimed after the job", tt.name)
+		}
+		cleanup()
+	}
+}
+
+func TestStartUpdateJobRefusals(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	now := time.Now()
+	tests := []struct {
+		name string
+		user *User
+		want error
+	}{
+		{"disabled", &User{ID: "u1", Disabled: true}, ErrUserDisabled},
+		{"paused", &User{ID: "u2", Pause: &Pause{Since: now}}, ErrUserPaused},
+		{"token expired", &User{ID: "u3", TokenExpiredAt: &now}, ErrTokenExpired},
+	}
+	for _, tt := range tests {
+		s.userList[tt.user.ID] = tt.user
+		for _, force := range []bool{false, true} {
+			if _, err := s.StartUpdateJob(tt.user, force); err != tt.want {
+				t.Errorf("%s: StartUpdateJob(force %v) = %v, want %v", tt.name, force, err, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/artkescha/hh-updater/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// newCycleLog returns the logger of an update cycle, tagging its entries
+// with a random cycle ID.
+func newCycleLog() *logrus.Entry {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return logrus.NewEntry(logrus.StandardLogger())
+	}
+	return logrus.WithField(logging.FieldCycleID, hex.EncodeToString(id))
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/artkescha/hh-updater/hhclient"
+	"github.com/artkescha/hh-updater/metrics"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+const (
+	UserStateActive   = "active"
+	UserStateDisabled = "disabled"
+)
+
+// serverMetrics are exposed on /metrics. Labels must never carry user
+// emails or IDs.
+type serverMetrics struct {
+	registry        *metrics.Registry
+	cycleDuration   *metrics.HistogramVec
+	outcomes        *metrics.CounterVec
+	hhRequests      *metrics.CounterVec
+	hhLatency       *metrics.HistogramVec
+	tokenRefreshes  *metrics.CounterVec
+	lastPersistUnix int64
+}
+
+func newServerMetrics(s *Server) *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: r,
+		cycleDuration: r.NewHistogramVec("hhupdater_update_cycle_duration_seconds",
+			"Duration of the update cycles.", []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800}),
+		outcomes: r.NewCounterVec("hhupdater_resume_outcomes_total",
+			"Resumes processed by the updater by outcome.", "status"),
+		hhRequests: r.NewCounterVec("hhupdater_hh_requests_total",
+			"Requests made to the hh API by endpoint and status code.", "method", "endpoint", "code"),
+		hhLatency: r.NewHistogramVec("hhupdater_hh_request_duration_seconds",
+			"Latency of the hh API requests.", metrics.DefBuckets, "method", "endpoint"),
+		tokenRefreshes: r.NewCounterVec("hhupdater_token_refreshes_total",
+			"Token refreshes by result.", "result"),
+	}
+	r.NewGaugeFunc("hhupdater_users", "Users by state.", func() map[string]float64 {
+		return s.usersByState()
+	}, "state")
+	r.NewGaugeFunc("hhupdater_seconds_since_last_persist",
+		"Seconds since the user list was last written to the database.", func() map[string]float64 {
+			last := atomic.LoadInt64(&m.lastPersistUnix)
+			if last == 0 {
+				return map[string]float64{}
+			}
+			return map[string]float64{"": time.Since(time.Unix(last, 0)).Seconds()}
+		})
+	return m
+}
+
+func (m *serverMetrics) observeRequest(method, endpoint string, code int, d time.Duration) {
+	m.hhRequests.Inc(method, endpoint, strconv.Itoa(code))
+	m.hhLatency.Observe(d.Seconds(), method, endpoint)
+}
+
+func (m *serverMetrics) persisted() {
+	atomic.StoreInt64(&m.lastPersistUnix, time.Now().Unix())
+}
+
+// newClient creates an hh client reporting its requests to the metrics.
+func (s *Server) newClient(token *oauth2.Token) *hhclient.Client {
+	opts := []hhclient.Option{hhclient.WithObserver(s.observeRequest)}
+	if s.hhTransport != nil {
+		opts = append(opts, hhclient.WithTransport(s.hhTransport))
+	}
+	return hhclient.NewClient(token, opts...)
+}
+
+func (s *Server) usersByState() map[string]float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	states := map[string]float64{UserStateActive: 0, UserStateDisabled: 0, UserStatePaused: 0}
+	now := time.Now()
+	for _, user := range s.userList {
+		states[userState(user, now)]++
+	}
+	return states
+}
+
+// startMetrics serves /metrics on a separate address so it is not exposed
+// with the public site.
+func (s *Server) startMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics.registry.Handler())
+	s.metricsServer.Handler = mux
+	s.goLoop(LoopMetrics, func() {
+		if err := s.metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+			logrus.Errorf("Metrics server failed: %v", err)
+		}
+	})
+	logrus.Infof("Serving metrics on %s", s.metricsServer.Addr)
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artkescha/hh-updater/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultContentSecurityPolicy allows the pages to load bootstrap and the
+// Yandex.Metrica counter.
+const DefaultContentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' 'unsafe-inline' https://mc.yandex.ru; " +
+	"style-src 'self' 'unsafe-inline' https://maxcdn.bootstrapcdn.com; " +
+	"font-src 'self' https://maxcdn.bootstrapcdn.com; " +
+	"img-src 'self' data: https://mc.yandex.ru; " +
+	"connect-src 'self' https://mc.yandex.ru; " +
+	"frame-ancestors 'none'"
+
+type ctxKey int
+
+const (
+	userCtxKey ctxKey = iota
+	requestIDCtxKey
+)
+
+// requestIDRe limits the request IDs accepted from a proxy in front of the
+// server.
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._\-]{1,64}$`)
+
+// Middleware wraps a handler.
+type Middleware func(http.Handler) http.Handler
+
+// chain applies the middlewares so that the first one sees the request
+// first.
+func chain(h http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// RequestIDFromContext returns the ID given to the request by the
+// middleware.
+func RequestIDFromContext(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDCtxKey).(string)
+	return id
+}
+
+// sameOrigin reports whether the request comes from a page of the public
+// URL, judging by the Origin header or, without it, the Referer.
+func (s *Server) sameOrigin(r *http.Request) bool {
+	public := s.conf().PublicURL
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		origin = r.Header.Get("Referer")
+	}
+	u, err := url.Parse(origin)
+	if err != nil || len(origin) == 0 {
+		return false
+	}
+	return u.Scheme == public.Scheme && u.Host == public.Host
+}
+
+// requestLog returns the logger of the request, tagged with its ID.
+func requestLog(r *http.Request) *logrus.Entry {
+	return logrus.WithField(logging.FieldRequestID, RequestIDFromContext(r))
+}
+
+// RequestID keeps the X-Request-Id set by a proxy or generates a new one
+// and returns it in the response.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !requestIDRe.MatchString(id) {
+			b := make([]byte, 8)
+			if _, err := rand.Read(b); err == nil {
+				id = hex.EncodeToString(b)
+			}
+		}
+		w.Header().Set("X-Request-Id", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDCtxKey, id)))
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// AccessLog logs every request once it is served. The query is left out
+// since it carries the OAuth code. Probes are logged at debug level.
+func (s *Server) AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		entry := requestLog(r).WithFields(logrus.Fields{
+			"method":   r.Method,
+			"path":     r.URL.Path,
+			"status":   rec.status,
+			"bytes":    rec.bytes,
+			"duration": time.Since(start).String(),
+			"remote":   s.clientIP(r),
+		})
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			entry.Debug("Request served")
+		} else {
+			entry.Info("Request served")
+		}
+	})
+}
+
+// Recover turns a panic in a handler into a redirect to the error page.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				requestLog(r).Errorf("Panic serving %s: %v\n%s", r.URL.Path, err, debug.Stack())
+				http.Redirect(w, r, "/error.html", http.StatusFound)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SecurityHeaders sets the CSP, frame and content type headers and HSTS
+// when the site is served over https.
+func (s *Server) SecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conf := s.conf()
+		csp := conf.ContentSecurityPolicy
+		if len(csp) == 0 {
+			csp = DefaultContentSecurityPolicy
+		}
+		h := w.Header()
+		h.Set("Content-Security-Policy", csp)
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "same-origin")
+		if conf.CookieSecure || r.TLS != nil {
+			h.Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the address of the client, taken from X-Forwarded-For
+// only if the proxy in front of the server is trusted to set it.
+func (s *Server) clientIP(r *http.Request) string {
+	if s.conf().TrustForwardedFor {
+		if forwarded := r.Header.Get("X-Forwarded-For"); len(forwarded) != 0 {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimiter is a token bucket per client IP refilled at the limit per
+// minute.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*bucket{}, lastSweep: time.Now()}
+}
+
+func (l *rateLimiter) allow(ip string, perMinute int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > time.Minute {
+		// Buckets idle for a minute are full again and need not be kept.
+		for key, b := range l.buckets {
+			if now.Sub(b.last) > time.Minute {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: float64(perMinute), last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens += now.Sub(b.last).Minutes() * float64(perMinute)
+	if b.tokens > float64(perMinute) {
+		b.tokens = float64(perMinute)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// RateLimit limits the requests per client IP to the configured auth rate
+// limit. A limit of 0 disables it.
+func (s *Server) RateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := s.conf().AuthRateLimit
+		if limit > 0 && !s.limiter.allow(s.clientIP(r), limit, time.Now()) {
+			requestLog(r).Warnf("Rate limit exceeded for %s", r.URL.Path)
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
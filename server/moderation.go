@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/artkescha/hh-updater/hhclient"
+)
+
+const (
+	ModerationBlocked    = "blocked"
+	ModerationUnfinished = "unfinished"
+)
+
+// Moderation is set while hh does not allow the resume to be published
+// because it is blocked by moderators or not filled in completely.
+type Moderation struct {
+	Reason     string    `json:"reason"`
+	PublishURL string    `json:"publish_url,omitempty"`
+	Since      time.Time `json:"since"`
+}
+
+func moderationReason(status *hhclient.ResumeStatus) string {
+	if status.Blocked {
+		return ModerationBlocked
+	}
+	if !status.Finished {
+		return ModerationUnfinished
+	}
+	return ""
+}
+
+// checkModeration records transitions of the resume into and out of the
+// blocked or unfinished state and notifies the user about them. It reports
+// whether the resume must be left alone. A dry run only reports it.
+func (s *Server) checkModeration(user *User, resume *hhclient.Resume, status *hhclient.ResumeStatus) bool {
+	reason := moderationReason(status)
+	if s.dryRun() {
+		return len(reason) != 0
+	}
+	s.mu.Lock()
+	state := user.resumeState(resume.ID)
+	previous := state.Moderation
+	switch {
+	case len(reason) != 0 && (previous == nil || previous.Reason != reason):
+		state.Moderation = &Moderation{Reason: reason, PublishURL: status.PublishURL, Since: time.Now().UTC()}
+	case len(reason) == 0 && previous != nil:
+		state.Moderation = nil
+	default:
+		s.mu.Unlock()
+		return len(reason) != 0
+	}
+	s.userListChanged = true
+	s.mu.Unlock()
+
+	if len(reason) == 0 {
+		s.notify(user, &Event{
+			Type:     EventResumeRestored,
+			ResumeID: resume.ID,
+			Title:    resume.Title,
+			Message:  fmt.Sprintf("Резюме \"%s\" снова доступно для публикации, обновления возобновлены", resume.Title),
+		})
+		return false
+	}
+	message := fmt.Sprintf("Резюме \"%s\" заблокировано модератором, обновления остановлены", resume.Title)
+	if reason == ModerationUnfinished {
+		message = fmt.Sprintf("Резюме \"%s\" не заполнено до конца, обновления остановлены", resume.Title)
+	}
+	s.notify(user, &Event{
+		Type:     EventResumeBlocked,
+		ResumeID: resume.ID,
+		Title:    resume.Title,
+		Message:  message,
+		URL:      status.PublishURL,
+	})
+	return true
+}
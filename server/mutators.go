@@ -0,0 +1,382 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/artkescha/hh-updater/config"
+	"github.com/artkescha/hh-updater/hhclient"
+)
+
+const (
+	MutatorSuffix    = "suffix"
+	MutatorVariants  = "variants"
+	MutatorInvisible = "invisible"
+	MutatorSkills    = "skills"
+	MutatorTitle     = "title"
+	// MutatorNone disables resume edits for a user or a resume.
+	MutatorNone = "none"
+
+	// DefaultInvisibleChar is a zero width space.
+	DefaultInvisibleChar = "\u200b"
+)
+
+// FieldChange describes a single resume field modified by a mutator.
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// ResumeMutator modifies a resume so hh treats it as edited. Revert must undo
+// whatever Mutate did, so a resume can be switched to another mutator or
+// restored to its original text.
+type ResumeMutator interface {
+	Name() string
+	Mutate(resume *hhclient.Resume) ([]FieldChange, error)
+	Revert(resume *hhclient.Resume) ([]FieldChange, error)
+}
+
+func NewMutator(name string, conf config.MutatorConfig) (ResumeMutator, error) {
+	switch conf.Type {
+	case MutatorSuffix:
+		if len(conf.Suffix) == 0 {
+			return nil, fmt.Errorf("mutator %s: empty suffix", name)
+		}
+		return &SuffixMutator{name: name, Suffix: conf.Suffix}, nil
+	case MutatorVariants:
+		if len(conf.Variants) < 2 {
+			return nil, fmt.Errorf("mutator %s: at least two variants required", name)
+		}
+		return &VariantMutator{name: name, Variants: conf.Variants}, nil
+	case MutatorInvisible:
+		char := conf.Char
+		if len(char) == 0 {
+			char = DefaultInvisibleChar
+		}
+		return &SuffixMutator{name: name, Suffix: char}, nil
+	case MutatorSkills:
+		return &SkillsMutator{name: name}, nil
+	case MutatorTitle:
+		return &TitleMutator{name: name, Variants: conf.Variants}, nil
+	}
+	return nil, fmt.Errorf("mutator %s: unknown type %q", name, conf.Type)
+}
+
+// SuffixMutator toggles a suffix on every experience description. With an
+// invisible character as the suffix the resume text does not visibly change.
+type SuffixMutator struct {
+	name   string
+	Suffix string
+}
+
+func (m *SuffixMutator) Name() string {
+	return m.name
+}
+
+func (m *SuffixMutator) Mutate(resume *hhclient.Resume) ([]FieldChange, error) {
+	return mutateDescriptions(resume, func(desc string) string {
+		return updateDescription(desc, m.Suffix)
+	}), nil
+}
+
+func (m *SuffixMutator) Revert(resume *hhclient.Resume) ([]FieldChange, error) {
+	return mutateDescriptions(resume, func(desc string) string {
+		return strings.TrimSuffix(desc, m.Suffix)
+	}), nil
+}
+
+// VariantMutator rotates the ending of every experience description among
+// the configured variants.
+type VariantMutator struct {
+	name     string
+	Variants []string
+}
+
+func (m *VariantMutator) Name() string {
+	return m.name
+}
+
+func (m *VariantMutator) Mutate(resume *hhclient.Resume) ([]FieldChange, error) {
+	return mutateDescriptions(resume, func(desc string) string {
+		base, idx := m.split(desc)
+		return base + m.Variants[(idx+1)%len(m.Variants)]
+	}), nil
+}
+
+func (m *VariantMutator) Revert(resume *hhclient.Resume) ([]FieldChange, error) {
+	return mutateDescriptions(resume, func(desc string) string {
+		base, _ := m.split(desc)
+		return base
+	}), nil
+}
+
+// split cuts the longest matching variant off the description. The returned
+// index is -1 if the description ends with none of them.
+func (m *VariantMutator) split(desc string) (string, int) {
+	idx := -1
+	for i, variant := range m.Variants {
+		if len(variant) == 0 || !strings.HasSuffix(desc, variant) {
+			continue
+		}
+		if idx < 0 || len(variant) > len(m.Variants[idx]) {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return desc, idx
+	}
+	return strings.TrimSuffix(desc, m.Variants[idx]), idx
+}
+
+// ResumeOriginal keeps the resume fields as they were before a mutator was
+// first applied, for the mutators whose edits can not be told from the text.
+type ResumeOriginal struct {
+	Title    string   `json:"title"`
+	SkillSet []string `json:"skill_set,omitempty"`
+}
+
+func (o *ResumeOriginal) captured() bool {
+	return len(o.Title) != 0
+}
+
+func (o *ResumeOriginal) capture(resume *hhclient.Resume) {
+	o.Title = resume.Title
+	o.SkillSet = append([]string(nil), resume.SkillSet...)
+}
+
+// bindMutator returns the mutator working on the original fields and the
+// title variants of a resume. The mutators not needing them are returned
+// as is.
+func bindMutator(m ResumeMutator, original *ResumeOriginal, titleVariants []string) ResumeMutator {
+	switch m := m.(type) {
+	case *SkillsMutator:
+		return &SkillsMutator{name: m.name, original: original}
+	case *TitleMutator:
+		variants := m.Variants
+		if len(titleVariants) != 0 {
+			variants = titleVariants
+		}
+		return &TitleMutator{name: m.name, Variants: variants, original: original}
+	}
+	return m
+}
+
+// SkillsMutator toggles the key skills between the original order and the
+// one with the first skill moved to the end.
+type SkillsMutator struct {
+	name     string
+	original *ResumeOriginal
+}
+
+func (m *SkillsMutator) Name() string {
+	return m.name
+}
+
+func (m *SkillsMutator) Mutate(resume *hhclient.Resume) ([]FieldChange, error) {
+	if m.original == nil {
+		return nil, errors.New("skills mutator is not bound to a resume")
+	}
+	if !m.ours(resume.SkillSet) {
+		// The skills were edited on hh, their order is the original now.
+		m.original.SkillSet = append([]string(nil), resume.SkillSet...)
+	}
+	original := m.original.SkillSet
+	if len(original) < 2 {
+		return nil, nil
+	}
+	if rotated := rotateSkills(original); !equalSkills(resume.SkillSet, rotated) {
+		return setSkills(resume, rotated), nil
+	}
+	return setSkills(resume, original), nil
+}
+
+func (m *SkillsMutator) Revert(resume *hhclient.Resume) ([]FieldChange, error) {
+	if m.original == nil || !m.ours(resume.SkillSet) {
+		// Keep the skills edited on hh as they are.
+		return nil, nil
+	}
+	return setSkills(resume, m.original.SkillSet), nil
+}
+
+// ours reports whether the skills are in the original or the rotated
+// order, that is not edited on hh since the mutator set them.
+func (m *SkillsMutator) ours(skills []string) bool {
+	original := m.original.SkillSet
+	return equalSkills(skills, original) || (len(original) >= 2 && equalSkills(skills, rotateSkills(original)))
+}
+
+func rotateSkills(skills []string) []string {
+	return append(append([]string(nil), skills[1:]...), skills[0])
+}
+
+func setSkills(resume *hhclient.Resume, skills []string) []FieldChange {
+	if equalSkills(resume.SkillSet, skills) {
+		return nil
+	}
+	change := FieldChange{Field: "skill_set", Old: strings.Join(resume.SkillSet, ", "), New: strings.Join(skills, ", ")}
+	resume.SkillSet = append([]string(nil), skills...)
+	return []FieldChange{change}
+}
+
+func equalSkills(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TitleMutator rotates the resume title among the original title and the
+// variants, set per resume or in the config. Revert restores the original
+// title.
+type TitleMutator struct {
+	name     string
+	Variants []string
+	original *ResumeOriginal
+}
+
+func (m *TitleMutator) Name() string {
+	return m.name
+}
+
+func (m *TitleMutator) Mutate(resume *hhclient.Resume) ([]FieldChange, error) {
+	if m.original == nil {
+		return nil, errors.New("title mutator is not bound to a resume")
+	}
+	if len(m.Variants) == 0 {
+		return nil, fmt.Errorf("no title variants for mutator %s", m.name)
+	}
+	titles := []string{m.original.Title}
+	for _, variant := range m.Variants {
+		if variant != m.original.Title {
+			titles = append(titles, variant)
+		}
+	}
+	idx := -1
+	for i, title := range titles {
+		if title == resume.Title {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		// The title was edited on hh, it is the original now.
+		m.original.Title = resume.Title
+		titles[0], idx = resume.Title, 0
+	}
+	return setTitle(resume, titles[(idx+1)%len(titles)]), nil
+}
+
+func (m *TitleMutator) Revert(resume *hhclient.Resume) ([]FieldChange, error) {
+	if m.original == nil || !m.original.captured() {
+		return nil, nil
+	}
+	return setTitle(resume, m.original.Title), nil
+}
+
+func setTitle(resume *hhclient.Resume, title string) []FieldChange {
+	if resume.Title == title {
+		return nil
+	}
+	change := FieldChange{Field: "title", Old: resume.Title, New: title}
+	resume.Title = title
+	return []FieldChange{change}
+}
+
+func mutateDescriptions(resume *hhclient.Resume, fn func(string) string) []FieldChange {
+	var changes []FieldChange
+	for idx := range resume.Experience {
+		old := resume.Experience[idx].Description
+		desc := fn(old)
+		if desc == old {
+			continue
+		}
+		resume.Experience[idx].Description = desc
+		changes = append(changes, FieldChange{
+			Field: "experience." + strconv.Itoa(idx) + ".description",
+			Old:   old,
+			New:   desc,
+		})
+	}
+	return changes
+}
+
+// buildMutators builds the configured mutators and returns them with the
+// default mutator name. experience_description_suffix is kept working as
+// the default suffix mutator.
+func buildMutators(c *config.Config) (map[string]ResumeMutator, string, error) {
+	mutators := map[string]ResumeMutator{
+		MutatorInvisible: &SuffixMutator{name: MutatorInvisible, Suffix: DefaultInvisibleChar},
+		MutatorSkills:    &SkillsMutator{name: MutatorSkills},
+		MutatorTitle:     &TitleMutator{name: MutatorTitle},
+	}
+	if len(c.ExperienceDescSuffix) != 0 {
+		mutators[MutatorSuffix] = &SuffixMutator{name: MutatorSuffix, Suffix: c.ExperienceDescSuffix}
+	}
+	for name, conf := range c.Mutators {
+		mutator, err := NewMutator(name, conf)
+		if err != nil {
+			return nil, "", err
+		}
+		mutators[name] = mutator
+	}
+	defaultMutator := c.DefaultMutator
+	if len(defaultMutator) == 0 && len(c.ExperienceDescSuffix) != 0 {
+		defaultMutator = MutatorSuffix
+	}
+	if _, ok := mutators[defaultMutator]; len(defaultMutator) != 0 && defaultMutator != MutatorNone && !ok {
+		return nil, "", fmt.Errorf("Unknown default mutator %s", defaultMutator)
+	}
+	return mutators, defaultMutator, nil
+}
+
+func (s *Server) initMutators() error {
+	mutators, defaultMutator, err := buildMutators(s.conf())
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.mutators, s.defaultMutator = mutators, defaultMutator
+	s.mu.Unlock()
+	return nil
+}
+
+// mutator returns the named mutator. The caller must not hold s.mu.
+func (s *Server) mutator(name string) (ResumeMutator, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.mutators[name]
+	return m, ok
+}
+
+// mutatorNames lists the available mutators. The caller must hold s.mu.
+func (s *Server) mutatorNames() []string {
+	names := make([]string, 0, len(s.mutators))
+	for name := range s.mutators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mutatorFor picks the resume mutator, falling back to the user one and then
+// to the configured default. It returns nil if the resume must not be edited.
+// The caller must hold s.mu.
+func (s *Server) mutatorFor(user *User, resumeID string) ResumeMutator {
+	name := s.defaultMutator
+	if len(user.Mutator) != 0 {
+		name = user.Mutator
+	}
+	if state, ok := user.Resumes[resumeID]; ok && len(state.Mutator) != 0 {
+		name = state.Mutator
+	}
+	return s.mutators[name]
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/artkescha/hh-updater/config"
+	"github.com/artkescha/hh-updater/hhclient"
+)
+
+func testResume() *hhclient.Resume {
+	return &hhclient.Resume{
+		ID:       "r1",
+		Title:    "Go developer",
+		SkillSet: []string{"Go", "SQL", "Docker"},
+		Experience: []hhclient.Company{
+			{Name: "A", Description: "Backend services"},
+			{Name: "B", Description: "Internal tools"},
+		},
+	}
+}
+
+func copyResume(r *hhclient.Resume) *hhclient.Resume {
+	c := *r
+	c.SkillSet = append([]string(nil), r.SkillSet...)
+	c.Experience = append([]hhclient.Company(nil), r.Experience...)
+	return &c
+}
+
+func TestMutatorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		conf config.MutatorConfig
+	}{
+		{"suffix", config.MutatorConfig{Type: MutatorSuffix, Suffix: " "}},
+		{"invisible", config.MutatorConfig{Type: MutatorInvisible}},
+		{"variants", config.MutatorConfig{Type: MutatorVariants, Variants: []string{".", "!", " :)"}}},
+		{"skills", config.MutatorConfig{Type: MutatorSkills}},
+		{"title", config.MutatorConfig{Type: MutatorTitle, Variants: []string{"Golang developer", "Go engineer"}}},
+	}
+	for _, tt := range tests {
+		m, err := NewMutator(tt.name, tt.conf)
+		if err != nil {
+			t.Fatalf("%s: NewMutator: %v", tt.name, err)
+		}
+		for rounds := 1; rounds <= 4; rounds++ {
+			want := testResume()
+			resume := copyResume(want)
+			// The server captures the original once and binds the mutator
+			// for every update.
+			var original ResumeOriginal
+			original.capture(resume)
+			for i := 0; i < rounds; i++ {
+				before := copyResume(resume)
+				changes, err := bindMutator(m, &original, nil).Mutate(resume)
+				if err != nil {
+					t.Fatalf("%s: Mutate %d: %v", tt.name, i+1, err)
+				}
+				if len(changes) == 0 || reflect.DeepEqual(before, resume) {
+					t.Errorf("%s: Mutate %d changed nothing", tt.name, i+1)
+				}
+				for _, change := range changes {
+					if got, _ := resumeField(resume, change.Field); got != change.New {
+						t.Errorf("%s: Mutate %d reported %s = %q, resume has %q", tt.name, i+1, change.Field, change.New, got)
+					}
+				}
+			}
+			if _, err := bindMutator(m, &original, nil).Revert(resume); err != nil {
+				t.Fatalf("%s: Revert: %v", tt.name, err)
+			}
+			if !reflect.DeepEqual(resume, want) {
+				t.Errorf("%s: after %d mutations and Revert got %+v, want %+v", tt.name, rounds, resume, want)
+			}
+		}
+	}
+}
+
+func TestSkillsMutatorKeepsSkillsEditedOnHH(t *testing.T) {
+	m := &SkillsMutator{name: MutatorSkills}
+	resume := testResume()
+	var original ResumeOriginal
+	original.capture(resume)
+	if _, err := bindMutator(m, &original, nil).Mutate(resume); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		edited []string
+	}{
+		{"reordered", []string{"Docker", "Go", "SQL"}},
+		{"added", []string{"Go", "SQL", "Docker", "Kubernetes"}},
+	}
+	for _, tt := range tests {
+		resume.SkillSet = append([]string(nil), tt.edited...)
+		if _, err := bindMutator(m, &original, nil).Mutate(resume); err != nil {
+			t.Fatalf("%s: Mutate: %v", tt.name, err)
+		}
+		if _, err := bindMutator(m, &original, nil).Revert(resume); err != nil {
+			t.Fatalf("%s: Revert: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(resume.SkillSet, tt.edited) {
+			t.Errorf("%s: skills after Revert = %v, want %v", tt.name, resume.SkillSet, tt.edited)
+		}
+	}
+}
+
+func TestTitleMutator(t *testing.T) {
+	m := &TitleMutator{name: MutatorTitle, Variants: []string{"From config"}}
+	tests := []struct {
+		name          string
+		titleVariants []string
+		want          []string
+	}{
+		{"config variants", nil, []string{"From config", "Go developer", "From config"}},
+		{"resume variants", []string{"Golang developer", "Go developer", "Go engineer"},
+			[]string{"Golang developer", "Go engineer", "Go developer"}},
+	}
+	for _, tt := range tests {
+		resume := testResume()
+		var original ResumeOriginal
+		original.capture(resume)
+		for i, want := range tt.want {
+			if _, err := bindMutator(m, &original, tt.titleVariants).Mutate(resume); err != nil {
+				t.Fatalf("%s: Mutate: %v", tt.name, err)
+			}
+			if resume.Title != want {
+				t.Errorf("%s: title after %d mutations = %q, want %q", tt.name, i+1, resume.Title, want)
+			}
+		}
+	}
+
+	resume := testResume()
+	var original ResumeOriginal
+	original.capture(resume)
+	bound := bindMutator(m, &original, nil)
+	if _, err := bound.Mutate(resume); err != nil {
+		t.Fatal(err)
+	}
+	// A title edited on hh becomes the original.
+	resume.Title = "Senior Go developer"
+	if _, err := bound.Mutate(resume); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bound.Revert(resume); err != nil {
+		t.Fatal(err)
+	}
+	if resume.Title != "Senior Go developer" {
+		t.Errorf("title after Revert = %q, want the title edited on hh", resume.Title)
+	}
+
+	if _, err := m.Mutate(testResume()); err == nil {
+		t.Error("Mutate of an unbound title mutator succeeded, want an error")
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"time"
+
+	"github.com/artkescha/hh-updater/logging"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	EventResumeBlocked  = "resume.blocked"
+	EventResumeRestored = "resume.restored"
+	// EventResumeFailing is sent once the resume fails to update
+	// failure_alert_threshold times in a row.
+	EventResumeFailing = "resume.failing"
+	// EventTokenExpired is sent when hh rejects the refresh token, i.e. the
+	// access was revoked or has expired and the user must log in again.
+	EventTokenExpired = "token.expired"
+	// EventResumePublished and EventResumeFailed are sent on every update
+	// of a resume; they are not kept in the notification list.
+	EventResumePublished = "resume.published"
+	EventResumeFailed    = "resume.failed"
+	// EventResumeEdited is sent when the mutator edits the resume on
+	// publish, along with EventResumePublished.
+	EventResumeEdited = "resume.edited"
+	// EventInvitation is sent when an employer invites the user.
+	EventInvitation = "negotiation.invitation"
+	// EventUserDeleted is sent when the user is removed from hh-updater.
+	EventUserDeleted = "user.deleted"
+
+	// notificationLimit is the number of notifications kept per user.
+	notificationLimit = 20
+)
+
+// Event is something the user should know about.
+type Event struct {
+	Type     string    `json:"type"`
+	UserID   string    `json:"user_id"`
+	ResumeID string    `json:"resume_id,omitempty"`
+	Title    string    `json:"title,omitempty"`
+	Message  string    `json:"message"`
+	URL      string    `json:"url,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// Notifier delivers events to users through some channel. Notify is called
+// without holding the server lock.
+type Notifier interface {
+	Notify(user *User, event *Event) error
+}
+
+// notify keeps the event in the user notification list shown in the UI and
+// passes it to the configured notifiers.
+func (s *Server) notify(user *User, event *Event) {
+	event.UserID = user.ID
+	if event.At.IsZero() {
+		event.At = time.Now().UTC()
+	}
+	s.mu.Lock()
+	user.Notifications = append(user.Notifications, event)
+	if n := len(user.Notifications); n > notificationLimit {
+		user.Notifications = user.Notifications[n-notificationLimit:]
+	}
+	s.userListChanged = true
+	s.mu.Unlock()
+	logrus.WithField(logging.FieldUserID, user.ID).Infof("Event %s: %s", event.Type, event.Message)
+	s.broadcast(user, event)
+}
+
+// broadcast passes the event to the configured notifiers only.
+func (s *Server) broadcast(user *User, event *Event) {
+	event.UserID = user.ID
+	if event.At.IsZero() {
+		event.At = time.Now().UTC()
+	}
+	for _, notifier := range s.notifiers {
+		if err := notifier.Notify(user, event); err != nil {
+			logrus.WithField(logging.FieldUserID, user.ID).Errorf("Error sending %s event: %v", event.Type, err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/artkescha/hh-updater/hhclient"
+	"github.com/artkescha/hh-updater/logging"
+	"github.com/sirupsen/logrus"
+)
+
+var ErrUserNotFound = errors.New("User not found")
+
+func (s *Server) userDisabled(user *User) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return user.Disabled
+}
+
+// Users returns the users sorted by ID.
+func (s *Server) Users() []*User {
+	users := s.users()
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+	return users
+}
+
+// FindUser looks a user up by ID or email.
+func (s *Server) FindUser(idOrEmail string) (*User, error) {
+	if user, ok := s.getUser(idOrEmail); ok {
+		return user, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, user := range s.userList {
+		if strings.EqualFold(user.Email, idOrEmail) {
+			return user, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (s *Server) SetUserDisabled(user *User, disabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user.Disabled = disabled
+	s.userListChanged = true
+}
+
+// DeleteUser removes the user with the user webhooks and resume versions,
+// after sending the webhooks the user.deleted event.
+func (s *Server) DeleteUser(user *User) {
+	s.broadcast(user, &Event{Type: EventUserDeleted, Message: "Пользователь удалён"})
+	s.mu.Lock()
+	delete(s.userList, user.ID)
+	s.userListChanged = true
+	s.mu.Unlock()
+	if err := s.deleteUserWebhooks(user.ID); err != nil {
+		logrus.WithField(logging.FieldUserID, user.ID).Errorf("Error deleting webhooks: %v", err)
+	}
+	if err := s.deleteUserSnapshots(user.ID); err != nil {
+		logrus.WithField(logging.FieldUserID, user.ID).Errorf("Error deleting resume versions: %v", err)
+	}
+}
+
+// RunOnce runs a single update cycle over all the enabled users and returns
+// the outcomes by user ID.
+func (s *Server) RunOnce() map[string][]*ResumeOutcome {
+	results := map[string][]*ResumeOutcome{}
+	log := newCycleLog()
+	for _, user := range s.Users() {
+		if s.userDisabled(user) || s.userPaused(user, time.Now()) {
+			continue
+		}
+		outcomes, err := s.updateUser(log, user)
+		if err != nil {
+			log.WithField(logging.FieldUserID, user.ID).Error(err)
+		}
+		results[user.ID] = outcomes
+	}
+	return results
+}
+
+// RefreshToken refreshes the user token right away.
+func (s *Server) RefreshToken(user *User) error {
+	return s.refresher.Refresh(user)
+}
+
+// UserResumes lists the user resumes on hh.
+func (s *Server) UserResumes(user *User) ([]*hhclient.Resume, error) {
+	s.mu.RLock()
+	client := s.newClient(user.Token)
+	s.mu.RUnlock()
+	return client.Resume.ResumeMine()
+}
+
+// Close closes the database without writing the user list.
+func (s *Server) Close() error {
+	return s.db.Close()
+}
+
+// ValidateConfig checks the parts of the configuration interpreted by the
+// server without opening the database.
+func (s *Server) ValidateConfig() error {
+	return s.initMutators()
+}
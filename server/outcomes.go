@@ -0,0 +1,104 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	OutcomePublished         = "published"
+	OutcomeEdited            = "edited"
+	OutcomeSkippedNotAllowed = "skipped_not_allowed"
+	OutcomeSkippedBlocked    = "skipped_blocked"
+	OutcomeFailed            = "failed"
+	// OutcomePlanned is reported in dry run mode for a resume which would
+	// have been published.
+	OutcomePlanned = "planned"
+)
+
+var ErrEditRolledBack = errors.New("Edit changed unexpected fields and was rolled back")
+
+// ResumeOutcome is the result of a single resume in an update cycle. Edited
+// means the resume was both published and edited. Error may be set for a
+// published resume whose edit failed.
+type ResumeOutcome struct {
+	ResumeID string        `json:"resume_id"`
+	Title    string        `json:"title"`
+	Status   string        `json:"status"`
+	Error    string        `json:"error,omitempty"`
+	Changes  []FieldChange `json:"changes,omitempty"`
+	At       time.Time     `json:"at"`
+}
+
+func (o *ResumeOutcome) fail(err error) *ResumeOutcome {
+	o.Status = OutcomeFailed
+	o.Error = err.Error()
+	return o
+}
+
+func (o *ResumeOutcome) Published() bool {
+	return o.Status == OutcomePublished || o.Status == OutcomeEdited
+}
+
+func publishedCount(outcomes []*ResumeOutcome) int {
+	var count int
+	for _, outcome := range outcomes {
+		if outcome.Published() {
+			count++
+		}
+	}
+	return count
+}
+
+// recordOutcome keeps the outcome in the resume state and the digest and
+// alerts the user once the resume has failed failure_alert_threshold times
+// in a row.
+func (s *Server) recordOutcome(user *User, outcome *ResumeOutcome) {
+	s.mu.Lock()
+	state := user.resumeState(outcome.ResumeID)
+	state.LastOutcome = outcome
+	switch {
+	case outcome.Status == OutcomeFailed:
+		state.Failures++
+	case outcome.Published():
+		state.Failures = 0
+		user.digestResume(outcome.ResumeID).Publishes++
+	}
+	failures := state.Failures
+	s.userListChanged = true
+	s.metrics.outcomes.Inc(outcome.Status)
+	s.mu.Unlock()
+	switch {
+	case outcome.Published():
+		s.broadcast(user, &Event{
+			Type:     EventResumePublished,
+			ResumeID: outcome.ResumeID,
+			Title:    outcome.Title,
+			Message:  fmt.Sprintf("Резюме \"%s\" поднято в поиске", outcome.Title),
+		})
+		if outcome.Status == OutcomeEdited {
+			s.broadcast(user, &Event{
+				Type:     EventResumeEdited,
+				ResumeID: outcome.ResumeID,
+				Title:    outcome.Title,
+				Message:  fmt.Sprintf("Резюме \"%s\" изменено", outcome.Title),
+			})
+		}
+	case outcome.Status == OutcomeFailed:
+		s.broadcast(user, &Event{
+			Type:     EventResumeFailed,
+			ResumeID: outcome.ResumeID,
+			Title:    outcome.Title,
+			Message:  fmt.Sprintf("Не удалось обновить резюме \"%s\": %s", outcome.Title, outcome.Error),
+		})
+	}
+	if outcome.Status == OutcomeFailed && failures == s.conf().FailureAlertThreshold {
+		s.notify(user, &Event{
+			Type:     EventResumeFailing,
+			ResumeID: outcome.ResumeID,
+			Title:    outcome.Title,
+			Message:  fmt.Sprintf("Резюме \"%s\" не удалось обновить %d раз подряд: %s", outcome.Title, failures, outcome.Error),
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/artkescha/hh-updater/logging"
+	"github.com/sirupsen/logrus"
+)
+
+const UserStatePaused = "paused"
+
+// Pause stops the updates of a user or a resume. Without ResumeOn the pause
+// lasts until it is removed.
+type Pause struct {
+	Since    time.Time  `json:"since"`
+	ResumeOn *time.Time `json:"resume_on,omitempty"`
+}
+
+// active reports whether the pause is in effect at now.
+func (p *Pause) active(now time.Time) bool {
+	return p != nil && (p.ResumeOn == nil || now.Before(*p.ResumeOn))
+}
+
+// userState returns the state of the user. The caller holds s.mu.
+func userState(user *User, now time.Time) string {
+	switch {
+	case user.Disabled:
+		return UserStateDisabled
+	case user.Pause.active(now):
+		return UserStatePaused
+	}
+	return UserStateActive
+}
+
+// userPaused reports whether the user updates are paused, removing the
+// pause once its resume date has come.
+func (s *Server) userPaused(user *User, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user.Pause == nil {
+		return false
+	}
+	if user.Pause.active(now) {
+		return true
+	}
+	user.Pause = nil
+	s.userListChanged = true
+	logrus.WithField(logging.FieldUserID, user.ID).Info("Pause ended, updates resumed")
+	return false
+}
+
+// resumePaused is userPaused for a single resume.
+func (s *Server) resumePaused(user *User, resumeID string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := user.Resumes[resumeID]
+	if !ok || state.Pause == nil {
+		return false
+	}
+	if state.Pause.active(now) {
+		return true
+	}
+	state.Pause = nil
+	s.userListChanged = true
+	return false
+}
+
+// SetPause pauses the user, or the resume if resumeID is set. A nil pause
+// resumes the updates.
+func (s *Server) SetPause(user *User, resumeID string, pause *Pause) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(resumeID) != 0 {
+		user.resumeState(resumeID).Pause = pause
+	} else {
+		user.Pause = pause
+	}
+	s.userListChanged = true
+}
+
+// parseResumeOn reads the date the updates resume on. A plain date is taken
+// as the start of that day in UTC.
+func parseResumeOn(raw string) (*time.Time, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		if t, err = time.Parse("2006-01-02", raw); err != nil {
+			return nil, fmt.Errorf("resume_on must be a date or an RFC 3339 time")
+		}
+	}
+	t = t.UTC()
+	return &t, nil
+}
+
+// PauseHandler pauses the updates of the user or of the resume given by
+// resume_id on POST, optionally until resume_on, and resumes them on DELETE.
+func (s *Server) PauseHandler(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromContext(r)
+	if user == nil {
+		http.Error(w, "Empty user data", http.StatusInternalServerError)
+		return
+	}
+	resumeID := r.FormValue("resume_id")
+	log := requestLog(r).WithFields(logrus.Fields{logging.FieldUserID: user.ID, logging.FieldResumeID: resumeID})
+	switch r.Method {
+	case http.MethodPost:
+		resumeOn, err := parseResumeOn(r.FormValue("resume_on"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		now := time.Now().UTC()
+		if resumeOn != nil && !resumeOn.After(now) {
+			http.Error(w, "resume_on must be in the future", http.StatusBadRequest)
+			return
+		}
+		s.SetPause(user, resumeID, &Pause{Since: now, ResumeOn: resumeOn})
+		log.Info("Updates paused")
+	case http.MethodDelete:
+		s.SetPause(user, resumeID, nil)
+		log.Info("Updates resumed")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.MeHandler(w, r)
+}
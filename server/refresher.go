@@ -0,0 +1,234 @@
+package server
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/artkescha/hh-updater/logging"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+const (
+	DefaultTokenRefreshAhead = 30 * time.Minute
+
+	tokenRefreshCheckInterval = time.Minute
+)
+
+var ErrNoRefreshToken = errors.New("No refresh token")
+
+// TokenRefresher refreshes user tokens before they expire instead of waiting
+// for the update cycle to stumble upon an expired one.
+type TokenRefresher struct {
+	s      *Server
+	ahead  time.Duration
+	jitter time.Duration
+
+	mu       sync.Mutex
+	schedule map[string]refreshSchedule
+	// userLocks serialize the refreshes of a user: hh rotates the refresh
+	// token, so concurrent refreshes would make all but one fail.
+	userLocks map[string]*sync.Mutex
+
+	refreshes uint64
+	failures  uint64
+}
+
+type refreshSchedule struct {
+	expiry time.Time
+	at     time.Time
+}
+
+type RefresherStats struct {
+	Refreshes uint64 `json:"refreshes"`
+	Failures  uint64 `json:"failures"`
+}
+
+func NewTokenRefresher(s *Server, ahead, jitter time.Duration) *TokenRefresher {
+	t := &TokenRefresher{
+		s:         s,
+		schedule:  map[string]refreshSchedule{},
+		userLocks: map[string]*sync.Mutex{},
+	}
+	t.setWindow(ahead, jitter)
+	return t
+}
+
+// setWindow changes how long before the expiry tokens are refreshed. The
+// tokens already scheduled are rescheduled.
+func (t *TokenRefresher) setWindow(ahead, jitter time.Duration) {
+	if ahead <= 0 {
+		ahead = DefaultTokenRefreshAhead
+	}
+	if jitter < 0 {
+		jitter = 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ahead == ahead && t.jitter == jitter {
+		return
+	}
+	t.ahead, t.jitter = ahead, jitter
+	t.schedule = map[string]refreshSchedule{}
+}
+
+func (t *TokenRefresher) Run() {
+	for {
+		t.s.health.beat(LoopRefresher)
+		t.refreshDue(time.Now())
+		stats := t.Stats()
+		logrus.Debugf("Token refresher: %d refreshes, %d failures", stats.Refreshes, stats.Failures)
+		if !t.s.sleep(tokenRefreshCheckInterval) {
+			return
+		}
+	}
+}
+
+func (t *TokenRefresher) Stats() RefresherStats {
+	return RefresherStats{
+		Refreshes: atomic.LoadUint64(&t.refreshes),
+		Failures:  atomic.LoadUint64(&t.failures),
+	}
+}
+
+func (t *TokenRefresher) refreshDue(now time.Time) {
+	for _, user := range t.s.users() {
+		if t.s.stopping() {
+			return
+		}
+		if t.s.userDisabled(user) || t.s.userTokenExpired(user) {
+			continue
+		}
+		at, ok := t.dueAt(user)
+		if !ok || now.Before(at) {
+			continue
+		}
+		if err := t.Refresh(user); err != nil {
+			logrus.WithField(logging.FieldUserID, user.ID).Errorf("Error refreshing token: %v", err)
+		}
+	}
+}
+
+// dueAt returns the moment the user token should be refreshed. The moment is
+// picked once per token expiry, so the jitter does not move on every check.
+func (t *TokenRefresher) dueAt(user *User) (time.Time, bool) {
+	t.s.mu.RLock()
+	token := user.Token
+	t.s.mu.RUnlock()
+	if token == nil || token.Expiry.IsZero() {
+		return time.Time{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sched, ok := t.schedule[user.ID]
+	if !ok || !sched.expiry.Equal(token.Expiry) {
+		at := token.Expiry.Add(-t.ahead)
+		if t.jitter > 0 {
+			at = at.Add(-time.Duration(rand.Int63n(int64(t.jitter))))
+		}
+		sched = refreshSchedule{expiry: token.Expiry, at: at}
+		t.schedule[user.ID] = sched
+	}
+	return sched.at, true
+}
+
+func (t *TokenRefresher) userLock(user *User) *sync.Mutex {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.userLocks[user.ID]
+	if !ok {
+		l = &sync.Mutex{}
+		t.userLocks[user.ID] = l
+	}
+	return l
+}
+
+// Refresh exchanges the user refresh token for a new token and persists it
+// right away. Concurrent calls for a user are serialized; a call that waited
+// for another one to refresh the token returns without refreshing again.
+func (t *TokenRefresher) Refresh(user *User) error {
+	t.s.mu.RLock()
+	seen := user.Token
+	t.s.mu.RUnlock()
+	l := t.userLock(user)
+	l.Lock()
+	defer l.Unlock()
+	t.s.mu.RLock()
+	current := user.Token
+	t.s.mu.RUnlock()
+	if current != seen && current.Valid() {
+		return nil
+	}
+	if current == nil || len(current.RefreshToken) == 0 {
+		t.failed()
+		return ErrNoRefreshToken
+	}
+	// A token without an access token is never valid, which forces the
+	// token source to go to hh even if the current one has not expired yet.
+	tokenSource := t.s.oAuthConf.TokenSource(oauth2.NoContext, &oauth2.Token{
+		RefreshToken: current.RefreshToken,
+	})
+	newToken, err := tokenSource.Token()
+	if err != nil {
+		t.failed()
+		// The token may have been replaced meanwhile, e.g. by a new login,
+		// then the rejected one does not mean the access is gone.
+		if tokenRejected(err) && t.s.userToken(user) == current {
+			t.s.tokenExpired(user)
+		}
+		return err
+	}
+	atomic.AddUint64(&t.refreshes, 1)
+	t.s.metrics.tokenRefreshes.Inc("success")
+	stored, err := t.s.replaceToken(user, current, newToken)
+	if err != nil {
+		logrus.WithField(logging.FieldUserID, user.ID).Errorf("Error saving token: %v", err)
+	}
+	if !stored {
+		logrus.WithField(logging.FieldUserID, user.ID).Info("Token replaced while refreshing, keeping the new one")
+		return nil
+	}
+	logrus.WithField(logging.FieldUserID, user.ID).Infof("New token expiry date: %s", newToken.Expiry.String())
+	return nil
+}
+
+// tokenRejected reports whether hh refused to refresh the token, as opposed
+// to a network or server failure worth retrying.
+func tokenRejected(err error) bool {
+	rErr, ok := err.(*oauth2.RetrieveError)
+	return ok && strings.Contains(string(rErr.Body), "invalid_grant")
+}
+
+// tokenExpired marks the user token as no longer refreshable and alerts the
+// user. The token is not refreshed again until the user logs in.
+func (s *Server) tokenExpired(user *User) {
+	s.mu.Lock()
+	if user.TokenExpiredAt != nil {
+		s.mu.Unlock()
+		return
+	}
+	now := time.Now().UTC()
+	user.TokenExpiredAt = &now
+	s.userListChanged = true
+	s.mu.Unlock()
+	s.notify(user, &Event{
+		Type:    EventTokenExpired,
+		Message: "Доступ к hh.ru отозван или истёк, войдите снова, чтобы возобновить обновления",
+		URL:     s.conf().PublicURLRaw,
+	})
+}
+
+func (s *Server) userTokenExpired(user *User) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return user.TokenExpiredAt != nil
+}
+
+func (t *TokenRefresher) failed() {
+	atomic.AddUint64(&t.failures, 1)
+	t.s.metrics.tokenRefreshes.Inc("failure")
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestConcurrentRefreshRotatesOnce(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	var calls int32
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	hh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if n == 1 {
+			close(entered)
+			<-release
+		}
+		// hh rotates the refresh token, the old one is rejected from now on.
+		if r.FormValue("refresh_token") != "r1" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"a%d","refresh_token":"r%d","token_type":"bearer","expires_in":3600}`, n+1, n+1)
+	}))
+	defer hh.Close()
+	s.oAuthConf.Endpoint = oauth2.Endpoint{TokenURL: hh.URL, AuthStyle: oauth2.AuthStyleInParams}
+	user := &User{ID: "u1", Token: &oauth2.Token{
+		AccessToken: "a1", RefreshToken: "r1", Expiry: time.Now().Add(time.Minute),
+	}}
+	s.userList[user.ID] = user
+
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errs[0] = s.RefreshToken(user)
+	}()
+	<-entered
+	// The second refresh starts with the old token and waits for the first.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errs[1] = s.RefreshToken(user)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("refresh %d: %v", i, err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("%d token requests, want 1", n)
+	}
+	if token := s.userToken(user); token.RefreshToken != "r2" || token.AccessToken != "a2" {
+		t.Errorf("token %+v, want the one of the first refresh", token)
+	}
+	if user.TokenExpiredAt != nil {
+		t.Error("token marked expired")
+	}
+	stats := s.refresher.Stats()
+	if stats != (RefresherStats{Refreshes: 1}) {
+		t.Errorf("refresher stats %+v", stats)
+	}
+
+	w := httptest.NewRecorder()
+	s.AdminStatusHandler(w, httptest.NewRequest(http.MethodGet, "/admin/status", nil))
+	var status AdminStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.TokenRefresher != stats || status.Users[UserStateActive] != 1 {
+		t.Errorf("admin status %+v", status)
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"github.com/artkescha/hh-updater/config"
+	"github.com/sirupsen/logrus"
+)
+
+// conf returns the current configuration. It is replaced as a whole on
+// reload, so callers should not keep it for long.
+func (s *Server) conf() *config.Config {
+	s.confMu.RLock()
+	defer s.confMu.RUnlock()
+	return s.c
+}
+
+// restartFields are the settings which only take effect after a restart.
+// Reload keeps their current values.
+var restartFields = []struct {
+	name string
+	copy func(dst, src *config.Config) bool
+}{
+	{"listen_address", func(dst, src *config.Config) bool {
+		changed := dst.ListenAddress != src.ListenAddress
+		dst.ListenAddress = src.ListenAddress
+		return changed
+	}},
+	{"metrics_listen_address", func(dst, src *config.Config) bool {
+		changed := dst.MetricsListenAddress != src.MetricsListenAddress
+		dst.MetricsListenAddress = src.MetricsListenAddress
+		return changed
+	}},
+	{"tls", func(dst, src *config.Config) bool {
+		changed := dst.TLS != src.TLS
+		dst.TLS = src.TLS
+		return changed
+	}},
+	{"database_path", func(dst, src *config.Config) bool {
+		changed := dst.DatabasePath != src.DatabasePath
+		dst.DatabasePath = src.DatabasePath
+		return changed
+	}},
+	// The state string is checked on the callback of the logins started
+	// before the reload too.
+	{"client_id, client_secret, redirect_url, state_string", func(dst, src *config.Config) bool {
+		changed := dst.ClientID != src.ClientID || dst.ClientSecret != src.ClientSecret ||
+			dst.RedirectURL != src.RedirectURL || dst.StateString != src.StateString
+		dst.ClientID, dst.ClientSecret, dst.RedirectURL = src.ClientID, src.ClientSecret, src.RedirectURL
+		dst.StateString = src.StateString
+		return changed
+	}},
+	{"public_url, cookie_name, cookie_encryption_key", func(dst, src *config.Config) bool {
+		changed := dst.PublicURLRaw != src.PublicURLRaw || dst.CookieName != src.CookieName ||
+			dst.CookieEncryptionKey != src.CookieEncryptionKey
+		dst.PublicURLRaw, dst.PublicURL = src.PublicURLRaw, src.PublicURL
+		dst.CookieName, dst.CookieHostname, dst.CookieSecure = src.CookieName, src.CookieHostname, src.CookieSecure
+		dst.CookieEncryptionKey, dst.CookieEncryptionCipher = src.CookieEncryptionKey, src.CookieEncryptionCipher
+		return changed
+	}},
+}
+
+// Reload swaps in the settings of c which are safe to change on a running
+// server. c must be validated already. If the mutators of c can not be
+// built, nothing is changed. A change of admin_ids applies at once, to the
+// next admin request, and is logged.
+func (s *Server) Reload(c *config.Config) error {
+	mutators, defaultMutator, err := buildMutators(c)
+	if err != nil {
+		return err
+	}
+	if err := c.ApplyLogging(); err != nil {
+		return err
+	}
+	current := s.conf()
+	for _, field := range restartFields {
+		if field.copy(c, current) {
+			logrus.Warnf("Configuration reload: %s changed, restart required to apply", field.name)
+		}
+	}
+	if !equalStrings(current.AdminIDs, c.AdminIDs) {
+		logrus.Warnf("Configuration reload: admin_ids changed from %v to %v", current.AdminIDs, c.AdminIDs)
+	}
+	s.confMu.Lock()
+	s.c = c
+	s.confMu.Unlock()
+	s.mu.Lock()
+	s.mutators, s.defaultMutator = mutators, defaultMutator
+	s.mu.Unlock()
+	s.refresher.setWindow(c.TokenRefreshAhead, c.TokenRefreshJitter)
+	logrus.Info("Configuration reloaded")
+	return nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
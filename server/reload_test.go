@@ -0,0 +1,82 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// warningHook collects the warnings logged.
+type warningHook struct {
+	messages []string
+}
+
+func (h *warningHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.WarnLevel}
+}
+
+func (h *warningHook) Fire(e *logrus.Entry) error {
+	h.messages = append(h.messages, e.Message)
+	return nil
+}
+
+func TestReload(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	before := *s.conf()
+	hook := &warningHook{}
+	hooks := logrus.StandardLogger().ReplaceHooks(logrus.LevelHooks{})
+	defer logrus.StandardLogger().ReplaceHooks(hooks)
+	logrus.AddHook(hook)
+
+	c := before
+	// Restart only.
+	c.ListenAddress = "127.0.0.1:9999"
+	c.DatabasePath = "/elsewhere.db"
+	c.ClientSecret = "other secret"
+	c.StateString = "other state"
+	c.CookieName = "other"
+	// Live.
+	c.UpdateInterval = 5 * time.Minute
+	c.SnapshotLimit = 3
+	c.TokenRefreshAhead = time.Hour
+	c.AdminIDs = []string{"42"}
+	if err := s.Reload(&c); err != nil {
+		t.Fatal(err)
+	}
+
+	after := s.conf()
+	fields := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"listen_address", after.ListenAddress, before.ListenAddress},
+		{"database_path", after.DatabasePath, before.DatabasePath},
+		{"client_secret", after.ClientSecret, before.ClientSecret},
+		{"state_string", after.StateString, before.StateString},
+		{"cookie_name", after.CookieName, before.CookieName},
+		{"update_interval", after.UpdateInterval, 5 * time.Minute},
+		{"snapshot_limit", after.SnapshotLimit, 3},
+		{"admin_ids", strings.Join(after.AdminIDs, ","), "42"},
+	}
+	for _, tt := range fields {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v after reload, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+	if s.refresher.ahead != time.Hour {
+		t.Errorf("refresher window %s after reload, want 1h", s.refresher.ahead)
+	}
+	want := []string{"listen_address", "database_path", "state_string", "cookie_name", "admin_ids"}
+	logged := strings.Join(hook.messages, "\n")
+	for _, field := range want {
+		if !strings.Contains(logged, field) {
+			t.Errorf("no warning about %s in %q", field, logged)
+		}
+	}
+	if strings.Contains(logged, "update_interval") || strings.Contains(logged, "snapshot_limit") {
+		t.Errorf("warning about a live field in %q", logged)
+	}
+}
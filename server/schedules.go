@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/artkescha/hh-updater/logging"
+	"github.com/artkescha/hh-updater/schedule"
+	"github.com/sirupsen/logrus"
+)
+
+// userSchedule returns the schedule of the user, the default of the config
+// unless the user has set one.
+func (s *Server) userSchedule(user *User) (schedule.Schedule, error) {
+	s.mu.RLock()
+	spec := user.Schedule
+	s.mu.RUnlock()
+	if spec == nil {
+		conf := s.conf()
+		spec = &conf.Schedule
+	}
+	return schedule.Parse(spec)
+}
+
+// scheduleDue reports whether the update loop should update the user at
+// now. If not, the user is added to pending by the time the schedule opens.
+func (s *Server) scheduleDue(log *logrus.Entry, user *User, now time.Time, pending map[string]time.Time) bool {
+	sched, err := s.userSchedule(user)
+	if err != nil {
+		// The schedule was valid when saved, e.g. the time zone data is gone.
+		log.WithField(logging.FieldUserID, user.ID).Warnf("Invalid schedule, updating anyway: %v", err)
+		sched = schedule.Always{}
+	}
+	// A cron run missed long ago, e.g. before the schedule was set, is not
+	// caught up.
+	last := now.Add(-s.conf().UpdateInterval)
+	s.mu.RLock()
+	if user.ScheduledAt != nil && user.ScheduledAt.After(last) {
+		last = *user.ScheduledAt
+	}
+	s.mu.RUnlock()
+	if !sched.Due(last, now) {
+		if next := sched.Next(now); !next.IsZero() {
+			pending[user.ID] = next
+		}
+		log.WithField(logging.FieldUserID, user.ID).Debug("Outside of the schedule, update postponed")
+		return false
+	}
+	delete(pending, user.ID)
+	if s.dryRun() {
+		// A dry run leaves the schedule to the next real run.
+		return true
+	}
+	s.mu.Lock()
+	at := now.UTC()
+	user.ScheduledAt = &at
+	s.userListChanged = true
+	s.mu.Unlock()
+	return true
+}
+
+// splitLines returns the non-empty trimmed lines of raw.
+func splitLines(raw string) []string {
+	var list []string
+	for _, line := range strings.Split(raw, "\n") {
+		if line = strings.TrimSpace(line); len(line) != 0 {
+			list = append(list, line)
+		}
+	}
+	return list
+}
+
+// splitList reads a comma separated form value.
+func splitList(raw string) []string {
+	var list []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); len(item) != 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// ScheduleInfo is the response of the schedule settings.
+type ScheduleInfo struct {
+	Default schedule.Spec  `json:"default"`
+	User    *schedule.Spec `json:"user"`
+	// Next is the first moment the updates are allowed from now on.
+	Next *time.Time `json:"next,omitempty"`
+}
+
+// ScheduleHandler shows the schedule of the user on GET, sets the user
+// schedule from the time_zone, weekdays, windows and cron values on POST
+// and returns to the default schedule on DELETE.
+func (s *Server) ScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromContext(r)
+	if user == nil {
+		http.Error(w, "Empty user data", http.StatusInternalServerError)
+		return
+	}
+	log := requestLog(r).WithField(logging.FieldUserID, user.ID)
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		spec := &schedule.Spec{
+			TimeZone: strings.TrimSpace(r.FormValue("time_zone")),
+			Weekdays: splitList(r.FormValue("weekdays")),
+			Windows:  splitList(r.FormValue("windows")),
+			Cron:     strings.TrimSpace(r.FormValue("cron")),
+		}
+		if _, err := schedule.Parse(spec); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid schedule: %v", err), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		user.Schedule = spec
+		s.userListChanged = true
+		s.mu.Unlock()
+		log.Info("Schedule changed")
+	case http.MethodDelete:
+		s.mu.Lock()
+		user.Schedule = nil
+		s.userListChanged = true
+		s.mu.Unlock()
+		log.Info("Schedule reset to the default")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	info := &ScheduleInfo{Default: s.conf().Schedule}
+	s.mu.RLock()
+	info.User = user.Schedule
+	s.mu.RUnlock()
+	if sched, err := s.userSchedule(user); err == nil {
+		if next := sched.Next(time.Now()); !next.IsZero() {
+			info.Next = &next
+		}
+	}
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		http.Error(w, fmt.Sprintf("Cannot encode response data: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestScheduleDueDryRun(t *testing.T) {
+	tests := []struct {
+		name        string
+		dryRun      bool
+		wantChanged bool
+	}{
+		{"real run", false, true},
+		{"dry run", true, false},
+	}
+	for _, tt := range tests {
+		s, cleanup := newTestServer(t)
+		s.c.Update.DryRun = tt.dryRun
+		user := &User{ID: "u1"}
+		s.userList[user.ID] = user
+		s.userListChanged = false
+		now := time.Now()
+		pending := map[string]time.Time{user.ID: now}
+		if !s.scheduleDue(logrus.NewEntry(logrus.StandardLogger()), user, now, pending) {
+			t.Errorf("%s: update outside of the default schedule", tt.name)
+		}
+		if _, ok := pending[user.ID]; ok {
+			t.Errorf("%s: user left pending", tt.name)
+		}
+		if changed := user.ScheduledAt != nil; changed != tt.wantChanged {
+			t.Errorf("%s: ScheduledAt set %v, want %v", tt.name, changed, tt.wantChanged)
+		}
+		if s.userListChanged != tt.wantChanged {
+			t.Errorf("%s: userListChanged %v, want %v", tt.name, s.userListChanged, tt.wantChanged)
+		}
+		cleanup()
+	}
+}
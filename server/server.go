@@ -1,24 +1,25 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/artkescha/hh-updater/crypto"
 	"net/http"
 	"regexp"
+	"sync"
 	"time"
 
 	"github.com/artkescha/hh-updater/config"
 	"github.com/artkescha/hh-updater/hhclient"
+	"github.com/artkescha/hh-updater/logging"
+	"github.com/artkescha/hh-updater/schedule"
 	"github.com/boltdb/bolt"
-	"github.com/gorilla/context"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
 )
 
-const UserCtxKey = "ctxUser"
-
 // Endpoint is HH's OAuth 2.0 endpoint.
 var Endpoint = oauth2.Endpoint{
 	AuthURL:  "https://hh.ru/oauth/authorize",
@@ -34,11 +35,41 @@ var (
 )
 
 type Server struct {
-	c               *config.Config
+	// c is replaced on reload, use conf to read it.
+	c      *config.Config
+	confMu sync.RWMutex
+	mu     sync.RWMutex
+	// userList and userListChanged are guarded by mu, as well as the
+	// fields of the users stored in the list.
 	userList        map[string]*User
 	userListChanged bool
 	oAuthConf       *oauth2.Config
 	db              *bolt.DB
+	refresher       *TokenRefresher
+	mutators        map[string]ResumeMutator
+	defaultMutator  string
+	notifiers       []Notifier
+	telegram        *TelegramBot
+	// webhookWake wakes the webhook loop when events are queued.
+	webhookWake chan struct{}
+	// emails queues the alerts for the email loop.
+	emails chan *queuedEmail
+
+	// ctx is cancelled by Stop to make the background loops exit, wg
+	// tracks them.
+	ctx           context.Context
+	cancel        context.CancelFunc
+	wg            sync.WaitGroup
+	httpServer    *http.Server
+	metricsServer *http.Server
+	// redirectServer redirects plain HTTP to https when TLS is served.
+	redirectServer *http.Server
+	metrics        *serverMetrics
+	health         *health
+	limiter        *rateLimiter
+	jobs           *jobs
+	// hhTransport replaces the transport of the hh clients if set.
+	hhTransport http.RoundTripper
 }
 
 type User struct {
@@ -47,14 +78,82 @@ type User struct {
 	Token       *oauth2.Token `json:"token"`
 	UpdatedAt   time.Time     `json:"updated_at"`
 	UpdateCount int           `json:"update_count"`
+	// Disabled users are neither updated nor have their tokens refreshed.
+	Disabled bool   `json:"disabled,omitempty"`
+	Mutator  string `json:"mutator,omitempty"`
+	// Resumes holds per resume settings and state keyed by resume ID.
+	Resumes       map[string]*ResumeState `json:"resumes,omitempty"`
+	Notifications []*Event                `json:"notifications,omitempty"`
+	// Schedule overrides the default schedule of the config.
+	Schedule *schedule.Spec `json:"schedule,omitempty"`
+	// ScheduledAt is the time the update loop last ran the update of the
+	// user.
+	ScheduledAt *time.Time `json:"scheduled_at,omitempty"`
+	// TokenExpiredAt is set when hh rejected the refresh token; it is
+	// cleared when the user logs in again.
+	TokenExpiredAt *time.Time `json:"token_expired_at,omitempty"`
+	// Language of the emails, the default of the config if empty.
+	Language           string `json:"language,omitempty"`
+	UnsubscribedAlerts bool   `json:"unsubscribed_alerts,omitempty"`
+	UnsubscribedDigest bool   `json:"unsubscribed_digest,omitempty"`
+	// Digest collects the weekly digest, LastDigestAt is when the last one
+	// was sent.
+	Digest       *Digest    `json:"digest,omitempty"`
+	LastDigestAt *time.Time `json:"last_digest_at,omitempty"`
+	// InvitationsCheckedAt is the update time of the latest negotiation
+	// seen.
+	InvitationsCheckedAt *time.Time `json:"invitations_checked_at,omitempty"`
+	// TelegramChatID is the chat linked to the user, zero if none.
+	TelegramChatID int64 `json:"telegram_chat_id,omitempty"`
+	// Pause stops the updates, the token is still refreshed.
+	Pause *Pause `json:"pause,omitempty"`
+	// LastError is the error of the last update of the user, if it failed.
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	// SessionEpoch is stored in the cookies; incrementing it revokes the
+	// cookies issued before.
+	SessionEpoch int `json:"session_epoch,omitempty"`
+}
+
+type ResumeState struct {
+	Mutator        string        `json:"mutator,omitempty"`
+	AppliedMutator string        `json:"applied_mutator,omitempty"`
+	LastChanges    []FieldChange `json:"last_changes,omitempty"`
+	// Original is captured when a mutator is applied to the resume and
+	// dropped once the resume is restored.
+	Original *ResumeOriginal `json:"original,omitempty"`
+	// TitleVariants replace the variants of the title mutator for the
+	// resume.
+	TitleVariants []string        `json:"title_variants,omitempty"`
+	Template      *ResumeTemplate `json:"template,omitempty"`
+	// NeedsReview stops edits of the resume until the user clears it.
+	NeedsReview      bool                 `json:"needs_review,omitempty"`
+	ReviewReason     string               `json:"review_reason,omitempty"`
+	LastVerification *Verification        `json:"last_verification,omitempty"`
+	LastPublish      *PublishVerification `json:"last_publish,omitempty"`
+	// Conflicts counts the edits aborted because the resume was modified on
+	// hh between reading and writing it.
+	Conflicts      int            `json:"conflicts,omitempty"`
+	LastConflictAt time.Time      `json:"last_conflict_at,omitempty"`
+	LastOutcome    *ResumeOutcome `json:"last_outcome,omitempty"`
+	Moderation     *Moderation    `json:"moderation,omitempty"`
+	Pause          *Pause         `json:"pause,omitempty"`
+	// Failures counts the failed updates in a row.
+	Failures int `json:"failures,omitempty"`
 }
 
 type SafeUser struct {
-	ID string `json:"id"`
+	ID    string `json:"id"`
+	Epoch int    `json:"epoch,omitempty"`
+	// Purpose is sessionPurpose in the session cookie; Auth refuses
+	// anything else encrypted with the cookie cipher.
+	Purpose string `json:"purpose"`
 }
 
+const sessionPurpose = "session"
+
 func NewServer(config *config.Config) *Server {
-	return &Server{
+	s := &Server{
 		c:        config,
 		userList: map[string]*User{},
 		oAuthConf: &oauth2.Config{
@@ -64,21 +163,36 @@ func NewServer(config *config.Config) *Server {
 			RedirectURL:  config.RedirectURL,
 		},
 	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.httpServer = &http.Server{Addr: config.ListenAddress}
+	s.metrics = newServerMetrics(s)
+	s.health = newHealth()
+	s.limiter = newRateLimiter()
+	s.jobs = newJobs()
+	if len(config.MetricsListenAddress) != 0 {
+		s.metricsServer = &http.Server{Addr: config.MetricsListenAddress}
+	}
+	s.telegram = newTelegramBot(s)
+	s.webhookWake = make(chan struct{}, 1)
+	s.emails = make(chan *queuedEmail, emailQueueSize)
+	s.notifiers = []Notifier{&EmailNotifier{s: s}, s.telegram, &WebhookNotifier{s: s}}
+	s.refresher = NewTokenRefresher(s, config.TokenRefreshAhead, config.TokenRefreshJitter)
+	return s
 }
 
 func (s *Server) Init() error {
-	db, err := bolt.Open(s.c.DatabasePath, 0600, nil)
+	if err := s.initMutators(); err != nil {
+		return err
+	}
+	db, err := bolt.Open(s.conf().DatabasePath, 0600, dbOptions)
 	if err != nil {
 		return err
 	}
 	s.db = db
-	return s.db.Update(func(tx *bolt.Tx) error {
-		// Always create Users bucket.
-		if _, err := tx.CreateBucketIfNotExists(UsersBucket); err != nil {
-			return err
-		}
-		return nil
-	})
+	if _, _, err := s.Migrate(); err != nil {
+		return err
+	}
+	return s.initTLS()
 }
 
 func (u *User) SafeMail() string {
@@ -87,29 +201,50 @@ func (u *User) SafeMail() string {
 
 func (u *User) ToSafeUser() *User {
 	return &User{
-		ID:          u.ID,
-		Email:       u.SafeMail(),
-		Token:       nil,
-		UpdatedAt:   u.UpdatedAt,
-		UpdateCount: u.UpdateCount,
+		ID:            u.ID,
+		Email:         u.SafeMail(),
+		Token:         nil,
+		UpdatedAt:     u.UpdatedAt,
+		UpdateCount:   u.UpdateCount,
+		Mutator:       u.Mutator,
+		Resumes:       u.Resumes,
+		Notifications: u.Notifications,
+		Pause:         u.Pause,
+		Schedule:      u.Schedule,
+		// The UI asks the user to log in again.
+		TokenExpiredAt: u.TokenExpiredAt,
 	}
 }
 
+// resumeState returns the state of the resume, creating it if needed. The
+// caller must hold s.mu for writing.
+func (u *User) resumeState(resumeID string) *ResumeState {
+	if u.Resumes == nil {
+		u.Resumes = map[string]*ResumeState{}
+	}
+	state, ok := u.Resumes[resumeID]
+	if !ok {
+		state = &ResumeState{}
+		u.Resumes[resumeID] = state
+	}
+	return state
+}
+
 func (s *Server) AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
-	url := s.oAuthConf.AuthCodeURL(s.c.StateString)
+	url := s.oAuthConf.AuthCodeURL(s.conf().StateString)
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
 func (s *Server) userHandler(w http.ResponseWriter, r *http.Request) (*User, error) {
 	q := r.URL.Query()
-	if q.Get("state") != s.c.StateString {
+	if q.Get("state") != s.conf().StateString {
 		return nil, errors.New("Invalid oAuth2 state")
 	}
 	token, err := s.oAuthConf.Exchange(oauth2.NoContext, q.Get("code"))
 	if err != nil {
 		return nil, err
 	}
-	client := hhclient.NewClient(token)
+	client := s.newClient(token)
 	me, err := client.Me.GetMe()
 	if err != nil {
 		return nil, err
@@ -125,90 +260,347 @@ func (s *Server) userHandler(w http.ResponseWriter, r *http.Request) (*User, err
 func (s *Server) CallbackHandler(w http.ResponseWriter, r *http.Request) {
 	user, err := s.userHandler(w, r)
 	if err != nil {
-		logrus.Error(err)
+		requestLog(r).Error(err)
 		http.Redirect(w, r, "/error.html", http.StatusFound)
 		return
 	}
-	if _, ok := s.userList[user.ID]; !ok {
+	s.mu.Lock()
+	if existing, ok := s.userList[user.ID]; !ok {
 		s.userListChanged = true
 		s.userList[user.ID] = user
-		logrus.Infof("User %s added", user.Email)
+		logrus.WithField(logging.FieldUserID, user.ID).Info("User added")
+	} else if existing.TokenExpiredAt != nil {
+		// Logging in is the only way to get a working token back.
+		existing.Token = user.Token
+		existing.TokenExpiredAt = nil
+		s.userListChanged = true
+		logrus.WithField(logging.FieldUserID, user.ID).Info("User logged in again, token replaced")
 	} else {
-		logrus.Debugf("User %s logged", user.Email)
+		logrus.WithField(logging.FieldUserID, user.ID).Debug("User logged")
 	}
-	encodedCookie, err := s.Encrypt(user.ToSafeUser())
+	s.mu.Unlock()
+	s.mu.RLock()
+	safeUser := &SafeUser{ID: user.ID, Epoch: user.SessionEpoch, Purpose: sessionPurpose}
+	s.mu.RUnlock()
+	encodedCookie, err := s.Encrypt(safeUser)
 	if err != nil {
-		logrus.Error(err)
+		requestLog(r).Error(err)
 		http.Redirect(w, r, "/error.html", http.StatusFound)
 		return
 	}
 	http.SetCookie(w, &http.Cookie{
-		Name:    s.c.CookieName,
+		Name:    s.conf().CookieName,
 		Value:   encodedCookie,
 		Path:    "/",
-		Domain:  s.c.CookieHostname,
+		Domain:  s.conf().CookieHostname,
 		Expires: time.Now().AddDate(1, 0, 0),
-		Secure:  s.c.CookieSecure,
+		Secure:  s.conf().CookieSecure,
 		// Disallow access from JavaScript
 		HttpOnly: true,
+		// Not sent with the requests of other sites, except following a
+		// link, so they can not act on behalf of the user.
+		SameSite: http.SameSiteLaxMode,
 	})
 	http.Redirect(w, r, "/logged.html", http.StatusFound)
 }
 
-func (s *Server) upAndPublishUserResumes(user *User) (int, error) {
-	var updateCount int
-	client := hhclient.NewClient(user.Token)
+// upAndPublishUserResumes publishes and edits every resume of the user. A
+// failure of one resume is reported in its outcome and does not stop the
+// others; an error is returned only if the resume list can not be obtained.
+func (s *Server) upAndPublishUserResumes(log *logrus.Entry, user *User) ([]*ResumeOutcome, error) {
+	s.mu.RLock()
+	client := s.newClient(user.Token)
+	s.mu.RUnlock()
 	if _, err := client.Me.GetMe(); err != nil {
-		return 0, fmt.Errorf("Error getting information of user %s: %v", user.Email, err)
+		return nil, fmt.Errorf("Error getting information of user %s: %v", user.ID, err)
 	}
-	logrus.Debugf("Getting resumes for user: %s", user.Email)
+	log.Debug("Getting resumes")
 	resumeList, err := client.Resume.ResumeMine()
 	if err != nil {
-		return 0, fmt.Errorf("Error getting resume for user %s: %v", user.Email, err)
+		return nil, fmt.Errorf("Error getting resume for user %s: %v", user.ID, err)
 	}
 	if len(resumeList) == 0 {
-		return 0, ErrEmptyResumeList
+		return nil, ErrEmptyResumeList
 	}
+	// A dry run leaves the user state alone and sends no notifications.
+	dryRun := s.dryRun()
+	outcomes := make([]*ResumeOutcome, 0, len(resumeList))
 	for _, r := range resumeList {
-		logrus.Debugf("Requesting resume status: '%s'", r.Title)
-		status, err := client.Resume.ResumesStatus(r)
-		if err != nil {
-			return 0, fmt.Errorf("Error getting resume status '%s': %v", r.Title, err)
+		if s.stopping() {
+			break
 		}
-		if !status.CanPublishOrUpdate {
-			logrus.Debugf("Skipping publish resume: '%s'", r.Title)
-			continue
+		if !dryRun {
+			s.recordViews(user, r)
 		}
-		if err := client.Resume.ResumePublish(r); err != nil {
-			return 0, fmt.Errorf("error publishing resume '%s': %s", r.Title, err)
+		if s.resumePaused(user, r.ID, time.Now()) {
+			continue
 		}
-		if err := s.updateResume(client, r.ID, upExperience); err != nil {
-			logrus.Errorf("error update resume '%s': fail %s", r.Title, err)
+		outcome := s.upAndPublishResume(log.WithField(logging.FieldResumeID, r.ID), client, user, r)
+		if !dryRun {
+			s.recordOutcome(user, outcome)
 		}
-		updateCount++
-		logrus.Infof("Resume updated: '%s'", r.Title)
+		outcomes = append(outcomes, outcome)
+	}
+	if !dryRun {
+		s.checkInvitations(log, client, user)
 	}
-	return updateCount, nil
+	return outcomes, nil
 }
 
-func (s *Server) updateResume(client *hhclient.Client, resumeId string,
-	upFunc func(companies []hhclient.Company, prefix string)) error {
-	if len(s.c.ExperienceDescSuffix) == 0 {
-		return nil
+func (s *Server) upAndPublishResume(log *logrus.Entry, client *hhclient.Client, user *User, r *hhclient.Resume) *ResumeOutcome {
+	outcome := &ResumeOutcome{ResumeID: r.ID, Title: r.Title, At: time.Now().UTC()}
+	log.Debugf("Requesting resume status: '%s'", r.Title)
+	status, err := client.Resume.ResumesStatus(r)
+	if err != nil {
+		log.Errorf("Error getting resume status '%s': %v", r.Title, err)
+		return outcome.fail(fmt.Errorf("getting resume status: %v", err))
+	}
+	if s.checkModeration(user, r, status) {
+		log.Debugf("Skipping blocked resume: '%s'", r.Title)
+		outcome.Status = OutcomeSkippedBlocked
+		return outcome
+	}
+	if !status.CanPublishOrUpdate {
+		log.Debugf("Skipping publish resume: '%s'", r.Title)
+		outcome.Status = OutcomeSkippedNotAllowed
+		return outcome
 	}
-	resume, err := client.Resume.ReadResume(resumeId)
+	if s.dryRun() {
+		log.Infof("[dry-run] Would publish resume '%s'", r.Title)
+		outcome.Status = OutcomePlanned
+		changes, err := s.updateResume(log, client, user, r.ID)
+		if err != nil {
+			outcome.Error = fmt.Sprintf("planning edit: %v", err)
+		}
+		outcome.Changes = changes
+		return outcome
+	}
+	if err := client.Resume.ResumePublish(r); err != nil {
+		log.Errorf("error publishing resume '%s': %s", r.Title, err)
+		return outcome.fail(fmt.Errorf("publishing resume: %v", err))
+	}
+	outcome.Status = OutcomePublished
+	if v, err := s.verifyPublish(client, r); err != nil {
+		log.Errorf("error verifying publish of resume '%s': %s", r.Title, err)
+	} else {
+		if !v.Confirmed {
+			log.Warnf("Publish of resume '%s' is not confirmed by hh", r.Title)
+		}
+		s.recordPublishVerification(user, r.ID, v)
+	}
+	changes, err := s.updateResume(log, client, user, r.ID)
 	if err != nil {
-		return fmt.Errorf("error read resume fail %s", err)
+		log.Errorf("error update resume '%s': fail %s", r.Title, err)
+		outcome.Error = fmt.Sprintf("editing resume: %v", err)
+	}
+	if len(changes) != 0 {
+		outcome.Status = OutcomeEdited
+		outcome.Changes = changes
+	}
+	log.Infof("Resume updated: '%s'", r.Title)
+	return outcome
+}
+
+// updateResume edits the resume with the mutator selected for it and returns
+// the changes made. If another mutator was applied last time, its edit is
+// reverted first. In dry run mode the changes are only logged.
+func (s *Server) updateResume(log *logrus.Entry, client *hhclient.Client, user *User, resumeId string) ([]FieldChange, error) {
+	s.mu.RLock()
+	mutator := s.mutatorFor(user, resumeId)
+	var applied string
+	var rt *ResumeTemplate
+	var needsReview bool
+	var original ResumeOriginal
+	var titleVariants []string
+	if state, ok := user.Resumes[resumeId]; ok {
+		applied = state.AppliedMutator
+		rt = state.Template
+		needsReview = state.NeedsReview
+		if state.Original != nil {
+			original = *state.Original
+		}
+		titleVariants = state.TitleVariants
+	}
+	updateCount := user.UpdateCount
+	s.mu.RUnlock()
+	if needsReview {
+		log.Debug("Skipping edit of resume waiting for review")
+		return nil, nil
+	}
+	if rt != nil {
+		// A description template takes precedence over the other mutators.
+		tm, err := newTemplateMutator(rt, updateCount, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("error parsing template fail %s", err)
+		}
+		mutator = tm
+	}
+	if mutator == nil && len(applied) == 0 {
+		return nil, nil
+	}
+	if mutator != nil {
+		mutator = bindMutator(mutator, &original, titleVariants)
+	}
+	originalBefore := original
+	appliedBefore := applied
+	var resume *hhclient.Resume
+	var changes []FieldChange
+	for attempt := 1; ; attempt++ {
+		var err error
+		resume, err = client.Resume.ReadResume(resumeId)
+		if err != nil {
+			return nil, fmt.Errorf("error read resume fail %s", err)
+		}
+		original = originalBefore
+		changes, applied, err = s.mutateResume(resume, appliedBefore, mutator, &original, titleVariants)
+		if err != nil {
+			return nil, err
+		}
+		if len(changes) == 0 {
+			return nil, nil
+		}
+		if s.dryRun() {
+			for _, change := range changes {
+				log.Infof("[dry-run] Field %s would change: %q -> %q", change.Field, change.Old, change.New)
+			}
+			return changes, nil
+		}
+		// The user may have edited the resume on hh.ru since it was read.
+		conflict, err := checkConflict(client, resume)
+		if err != nil {
+			return nil, fmt.Errorf("error checking resume conflict fail %s", err)
+		}
+		if !conflict {
+			break
+		}
+		s.recordConflict(user, resumeId)
+		if attempt >= maxEditAttempts {
+			return nil, ErrResumeConflict
+		}
+		log.Info("Resume changed on hh while preparing the edit, retrying")
+	}
+	if err := s.saveSnapshot(&Snapshot{
+		ResumeID:       resumeId,
+		UserID:         user.ID,
+		CreatedAt:      time.Now().UTC(),
+		Reason:         SnapshotReasonEdit,
+		AppliedMutator: appliedBefore,
+		Changes:        changes,
+		Resume:         resume.Raw,
+	}); err != nil {
+		return nil, fmt.Errorf("error saving snapshot fail %s", err)
 	}
-	upFunc(resume.Experience, s.c.ExperienceDescSuffix)
 
 	if err := client.Resume.EditResume(resume); err != nil {
-		return fmt.Errorf("error editing resume fail %s", err)
+		return nil, fmt.Errorf("error editing resume fail %s", err)
+	}
+	for _, change := range changes {
+		log.Debugf("Field %s changed: %q -> %q", change.Field, change.Old, change.New)
+	}
+	v, verifyErr := s.verifyEdit(client, resumeId, resume.Raw, changes)
+	s.mu.Lock()
+	state := user.resumeState(resumeId)
+	if v == nil || !v.RolledBack {
+		state.AppliedMutator = applied
+		state.LastChanges = changes
+		state.Original = nil
+		if len(applied) != 0 {
+			state.Original = &original
+		}
+	}
+	s.userListChanged = true
+	s.mu.Unlock()
+	if v != nil {
+		s.recordVerification(user, resumeId, v)
+		for _, change := range v.Mismatches {
+			log.Warnf("Field %s stored as %q instead of %q", change.Field, change.New, change.Old)
+		}
+		if len(v.Unexpected) != 0 {
+			log.Errorf("%d unexpected fields changed, rolled back: %v", len(v.Unexpected), v.RolledBack)
+		}
+	}
+	if verifyErr != nil {
+		return changes, fmt.Errorf("error verifying resume fail %s", verifyErr)
+	}
+	if v.RolledBack {
+		return nil, ErrEditRolledBack
+	}
+	return changes, nil
+}
+
+// mutateResume reverts the previously applied mutator if it is not the one
+// to apply now and applies the new one. The mutators must be bound to
+// original, which is captured from the resume if it is empty. It returns
+// the changes and the name of the mutator applied to the resume.
+func (s *Server) mutateResume(resume *hhclient.Resume, applied string, mutator ResumeMutator, original *ResumeOriginal, titleVariants []string) ([]FieldChange, string, error) {
+	if !original.captured() {
+		original.capture(resume)
+	}
+	var changes []FieldChange
+	if previous, ok := s.mutator(applied); ok && (mutator == nil || previous.Name() != mutator.Name()) {
+		reverted, err := bindMutator(previous, original, titleVariants).Revert(resume)
+		if err != nil {
+			return nil, applied, fmt.Errorf("error reverting mutator %s fail %s", applied, err)
+		}
+		changes = append(changes, reverted...)
+		applied = ""
+	}
+	if mutator != nil {
+		mutated, err := mutator.Mutate(resume)
+		if err != nil {
+			return nil, applied, fmt.Errorf("error applying mutator %s fail %s", mutator.Name(), err)
+		}
+		changes = append(changes, mutated...)
+		applied = mutator.Name()
+	}
+	return changes, applied, nil
+}
+
+// MutatorHandler lists the available mutators on GET and selects one for the
+// user, or for a single resume if resume_id is given, on POST. An empty
+// mutator resets the selection to the default one.
+func (s *Server) MutatorHandler(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromContext(r)
+	if user == nil {
+		http.Error(w, "Empty user data", http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodPost {
+		name := r.FormValue("mutator")
+		if _, ok := s.mutator(name); len(name) != 0 && name != MutatorNone && !ok {
+			http.Error(w, fmt.Sprintf("Unknown mutator %s", name), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		if resumeID := r.FormValue("resume_id"); len(resumeID) != 0 {
+			state := user.resumeState(resumeID)
+			state.Mutator = name
+			if _, ok := r.Form["title_variants"]; ok {
+				state.TitleVariants = splitLines(r.FormValue("title_variants"))
+			}
+		} else {
+			user.Mutator = name
+		}
+		s.userListChanged = true
+		s.mu.Unlock()
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	resp := struct {
+		Available []string                `json:"available"`
+		Default   string                  `json:"default"`
+		Mutator   string                  `json:"mutator"`
+		Resumes   map[string]*ResumeState `json:"resumes"`
+	}{s.mutatorNames(), s.defaultMutator, user.Mutator, user.Resumes}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, fmt.Sprintf("Cannot encode response data: %v", err), http.StatusInternalServerError)
+		return
 	}
-	return nil
 }
 
 func (s *Server) RestoreUserList() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(UsersBucket)
 		v := b.Get(UsersKey)
@@ -224,33 +616,112 @@ func (s *Server) RestoreUserList() error {
 }
 
 func (s *Server) SaveUserList() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.saveUserListLocked()
+}
+
+// saveUserListLocked writes the user list to the database. The caller must
+// hold s.mu.
+func (s *Server) saveUserListLocked() error {
 	return s.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(UsersBucket)
 		encoded, err := json.Marshal(s.userList)
 		if err != nil {
 			return err
 		}
-		return b.Put(UsersKey, encoded)
+		if err := b.Put(UsersKey, encoded); err != nil {
+			return err
+		}
+		s.metrics.persisted()
+		return nil
 	})
 }
 
-func (s *Server) Stop() error {
-	return s.SaveUserList()
+// Stop drains the HTTP server, lets the background loops finish the resume
+// they are processing and writes the user list. It gives up when ctx is done.
+func (s *Server) Stop(ctx context.Context) error {
+	s.cancel()
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		logrus.Errorf("Error shutting down HTTP server: %v", err)
+	}
+	if s.metricsServer != nil {
+		if err := s.metricsServer.Shutdown(ctx); err != nil {
+			logrus.Errorf("Error shutting down metrics server: %v", err)
+		}
+	}
+	if s.redirectServer != nil {
+		if err := s.redirectServer.Shutdown(ctx); err != nil {
+			logrus.Errorf("Error shutting down HTTP redirect server: %v", err)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logrus.Warn("Background loops did not finish in time")
+	}
+	if err := s.SaveUserList(); err != nil {
+		return err
+	}
+	return s.db.Close()
+}
+
+// sleep waits for d and reports false if the server is stopping.
+func (s *Server) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-s.ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (s *Server) stopping() bool {
+	return s.ctx.Err() != nil
+}
+
+// goTask runs a one-off task in a goroutine tracked by Stop.
+func (s *Server) goTask(task func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		task()
+	}()
+}
+
+// goLoop runs the loop in a goroutine tracked by Stop and by the health
+// checks under the given name.
+func (s *Server) goLoop(name string, loop func()) {
+	s.wg.Add(1)
+	s.health.loopStarted(name)
+	go func() {
+		defer s.wg.Done()
+		defer s.health.loopExited(name)
+		loop()
+	}()
 }
 
 func (s *Server) Encrypt(body interface{}) (string, error) {
-	return crypto.EncryptObj(body, s.c.CookieEncryptionCipher)
+	return crypto.EncryptObj(body, s.conf().CookieEncryptionCipher)
 }
 
 func (s *Server) Decrypt(encrypted string, body interface{}) error {
-	return crypto.DecryptObj(encrypted, s.c.CookieEncryptionCipher, body)
+	return crypto.DecryptObj(encrypted, s.conf().CookieEncryptionCipher, body)
 }
 
 func (s *Server) LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	http.SetCookie(w, &http.Cookie{
-		Name:   s.c.CookieName,
-		Domain: s.c.CookieHostname,
-		MaxAge: 0,
+		Name:     s.conf().CookieName,
+		Domain:   s.conf().CookieHostname,
+		MaxAge:   0,
+		SameSite: http.SameSiteLaxMode,
 	})
 	http.Redirect(w, r, "/", http.StatusFound)
 }
@@ -261,8 +732,8 @@ func (s *Server) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Empty user data", http.StatusInternalServerError)
 		return
 	}
-	delete(s.userList, user.ID)
-	logrus.Infof("User %s deleted", user.Email)
+	s.DeleteUser(user)
+	logrus.WithField(logging.FieldUserID, user.ID).Info("User deleted")
 }
 
 func (s *Server) MeHandler(w http.ResponseWriter, r *http.Request) {
@@ -271,6 +742,8 @@ func (s *Server) MeHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Empty user data", http.StatusInternalServerError)
 		return
 	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	encoder := json.NewEncoder(w)
 	if err := encoder.Encode(user.ToSafeUser()); err != nil {
 		http.Error(w, fmt.Sprintf("Cannot encode response data: %v", err), http.StatusInternalServerError)
@@ -279,87 +752,227 @@ func (s *Server) MeHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetUserFromContext(r *http.Request) *User {
-	if value := context.Get(r, UserCtxKey); value != nil {
-		return value.(*User)
-	}
-	return nil
+	user, _ := r.Context().Value(userCtxKey).(*User)
+	return user
 }
 
-func SetUserToContext(r *http.Request, user *User) {
-	context.Set(r, UserCtxKey, user)
+// SetUserToContext returns a copy of the request carrying the user.
+func SetUserToContext(r *http.Request, user *User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userCtxKey, user))
 }
 
 func (s *Server) Auth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie(s.c.CookieName)
+		cookie, err := r.Cookie(s.conf().CookieName)
 		if err != nil || len(cookie.Value) == 0 {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 		var safeUser *SafeUser
-		if err := s.Decrypt(cookie.Value, &safeUser); err != nil {
+		if err := s.Decrypt(cookie.Value, &safeUser); err != nil || safeUser == nil || safeUser.Purpose != sessionPurpose {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-		user, ok := s.userList[safeUser.ID]
-		if !ok {
+		user, ok := s.getUser(safeUser.ID)
+		if !ok || safeUser.Epoch != s.sessionEpoch(user) {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-		SetUserToContext(r, user)
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, SetUserToContext(r, user))
+	}
+}
+
+// users returns a snapshot of the user list which may be iterated without
+// holding s.mu.
+func (s *Server) users() []*User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]*User, 0, len(s.userList))
+	for _, user := range s.userList {
+		users = append(users, user)
+	}
+	return users
+}
+
+func (s *Server) getUser(id string) (*User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.userList[id]
+	return user, ok
+}
+
+// dryRun reports whether the updates are only planned. The tokens are still
+// refreshed, since hh does not let the resumes be read otherwise.
+func (s *Server) dryRun() bool {
+	return s.conf().Update.DryRun
+}
+
+// replaceToken replaces the user token and writes the user list within the
+// same critical section, so a rotated refresh token is on disk before the
+// previous one is dropped from memory. The token is not stored if the user
+// token is no longer old, e.g. the user has logged in again meanwhile; the
+// result reports whether it was stored.
+func (s *Server) replaceToken(user *User, old, token *oauth2.Token) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user.Token != old && (user.Token == nil || old == nil || user.Token.RefreshToken != old.RefreshToken) {
+		return false, nil
+	}
+	user.Token = token
+	if err := s.saveUserListLocked(); err != nil {
+		// Keep the new token anyway: hh has already invalidated the old
+		// one. DumpLoop will retry the write.
+		s.userListChanged = true
+		return true, err
+	}
+	return true, nil
+}
+
+func (s *Server) userToken(user *User) *oauth2.Token {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return user.Token
+}
+
+// updateUser runs an update of a single user: refreshes the token if
+// needed, publishes and edits the resumes and credits the user with the
+// published ones.
+func (s *Server) updateUser(log *logrus.Entry, user *User) (outcomes []*ResumeOutcome, err error) {
+	if !s.claimUser(user) {
+		return nil, ErrUpdateInProgress
+	}
+	defer func() {
+		s.releaseUser(user, outcomes, err)
+	}()
+	defer func() {
+		if !s.dryRun() {
+			s.recordUserError(user, err)
+		}
+	}()
+	log = log.WithField(logging.FieldUserID, user.ID)
+	log.Debug("Getting information of user")
+	s.mu.RLock()
+	valid := user.Token.Valid()
+	s.mu.RUnlock()
+	if !valid {
+		if err := s.refresher.Refresh(user); err != nil {
+			return nil, fmt.Errorf("Error getting token for user %s: %v", user.ID, err)
+		}
+	}
+	outcomes, err = s.upAndPublishUserResumes(log, user)
+	if err != nil {
+		if err == ErrEmptyResumeList && !s.dryRun() {
+			log.Info("Deleting user with empty resume list")
+			s.DeleteUser(user)
+		}
+		return nil, err
+	}
+	updates := publishedCount(outcomes)
+	if updates == 0 {
+		// Skipping user update if nothing changed
+		return outcomes, nil
 	}
+	s.mu.Lock()
+	user.UpdateCount = user.UpdateCount + updates
+	user.UpdatedAt = time.Now().UTC()
+	s.userListChanged = true
+	s.mu.Unlock()
+	return outcomes, nil
 }
 
+// UpdateLoop runs an update cycle over all the users every update interval.
+// Between the cycles it wakes up when the schedule of a user skipped by the
+// last cycle opens, so the user is updated at the first eligible moment.
 func (s *Server) UpdateLoop() {
+	var cycleAt time.Time
+	// pending holds the users waiting for their schedule, by the time it
+	// opens.
+	pending := map[string]time.Time{}
 	for {
-		for _, user := range s.userList {
-			logrus.Debugf("Getting information of user: %s", user.Email)
-			tokenSource := s.oAuthConf.TokenSource(oauth2.NoContext, user.Token)
-			newToken, err := tokenSource.Token()
-			if err != nil {
-				logrus.Errorf("Error getting token for user %s: %v", user.Email, err)
-				continue
-			}
-			if user.Token.AccessToken != newToken.AccessToken {
-				logrus.Infof("Updating token for user %s", user.Email)
-				user.Token = newToken
-				s.userListChanged = true
-				logrus.Infof("New expiry date for user %s token: %s", user.Email, user.Token.Expiry.String())
-			}
-			updates, err := s.upAndPublishUserResumes(user)
-			if err != nil {
-				if err == ErrEmptyResumeList {
-					logrus.Infof("Deleting user with empty resume list: %s", user.Email)
-					delete(s.userList, user.ID)
-					s.userListChanged = true
+		s.health.beat(LoopUpdate)
+		now := time.Now()
+		full := !now.Before(cycleAt)
+		var users []*User
+		if full {
+			users = s.users()
+			cycleAt = now.Add(s.conf().UpdateInterval)
+		} else {
+			for id, at := range pending {
+				if at.After(now) {
+					continue
+				}
+				delete(pending, id)
+				if user, ok := s.getUser(id); ok {
+					users = append(users, user)
 				}
-				continue
 			}
-			if updates == 0 {
-				// Skipping user update if nothing changed
-				continue
+		}
+		if !s.updateUsers(newCycleLog(), users, pending) {
+			return
+		}
+		if full {
+			s.metrics.cycleDuration.Observe(time.Since(now).Seconds())
+			s.health.cycleFinished()
+		}
+		wake := cycleAt
+		for _, at := range pending {
+			if at.Before(wake) {
+				wake = at
 			}
-			user.UpdateCount = user.UpdateCount + updates
-			user.UpdatedAt = time.Now().UTC()
-			s.userListChanged = true
 		}
-		time.Sleep(s.c.UpdateInterval)
+		if !s.sleep(time.Until(wake)) {
+			return
+		}
 	}
 }
 
+// updateUsers updates the users whose schedule is due and adds the others
+// to pending. It returns false if the server is stopping.
+func (s *Server) updateUsers(log *logrus.Entry, users []*User, pending map[string]time.Time) bool {
+	for _, user := range users {
+		if s.stopping() {
+			return false
+		}
+		// A cycle over many users may take longer than the loop interval.
+		s.health.beat(LoopUpdate)
+		now := time.Now()
+		if s.userDisabled(user) || s.userPaused(user, now) {
+			continue
+		}
+		if !s.scheduleDue(log, user, now, pending) {
+			continue
+		}
+		_, err := s.updateUser(log, user)
+		switch err {
+		case nil, ErrEmptyResumeList:
+		case ErrUpdateInProgress:
+			// The user asked for an update right now.
+			log.WithField(logging.FieldUserID, user.ID).Debug(err)
+		default:
+			log.WithField(logging.FieldUserID, user.ID).Error(err)
+		}
+	}
+	return true
+}
+
 func (s *Server) DumpLoop() {
 	for {
+		s.health.beat(LoopDump)
+		s.mu.Lock()
 		if s.userListChanged {
 			logrus.Debug("Saving to disk...")
-			if err := s.SaveUserList(); err != nil {
+			if err := s.saveUserListLocked(); err != nil {
 				logrus.Errorf("Error saving to disk: %v", err)
 			} else {
 				logrus.Debug("Saved to disk")
 				s.userListChanged = false
 			}
 		}
-		time.Sleep(s.c.DumpInterval)
+		s.mu.Unlock()
+		// The final write is done by Stop.
+		if !s.sleep(s.conf().DumpInterval) {
+			return
+		}
 	}
 }
 
@@ -368,18 +981,73 @@ func (s *Server) Start() error {
 		return err
 	}
 
-	http.HandleFunc("/authorize", s.AuthorizeHandler)
-	http.HandleFunc("/callback", s.CallbackHandler)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/authorize", s.RateLimit(s.AuthorizeHandler))
+	mux.HandleFunc("/callback", s.RateLimit(s.CallbackHandler))
 
-	http.HandleFunc("/logout", s.Auth(http.HandlerFunc(s.LogoutHandler)))
-	http.HandleFunc("/delete", s.Auth(http.HandlerFunc(s.DeleteHandler)))
-	http.HandleFunc("/me", s.Auth(http.HandlerFunc(s.MeHandler)))
+	mux.HandleFunc("/logout", s.Auth(http.HandlerFunc(s.LogoutHandler)))
+	mux.HandleFunc("/delete", s.Auth(http.HandlerFunc(s.DeleteHandler)))
+	mux.HandleFunc("/me", s.Auth(http.HandlerFunc(s.MeHandler)))
+	mux.HandleFunc("/settings/mutator", s.Auth(http.HandlerFunc(s.MutatorHandler)))
+	mux.HandleFunc("/settings/telegram", s.Auth(http.HandlerFunc(s.TelegramHandler)))
+	mux.HandleFunc("/settings/webhooks", s.Auth(http.HandlerFunc(s.WebhooksHandler)))
+	mux.HandleFunc("/settings/webhooks/deliveries", s.Auth(http.HandlerFunc(s.WebhookDeliveriesHandler)))
+	mux.HandleFunc("/settings/email", s.Auth(http.HandlerFunc(s.EmailSettingsHandler)))
+	mux.HandleFunc("/unsubscribe", s.UnsubscribeHandler)
+	mux.HandleFunc("/settings/schedule", s.Auth(http.HandlerFunc(s.ScheduleHandler)))
+	mux.HandleFunc("/settings/pause", s.Auth(http.HandlerFunc(s.PauseHandler)))
+	mux.HandleFunc("/settings/template", s.Auth(http.HandlerFunc(s.TemplateHandler)))
+	mux.HandleFunc("/resumes/versions", s.Auth(http.HandlerFunc(s.VersionsHandler)))
+	mux.HandleFunc("/resumes/diff", s.Auth(http.HandlerFunc(s.DiffHandler)))
+	mux.HandleFunc("/resumes/rollback", s.Auth(http.HandlerFunc(s.RollbackHandler)))
+	mux.HandleFunc("/resumes/review", s.Auth(http.HandlerFunc(s.ReviewHandler)))
+	mux.HandleFunc("/update", s.Auth(http.HandlerFunc(s.UpdateNowHandler)))
+	mux.HandleFunc("/update/job", s.Auth(http.HandlerFunc(s.JobHandler)))
 
-	http.Handle("/", http.FileServer(http.Dir("./public")))
+	mux.HandleFunc("/healthz", s.HealthzHandler)
+	mux.HandleFunc("/readyz", s.ReadyzHandler)
 
-	go s.UpdateLoop()
-	go s.DumpLoop()
+	mux.Handle("/admin", http.RedirectHandler("/admin.html", http.StatusFound))
+	mux.HandleFunc("/admin/status", s.Admin(s.AdminStatusHandler))
+	mux.HandleFunc("/admin/users", s.Admin(s.AdminUsersHandler))
+	mux.HandleFunc("/admin/users/update", s.Admin(s.AdminActionHandler(AuditForceUpdate)))
+	mux.HandleFunc("/admin/users/pause", s.Admin(s.AdminActionHandler(AuditPause)))
+	mux.HandleFunc("/admin/users/resume", s.Admin(s.AdminActionHandler(AuditResume)))
+	mux.HandleFunc("/admin/users/revoke", s.Admin(s.AdminActionHandler(AuditRevoke)))
+	mux.HandleFunc("/admin/users/delete", s.Admin(s.AdminActionHandler(AuditDelete)))
+	mux.HandleFunc("/admin/audit", s.Admin(s.AdminAuditHandler))
+	mux.HandleFunc("/admin/webhooks", s.Admin(s.AdminWebhooksHandler))
+	mux.HandleFunc("/admin/webhooks/deliveries", s.Admin(s.AdminWebhookDeliveriesHandler))
 
-	logrus.Infof("Started running on %s", s.c.ListenAddress)
-	return http.ListenAndServe(s.c.ListenAddress, nil)
+	mux.Handle("/", http.FileServer(http.Dir("./public")))
+
+	if s.metricsServer != nil {
+		s.startMetrics()
+	}
+	if s.redirectServer != nil {
+		s.startRedirect()
+	}
+	s.goLoop(LoopUpdate, s.UpdateLoop)
+	s.goLoop(LoopDump, s.DumpLoop)
+	s.goLoop(LoopRefresher, s.refresher.Run)
+	s.goLoop(LoopDigest, s.DigestLoop)
+	s.goLoop(LoopTelegram, s.telegram.Run)
+	s.goLoop(LoopWebhooks, s.WebhookLoop)
+	s.goLoop(LoopEmail, s.EmailLoop)
+
+	s.httpServer.Handler = chain(mux, RequestID, s.AccessLog, Recover, s.SecurityHeaders)
+
+	var err error
+	if s.httpServer.TLSConfig != nil {
+		logrus.Infof("Started running on %s with TLS", s.conf().ListenAddress)
+		// The certificate is served by TLSConfig.GetCertificate.
+		err = s.httpServer.ListenAndServeTLS("", "")
+	} else {
+		logrus.Infof("Started running on %s", s.conf().ListenAddress)
+		err = s.httpServer.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,405 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/artkescha/hh-updater/hhclient"
+	"github.com/artkescha/hh-updater/logging"
+	"github.com/boltdb/bolt"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultSnapshotLimit = 50
+
+	SnapshotReasonEdit     = "edit"
+	SnapshotReasonRollback = "rollback"
+)
+
+var (
+	ErrSnapshotNotFound = errors.New("Snapshot not found")
+
+	SnapshotsBucket = []byte("snapshotsv1")
+)
+
+// Snapshot is the resume as read from hh right before it was edited. Changes
+// lists what the edit was about to modify.
+type Snapshot struct {
+	Version        uint64          `json:"version"`
+	ResumeID       string          `json:"resume_id"`
+	UserID         string          `json:"user_id"`
+	CreatedAt      time.Time       `json:"created_at"`
+	Reason         string          `json:"reason"`
+	AppliedMutator string          `json:"applied_mutator,omitempty"`
+	Changes        []FieldChange   `json:"changes"`
+	Resume         json.RawMessage `json:"resume,omitempty"`
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// saveSnapshot stores the resume as a new version and drops the versions
+// exceeding the configured limit.
+func (s *Server) saveSnapshot(snapshot *Snapshot) error {
+	limit := s.conf().SnapshotLimit
+	if limit <= 0 {
+		limit = DefaultSnapshotLimit
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(SnapshotsBucket).CreateBucketIfNotExists([]byte(snapshot.ResumeID))
+		if err != nil {
+			return err
+		}
+		version, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		snapshot.Version = version
+		encoded, err := json.Marshal(snapshot)
+		if err != nil {
+			return err
+		}
+		// Stats only counts the committed keys, so it is read before the
+		// Put.
+		count := b.Stats().KeyN + 1
+		if err := b.Put(itob(version), encoded); err != nil {
+			return err
+		}
+		var stale [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && count-len(stale) > limit; k, _ = c.Next() {
+			stale = append(stale, k)
+		}
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// snapshots returns the user versions of the resume, newest first. The
+// resume body is only kept if withBody is set.
+func (s *Server) snapshots(userID, resumeID string, withBody bool) ([]*Snapshot, error) {
+	var list []*Snapshot
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(SnapshotsBucket).Bucket([]byte(resumeID))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var snapshot Snapshot
+			if err := json.Unmarshal(v, &snapshot); err != nil {
+				return err
+			}
+			if snapshot.UserID != userID {
+				continue
+			}
+			if !withBody {
+				snapshot.Resume = nil
+			}
+			list = append(list, &snapshot)
+		}
+		return nil
+	})
+	return list, err
+}
+
+func (s *Server) snapshot(userID, resumeID string, version uint64) (*Snapshot, error) {
+	var snapshot *Snapshot
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(SnapshotsBucket).Bucket([]byte(resumeID))
+		if b == nil {
+			return ErrSnapshotNotFound
+		}
+		v := b.Get(itob(version))
+		if v == nil {
+			return ErrSnapshotNotFound
+		}
+		return json.Unmarshal(v, &snapshot)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.UserID != userID {
+		return nil, ErrSnapshotNotFound
+	}
+	return snapshot, nil
+}
+
+// deleteUserSnapshots removes the stored versions of the user resumes,
+// dropping the buckets of the resumes left without versions.
+func (s *Server) deleteUserSnapshots(userID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(SnapshotsBucket)
+		var empty [][]byte
+		err := root.ForEach(func(resumeID, v []byte) error {
+			b := root.Bucket(resumeID)
+			if b == nil {
+				return nil
+			}
+			var stale [][]byte
+			kept := 0
+			err := b.ForEach(func(k, v []byte) error {
+				var snapshot Snapshot
+				if err := json.Unmarshal(v, &snapshot); err != nil {
+					return err
+				}
+				if snapshot.UserID == userID {
+					stale = append(stale, k)
+				} else {
+					kept++
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if kept == 0 {
+				empty = append(empty, resumeID)
+				return nil
+			}
+			for _, k := range stale {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, resumeID := range empty {
+			if err := root.DeleteBucket(resumeID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// diffResumes compares two raw resumes field by field. Nested fields are
+// named by their JSON path, e.g. "experience.0.description".
+func diffResumes(from, to json.RawMessage) ([]FieldChange, error) {
+	var a, b interface{}
+	if err := json.Unmarshal(from, &a); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(to, &b); err != nil {
+		return nil, err
+	}
+	fa, fb := map[string]string{}, map[string]string{}
+	flatten("", a, fa)
+	flatten("", b, fb)
+	var changes []FieldChange
+	for field, old := range fa {
+		if value, ok := fb[field]; !ok || value != old {
+			changes = append(changes, FieldChange{Field: field, Old: old, New: value})
+		}
+	}
+	for field, value := range fb {
+		if _, ok := fa[field]; !ok {
+			changes = append(changes, FieldChange{Field: field, New: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Field < changes[j].Field
+	})
+	return changes, nil
+}
+
+func flatten(prefix string, v interface{}, out map[string]string) {
+	join := func(key string) string {
+		if len(prefix) == 0 {
+			return key
+		}
+		return prefix + "." + key
+	}
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			flatten(join(key), item, out)
+		}
+	case []interface{}:
+		for idx, item := range value {
+			flatten(join(strconv.Itoa(idx)), item, out)
+		}
+	case nil:
+		out[prefix] = ""
+	case string:
+		out[prefix] = value
+	default:
+		encoded, _ := json.Marshal(value)
+		out[prefix] = string(encoded)
+	}
+}
+
+// rollbackResume writes the snapshot back to hh. The current state is
+// stored as a new version first, so a rollback can be undone as well. The
+// whole resume is written except the fields hh does not allow to edit, which
+// are also left out of the reported changes.
+func (s *Server) rollbackResume(user *User, resumeID string, version uint64) error {
+	snapshot, err := s.snapshot(user.ID, resumeID, version)
+	if err != nil {
+		return err
+	}
+	target, err := hhclient.EditableResume(snapshot.Resume)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	client := s.newClient(user.Token)
+	var applied string
+	if state, ok := user.Resumes[resumeID]; ok {
+		applied = state.AppliedMutator
+	}
+	s.mu.RUnlock()
+	current, err := client.Resume.ReadResume(resumeID)
+	if err != nil {
+		return err
+	}
+	editable, err := hhclient.EditableResume(current.Raw)
+	if err != nil {
+		return err
+	}
+	changes, err := diffResumes(editable, target)
+	if err != nil {
+		return err
+	}
+	if err := s.saveSnapshot(&Snapshot{
+		ResumeID:       resumeID,
+		UserID:         user.ID,
+		CreatedAt:      time.Now().UTC(),
+		Reason:         SnapshotReasonRollback,
+		AppliedMutator: applied,
+		Changes:        changes,
+		Resume:         current.Raw,
+	}); err != nil {
+		return err
+	}
+	if err := client.Resume.EditResumeRaw(resumeID, target); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	state := user.resumeState(resumeID)
+	state.AppliedMutator = snapshot.AppliedMutator
+	state.LastChanges = changes
+	if len(snapshot.AppliedMutator) == 0 {
+		state.Original = nil
+	}
+	s.userListChanged = true
+	s.mu.Unlock()
+	logrus.WithFields(logrus.Fields{logging.FieldUserID: user.ID, logging.FieldResumeID: resumeID}).Infof("Resume rolled back to version %d", version)
+	return nil
+}
+
+// VersionsHandler lists the stored versions of a resume.
+func (s *Server) VersionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromContext(r)
+	if user == nil {
+		http.Error(w, "Empty user data", http.StatusInternalServerError)
+		return
+	}
+	list, err := s.snapshots(user.ID, r.FormValue("resume_id"), false)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Cannot read versions: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		http.Error(w, fmt.Sprintf("Cannot encode response data: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// DiffHandler shows the difference between two versions of a resume. The
+// "to" version may be omitted to compare with the resume currently on hh.
+func (s *Server) DiffHandler(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromContext(r)
+	if user == nil {
+		http.Error(w, "Empty user data", http.StatusInternalServerError)
+		return
+	}
+	resumeID := r.FormValue("resume_id")
+	fromVersion, err := strconv.ParseUint(r.FormValue("from"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid from version", http.StatusBadRequest)
+		return
+	}
+	from, err := s.snapshot(user.ID, resumeID, fromVersion)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	var to json.RawMessage
+	if raw := r.FormValue("to"); len(raw) != 0 {
+		toVersion, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid to version", http.StatusBadRequest)
+			return
+		}
+		snapshot, err := s.snapshot(user.ID, resumeID, toVersion)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		to = snapshot.Resume
+	} else {
+		s.mu.RLock()
+		client := s.newClient(user.Token)
+		s.mu.RUnlock()
+		current, err := client.Resume.ReadResume(resumeID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Cannot read resume: %v", err), http.StatusBadGateway)
+			return
+		}
+		to = current.Raw
+	}
+	changes, err := diffResumes(from.Resume, to)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Cannot compare versions: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(changes); err != nil {
+		http.Error(w, fmt.Sprintf("Cannot encode response data: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// RollbackHandler restores the resume to the given version on hh.
+func (s *Server) RollbackHandler(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromContext(r)
+	if user == nil {
+		http.Error(w, "Empty user data", http.StatusInternalServerError)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	version, err := strconv.ParseUint(r.FormValue("version"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+	if err := s.rollbackResume(user, r.FormValue("resume_id"), version); err != nil {
+		if err == ErrSnapshotNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		logrus.Errorf("Error rolling back resume: %v", err)
+		http.Error(w, fmt.Sprintf("Cannot roll back resume: %v", err), http.StatusBadGateway)
+		return
+	}
+}
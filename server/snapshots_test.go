@@ -0,0 +1,299 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// fakeHH serves the resumes of the hh API from memory and records the
+// edits.
+type fakeHH struct {
+	mu      sync.Mutex
+	resumes map[string]json.RawMessage
+	puts    []json.RawMessage
+	// onPut returns the resume stored by an edit. If nil, the fields of the
+	// edit replace the stored ones and the others are kept, as on hh.
+	onPut  func(id string, body json.RawMessage) json.RawMessage
+	server *httptest.Server
+}
+
+// newFakeHH starts a fake hh and makes the hh clients of s use it.
+func newFakeHH(t *testing.T, s *Server, resumes map[string]string) *fakeHH {
+	f := &fakeHH{resumes: map[string]json.RawMessage{}}
+	for id, body := range resumes {
+		f.resumes[id] = json.RawMessage(body)
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	target, err := url.Parse(f.server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.hhTransport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+		return http.DefaultTransport.RoundTrip(req)
+	})
+	return f
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func (f *fakeHH) serve(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/resumes/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resume, ok := f.resumes[id]
+	if !ok || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(resume)
+	case http.MethodPut:
+		body, _ := ioutil.ReadAll(r.Body)
+		f.puts = append(f.puts, body)
+		if f.onPut != nil {
+			f.resumes[id] = f.onPut(id, body)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		var stored, edit map[string]json.RawMessage
+		if err := json.Unmarshal(resume, &stored); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := json.Unmarshal(body, &edit); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for key, value := range edit {
+			stored[key] = value
+		}
+		f.resumes[id], _ = json.Marshal(stored)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeHH) edits() []json.RawMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]json.RawMessage(nil), f.puts...)
+}
+
+func (f *fakeHH) Close() {
+	f.server.Close()
+}
+
+// jsonEqual reports whether the raw values hold the same JSON.
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatalf("decode %s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatalf("decode %s: %v", b, err)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+func TestDiffResumes(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		want     []FieldChange
+	}{
+		{"same", `{"title":"A","skill_set":["Go"]}`, `{"skill_set":["Go"],"title":"A"}`, nil},
+		{"string", `{"title":"A"}`, `{"title":"B"}`, []FieldChange{{Field: "title", Old: "A", New: "B"}}},
+		{"nested",
+			`{"experience":[{"description":"a"},{"description":"b"}]}`,
+			`{"experience":[{"description":"a"},{"description":"c"}]}`,
+			[]FieldChange{{Field: "experience.1.description", Old: "b", New: "c"}}},
+		{"added and removed",
+			`{"title":"A","skill_set":["Go"]}`,
+			`{"title":"A","skill_set":["Go","SQL"],"area":{"id":"1"}}`,
+			[]FieldChange{{Field: "area.id", New: "1"}, {Field: "skill_set.1", New: "SQL"}}},
+		{"removed", `{"title":"A","salary":null}`, `{"title":"A"}`, []FieldChange{{Field: "salary"}}},
+		{"numbers and booleans",
+			`{"age":30,"relocation":false,"weight":1.5}`,
+			`{"age":31,"relocation":true,"weight":1.5}`,
+			[]FieldChange{{Field: "age", Old: "30", New: "31"}, {Field: "relocation", Old: "false", New: "true"}}},
+	}
+	for _, tt := range tests {
+		got, err := diffResumes(json.RawMessage(tt.from), json.RawMessage(tt.to))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: diffResumes = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+	if _, err := diffResumes(json.RawMessage(`{`), json.RawMessage(`{}`)); err == nil {
+		t.Error("diffResumes of invalid JSON succeeded, want an error")
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	var v interface{}
+	body := `{"title":"A","skill_set":["Go","SQL"],"area":{"id":"1","name":null},"age":30,"contact":[{"value":{"email":"a@b.ru"}}]}`
+	if err := json.Unmarshal([]byte(body), &v); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	flatten("", v, got)
+	want := map[string]string{
+		"title":                 "A",
+		"skill_set.0":           "Go",
+		"skill_set.1":           "SQL",
+		"area.id":               "1",
+		"area.name":             "",
+		"age":                   "30",
+		"contact.0.value.email": "a@b.ru",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("flatten = %v, want %v", got, want)
+	}
+}
+
+func TestSaveSnapshotPrunes(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	s.c.SnapshotLimit = 3
+	for i := 0; i < 5; i++ {
+		if err := s.saveSnapshot(&Snapshot{ResumeID: "r1", UserID: "u1", Resume: json.RawMessage(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.saveSnapshot(&Snapshot{ResumeID: "r2", UserID: "u1", Resume: json.RawMessage(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		userID, resumeID string
+		want             []uint64
+	}{
+		{"u1", "r1", []uint64{5, 4, 3}},
+		{"u1", "r2", []uint64{1}},
+		{"u2", "r1", nil},
+	}
+	for _, tt := range tests {
+		list, err := s.snapshots(tt.userID, tt.resumeID, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []uint64
+		for _, snapshot := range list {
+			got = append(got, snapshot.Version)
+			if snapshot.Resume != nil {
+				t.Errorf("%s/%s: snapshot %d listed with the body", tt.userID, tt.resumeID, snapshot.Version)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s/%s: versions %v, want %v", tt.userID, tt.resumeID, got, tt.want)
+		}
+	}
+	if _, err := s.snapshot("u2", "r1", 5); err != ErrSnapshotNotFound {
+		t.Errorf("snapshot of another user = %v, want %v", err, ErrSnapshotNotFound)
+	}
+}
+
+func TestRollbackResume(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	const (
+		old     = `{"id":"r1","updated_at":"2024-01-01","title":"Go developer","skill_set":["Go","SQL"]}`
+		current = `{"id":"r1","updated_at":"2024-01-02","title":"Go developer!","skill_set":["SQL","Go"],"total_views":7}`
+	)
+	hh := newFakeHH(t, s, map[string]string{"r1": current})
+	defer hh.Close()
+	user := &User{
+		ID:      "u1",
+		Token:   &oauth2.Token{AccessToken: "token", Expiry: time.Now().Add(time.Hour)},
+		Resumes: map[string]*ResumeState{"r1": {AppliedMutator: MutatorSkills}},
+	}
+	s.userList[user.ID] = user
+	snapshot := &Snapshot{ResumeID: "r1", UserID: "u1", Reason: SnapshotReasonEdit, Resume: json.RawMessage(old)}
+	if err := s.saveSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.rollbackResume(&User{ID: "u2"}, "r1", snapshot.Version); err != ErrSnapshotNotFound {
+		t.Errorf("rollback by another user = %v, want %v", err, ErrSnapshotNotFound)
+	}
+	if err := s.rollbackResume(user, "r1", snapshot.Version); err != nil {
+		t.Fatal(err)
+	}
+	edits := hh.edits()
+	if len(edits) != 1 {
+		t.Fatalf("%d edits sent, want 1", len(edits))
+	}
+	// The read-only fields are not sent back.
+	if want := `{"title":"Go developer","skill_set":["Go","SQL"]}`; !jsonEqual(t, edits[0], []byte(want)) {
+		t.Errorf("edit sent %s, want %s", edits[0], want)
+	}
+	versions, err := s.snapshots("u1", "r1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Reason != SnapshotReasonRollback || !jsonEqual(t, versions[0].Resume, []byte(current)) {
+		t.Errorf("versions after rollback %+v, want the resume before the rollback stored first", versions)
+	}
+	state := user.Resumes["r1"]
+	if state.AppliedMutator != "" || state.Original != nil {
+		t.Errorf("state after rollback %+v, want no mutator applied", state)
+	}
+	var fields []string
+	for _, change := range state.LastChanges {
+		fields = append(fields, change.Field)
+	}
+	if want := []string{"skill_set.0", "skill_set.1", "title"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("changed fields %v, want %v", fields, want)
+	}
+}
+
+func TestDeleteUserSnapshots(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	saved := []struct{ userID, resumeID string }{
+		{"u1", "r1"}, {"u1", "r1"}, {"u1", "r2"}, {"u2", "r3"}, {"u2", "r1"},
+	}
+	for _, snapshot := range saved {
+		if err := s.saveSnapshot(&Snapshot{ResumeID: snapshot.resumeID, UserID: snapshot.userID, Resume: json.RawMessage(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.userList["u1"] = &User{ID: "u1"}
+	s.DeleteUser(s.userList["u1"])
+	tests := []struct {
+		userID, resumeID string
+		want             int
+	}{
+		{"u1", "r1", 0},
+		{"u1", "r2", 0},
+		{"u2", "r1", 1},
+		{"u2", "r3", 1},
+	}
+	for _, tt := range tests {
+		list, err := s.snapshots(tt.userID, tt.resumeID, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != tt.want {
+			t.Errorf("%s/%s: %d versions left, want %d", tt.userID, tt.resumeID, len(list), tt.want)
+		}
+	}
+}
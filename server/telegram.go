@@ -0,0 +1,444 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artkescha/hh-updater/config"
+	"github.com/artkescha/hh-updater/logging"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// telegramPollTimeout is the long polling timeout of getUpdates.
+	telegramPollTimeout = 30
+	telegramRetryDelay  = 5 * time.Second
+	telegramIdleDelay   = time.Minute
+	telegramTimeout     = 10 * time.Second
+)
+
+// updateRefusals explain why /update can not start an update.
+var updateRefusals = map[error]string{
+	ErrUserDisabled: "Обновления отключены администратором",
+	ErrUserPaused:   "Обновления приостановлены, сначала отправьте /resume",
+	ErrTokenExpired: "Доступ к hh.ru истёк, войдите снова на странице hh-updater",
+}
+
+const linkCodeInvalid = "Код недействителен или истёк, получите новый на странице hh-updater"
+
+// telegramEvents are pushed to the linked chats.
+var telegramEvents = map[string]bool{
+	EventResumePublished: true,
+	EventResumeFailed:    true,
+	EventResumeFailing:   true,
+	EventResumeBlocked:   true,
+	EventResumeRestored:  true,
+	EventTokenExpired:    true,
+	EventInvitation:      true,
+}
+
+// outcomeNames are the outcome statuses as shown to the user.
+var outcomeNames = map[string]string{
+	OutcomePublished:         "опубликовано",
+	OutcomeEdited:            "опубликовано и изменено",
+	OutcomePlanned:           "запланировано",
+	OutcomeSkippedNotAllowed: "пропущено: обновление пока недоступно",
+	OutcomeSkippedBlocked:    "пропущено: резюме заблокировано",
+	OutcomeFailed:            "ошибка",
+}
+
+const telegramHelp = `Команды:
+/status - состояние обновлений
+/update - обновить резюме сейчас
+/pause [ГГГГ-ММ-ДД] - приостановить обновления, при желании до даты
+/resume - возобновить обновления
+/stop - отвязать чат`
+
+// TelegramBot links Telegram chats to users by one-time codes, pushes the
+// events to the linked chats and runs the commands sent to it. It reads the
+// config on every request, so a reload applies at once.
+type TelegramBot struct {
+	s *Server
+
+	mu       sync.Mutex
+	codes    map[string]linkCode
+	username string
+	// offset is the next update to receive.
+	offset int64
+}
+
+type linkCode struct {
+	userID  string
+	expires time.Time
+}
+
+type telegramResponse struct {
+	OK          bool            `json:"ok"`
+	Description string          `json:"description"`
+	Result      json.RawMessage `json:"result"`
+}
+
+type telegramUpdate struct {
+	UpdateID int64            `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+type telegramMessage struct {
+	Chat struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	Text string `json:"text"`
+}
+
+func newTelegramBot(s *Server) *TelegramBot {
+	return &TelegramBot{s: s, codes: map[string]linkCode{}}
+}
+
+// call invokes a Bot API method and decodes its result.
+func (b *TelegramBot) call(ctx context.Context, conf *config.TelegramConfig, method string, params, result interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(conf.APIURL, "/") + "/bot" + conf.Token + "/" + method
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var r telegramResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("telegram %s: %s", method, resp.Status)
+	}
+	if !r.OK {
+		return fmt.Errorf("telegram %s: %s", method, r.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(r.Result, result)
+}
+
+func (b *TelegramBot) send(chatID int64, text string) error {
+	conf := b.s.conf().Telegram
+	ctx, cancel := context.WithTimeout(b.s.ctx, telegramTimeout)
+	defer cancel()
+	return b.call(ctx, &conf, "sendMessage", map[string]interface{}{
+		"chat_id":                  chatID,
+		"text":                     text,
+		"disable_web_page_preview": true,
+	}, nil)
+}
+
+func (b *TelegramBot) Notify(user *User, event *Event) error {
+	if !b.s.conf().Telegram.Enabled() || !telegramEvents[event.Type] {
+		return nil
+	}
+	b.s.mu.RLock()
+	chatID := user.TelegramChatID
+	b.s.mu.RUnlock()
+	if chatID == 0 {
+		return nil
+	}
+	text := event.Message
+	if len(event.URL) != 0 {
+		text += "\n" + event.URL
+	}
+	return b.send(chatID, text)
+}
+
+// Run receives the messages sent to the bot by long polling.
+func (b *TelegramBot) Run() {
+	for {
+		b.s.health.beat(LoopTelegram)
+		conf := b.s.conf().Telegram
+		if !conf.Enabled() {
+			if !b.s.sleep(telegramIdleDelay) {
+				return
+			}
+			continue
+		}
+		var updates []*telegramUpdate
+		err := b.call(b.s.ctx, &conf, "getUpdates", map[string]interface{}{
+			"offset":          b.offset,
+			"timeout":         telegramPollTimeout,
+			"allowed_updates": []string{"message"},
+		}, &updates)
+		if err != nil {
+			if b.s.stopping() {
+				return
+			}
+			logrus.Errorf("Error getting telegram updates: %v", err)
+			if !b.s.sleep(telegramRetryDelay) {
+				return
+			}
+			continue
+		}
+		for _, update := range updates {
+			b.offset = update.UpdateID + 1
+			if update.Message != nil {
+				b.handle(update.Message)
+			}
+		}
+	}
+}
+
+// handle runs the command of the message and replies to it.
+func (b *TelegramBot) handle(msg *telegramMessage) {
+	fields := strings.Fields(msg.Text)
+	if len(fields) == 0 {
+		return
+	}
+	// Commands in groups are suffixed with the bot name.
+	command := strings.SplitN(fields[0], "@", 2)[0]
+	args := fields[1:]
+	chatID := msg.Chat.ID
+	var reply string
+	if command == "/start" && len(args) != 0 {
+		reply = b.link(chatID, args[0])
+	} else if user := b.userByChat(chatID); user == nil {
+		reply = "Чат не связан с hh-updater. Получите код на странице hh-updater и отправьте /start КОД"
+	} else {
+		log := logrus.WithField(logging.FieldUserID, user.ID)
+		switch command {
+		case "/status":
+			reply = b.status(user)
+		case "/update":
+			reply = "Обновление запущено, результаты придут сообщениями"
+			if _, err := b.s.StartUpdateJob(user, false); err != nil {
+				reply = err.Error()
+				if tooSoon, ok := err.(*TooSoonError); ok {
+					reply = fmt.Sprintf("Обновление уже запрашивалось, повторите через %s", tooSoon.RetryAfter.Round(time.Second))
+				}
+				if refusal, ok := updateRefusals[err]; ok {
+					reply = refusal
+				}
+			}
+		case "/pause":
+			reply = b.pause(user, args)
+		case "/resume":
+			b.s.SetPause(user, "", nil)
+			reply = "Обновления возобновлены"
+			log.Info("Updates resumed from telegram")
+		case "/stop":
+			b.s.mu.Lock()
+			user.TelegramChatID = 0
+			b.s.userListChanged = true
+			b.s.mu.Unlock()
+			reply = "Чат отвязан от hh-updater"
+			log.Info("Telegram chat unlinked")
+		default:
+			reply = telegramHelp
+		}
+	}
+	if err := b.send(chatID, reply); err != nil {
+		logrus.Errorf("Error replying to telegram: %v", err)
+	}
+}
+
+func (b *TelegramBot) pause(user *User, args []string) string {
+	var raw string
+	if len(args) != 0 {
+		raw = args[0]
+	}
+	resumeOn, err := parseResumeOn(raw)
+	if err != nil {
+		return err.Error()
+	}
+	now := time.Now().UTC()
+	if resumeOn != nil && !resumeOn.After(now) {
+		return "Дата возобновления должна быть в будущем"
+	}
+	b.s.SetPause(user, "", &Pause{Since: now, ResumeOn: resumeOn})
+	logrus.WithField(logging.FieldUserID, user.ID).Info("Updates paused from telegram")
+	if resumeOn != nil {
+		return "Обновления приостановлены до " + resumeOn.Format("02.01.2006")
+	}
+	return "Обновления приостановлены, /resume возобновит их"
+}
+
+func (b *TelegramBot) status(user *User) string {
+	now := time.Now()
+	s := b.s
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var lines []string
+	switch userState(user, now) {
+	case UserStateDisabled:
+		lines = append(lines, "Обновления отключены администратором")
+	case UserStatePaused:
+		line := "Обновления приостановлены"
+		if user.Pause.ResumeOn != nil {
+			line += " до " + user.Pause.ResumeOn.Format("02.01.2006")
+		}
+		lines = append(lines, line)
+	default:
+		lines = append(lines, "Обновления включены")
+	}
+	if user.TokenExpiredAt != nil {
+		lines = append(lines, "Доступ к hh.ru истёк, войдите в hh-updater снова")
+	}
+	if !user.UpdatedAt.IsZero() {
+		lines = append(lines, "Последнее обновление: "+user.UpdatedAt.Local().Format("02.01.2006 15:04"))
+	}
+	ids := make([]string, 0, len(user.Resumes))
+	for id := range user.Resumes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		outcome := user.Resumes[id].LastOutcome
+		if outcome == nil {
+			continue
+		}
+		line := fmt.Sprintf("«%s»: %s, %s", outcome.Title, outcomeNames[outcome.Status], outcome.At.Local().Format("02.01.2006 15:04"))
+		if user.Resumes[id].Pause.active(now) {
+			line += " (приостановлено)"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// userByChat returns the user linked to the chat.
+func (b *TelegramBot) userByChat(chatID int64) *User {
+	b.s.mu.RLock()
+	defer b.s.mu.RUnlock()
+	for _, user := range b.s.userList {
+		if user.TelegramChatID == chatID {
+			return user
+		}
+	}
+	return nil
+}
+
+// newLinkCode returns a one-time code linking a chat to the user, the codes
+// issued to the user before are dropped.
+func (b *TelegramBot) newLinkCode(user *User) (string, time.Time) {
+	expires := time.Now().Add(b.s.conf().Telegram.LinkCodeTTL)
+	code := newJobID()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c, link := range b.codes {
+		if link.userID == user.ID || time.Now().After(link.expires) {
+			delete(b.codes, c)
+		}
+	}
+	b.codes[code] = linkCode{userID: user.ID, expires: expires}
+	return code, expires
+}
+
+// link links the chat to the user of the code. A chat is linked to one user
+// at most.
+func (b *TelegramBot) link(chatID int64, code string) string {
+	b.mu.Lock()
+	link, ok := b.codes[code]
+	delete(b.codes, code)
+	b.mu.Unlock()
+	if !ok || time.Now().After(link.expires) {
+		return linkCodeInvalid
+	}
+	user, ok := b.s.getUser(link.userID)
+	if !ok {
+		return linkCodeInvalid
+	}
+	b.s.mu.Lock()
+	for _, other := range b.s.userList {
+		if other.TelegramChatID == chatID {
+			other.TelegramChatID = 0
+		}
+	}
+	user.TelegramChatID = chatID
+	b.s.userListChanged = true
+	email := user.SafeMail()
+	b.s.mu.Unlock()
+	logrus.WithField(logging.FieldUserID, user.ID).Info("Telegram chat linked")
+	return fmt.Sprintf("Чат связан с hh-updater (%s)\n\n%s", email, telegramHelp)
+}
+
+// botUsername returns the bot name for the t.me links, asking the Bot API
+// once.
+func (b *TelegramBot) botUsername() string {
+	b.mu.Lock()
+	username := b.username
+	b.mu.Unlock()
+	if len(username) != 0 {
+		return username
+	}
+	conf := b.s.conf().Telegram
+	ctx, cancel := context.WithTimeout(b.s.ctx, telegramTimeout)
+	defer cancel()
+	var me struct {
+		Username string `json:"username"`
+	}
+	if err := b.call(ctx, &conf, "getMe", struct{}{}, &me); err != nil {
+		logrus.Errorf("Error getting telegram bot name: %v", err)
+		return ""
+	}
+	b.mu.Lock()
+	b.username = me.Username
+	b.mu.Unlock()
+	return me.Username
+}
+
+// TelegramSettings is the state of the Telegram link of the user. Code is
+// only set right after it was issued.
+type TelegramSettings struct {
+	Enabled   bool       `json:"enabled"`
+	Linked    bool       `json:"linked"`
+	Code      string     `json:"code,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Link      string     `json:"link,omitempty"`
+}
+
+// TelegramHandler shows whether a chat is linked on GET, issues a link code
+// on POST and unlinks the chat on DELETE.
+func (s *Server) TelegramHandler(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromContext(r)
+	if user == nil {
+		http.Error(w, "Empty user data", http.StatusInternalServerError)
+		return
+	}
+	settings := &TelegramSettings{Enabled: s.conf().Telegram.Enabled()}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !settings.Enabled {
+			http.Error(w, "Telegram bot is not configured", http.StatusNotFound)
+			return
+		}
+		code, expires := s.telegram.newLinkCode(user)
+		settings.Code, settings.ExpiresAt = code, &expires
+		if username := s.telegram.botUsername(); len(username) != 0 {
+			settings.Link = "https://t.me/" + username + "?start=" + code
+		}
+	case http.MethodDelete:
+		s.mu.Lock()
+		user.TelegramChatID = 0
+		s.userListChanged = true
+		s.mu.Unlock()
+		requestLog(r).WithField(logging.FieldUserID, user.ID).Info("Telegram chat unlinked")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.RLock()
+	settings.Linked = user.TelegramChatID != 0
+	s.mu.RUnlock()
+	if err := json.NewEncoder(w).Encode(settings); err != nil {
+		http.Error(w, fmt.Sprintf("Cannot encode response data: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBotAPI serves the Bot API methods used by the bot and records the
+// messages sent.
+type fakeBotAPI struct {
+	*httptest.Server
+	t *testing.T
+
+	mu       sync.Mutex
+	messages []fakeBotMessage
+	// updates are returned by the first getUpdates, the next ones wait for
+	// the client to give up or the fake to close.
+	updates []*telegramUpdate
+	closed  chan struct{}
+}
+
+type fakeBotMessage struct {
+	ChatID int64  `json:"chat_id"`
+	Text   string `json:"text"`
+}
+
+func newFakeBotAPI(t *testing.T, s *Server) *fakeBotAPI {
+	f := &fakeBotAPI{t: t, closed: make(chan struct{})}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	s.c.Telegram.Token = "123:secret"
+	// The base URL may end with a slash.
+	s.c.Telegram.APIURL = f.URL + "/"
+	return f
+}
+
+func (f *fakeBotAPI) serve(w http.ResponseWriter, r *http.Request) {
+	method := strings.TrimPrefix(r.URL.Path, "/bot123:secret/")
+	if method == r.URL.Path {
+		f.t.Errorf("unexpected path %s", r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	var result interface{} = true
+	switch method {
+	case "getMe":
+		result = map[string]string{"username": "hhupdater_bot"}
+	case "sendMessage":
+		var msg fakeBotMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			f.t.Error(err)
+		}
+		f.mu.Lock()
+		f.messages = append(f.messages, msg)
+		f.mu.Unlock()
+	case "getUpdates":
+		f.mu.Lock()
+		updates := f.updates
+		f.updates = nil
+		f.mu.Unlock()
+		if updates == nil {
+			select {
+			case <-r.Context().Done():
+			case <-f.closed:
+			}
+			return
+		}
+		result = updates
+	default:
+		f.t.Errorf("unexpected method %s", method)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": result})
+}
+
+func (f *fakeBotAPI) Close() {
+	close(f.closed)
+	f.Server.Close()
+}
+
+// lastMessage returns the last message sent to the chat.
+func (f *fakeBotAPI) lastMessage(chatID int64) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := len(f.messages) - 1; i >= 0; i-- {
+		if f.messages[i].ChatID == chatID {
+			return f.messages[i].Text
+		}
+	}
+	return ""
+}
+
+func TestTelegramLinkAndCommands(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	api := newFakeBotAPI(t, s)
+	defer api.Close()
+	user := &User{ID: "u1", Email: "user@example.com"}
+	s.userList[user.ID] = user
+	const chatID = 77
+
+	w := httptest.NewRecorder()
+	r := SetUserToContext(httptest.NewRequest(http.MethodPost, "/settings/telegram", nil), user)
+	s.TelegramHandler(w, r)
+	var settings TelegramSettings
+	if err := json.NewDecoder(w.Body).Decode(&settings); err != nil {
+		t.Fatal(err)
+	}
+	if len(settings.Code) == 0 || settings.Link != "https://t.me/hhupdater_bot?start="+settings.Code {
+		t.Fatalf("link settings %+v", settings)
+	}
+
+	send := func(chatID int64, text string) string {
+		msg := &telegramMessage{Text: text}
+		msg.Chat.ID = chatID
+		s.telegram.handle(msg)
+		return api.lastMessage(chatID)
+	}
+	steps := []struct {
+		chatID int64
+		text   string
+		reply  string
+	}{
+		{chatID, "/status", "Чат не связан"},
+		{chatID, "/start wrong", linkCodeInvalid},
+		{chatID, "/start " + settings.Code, "Чат связан с hh-updater"},
+		// The code is single use.
+		{chatID + 1, "/start " + settings.Code, linkCodeInvalid},
+		{chatID, "/status@hhupdater_bot", "Обновления включены"},
+		{chatID, "/pause", "Обновления приостановлены"},
+		{chatID, "/status", "Обновления приостановлены"},
+		{chatID, "/update", "Обновления приостановлены, сначала отправьте /resume"},
+		{chatID, "/resume", "Обновления возобновлены"},
+		{chatID, "/help", "Команды:"},
+		{chatID, "/stop", "Чат отвязан"},
+		{chatID, "/status", "Чат не связан"},
+	}
+	for _, step := range steps {
+		if reply := send(step.chatID, step.text); !strings.HasPrefix(reply, step.reply) {
+			t.Errorf("%q from chat %d: reply %q, want %q", step.text, step.chatID, reply, step.reply)
+		}
+	}
+	if user.TelegramChatID != 0 {
+		t.Errorf("chat %d still linked", user.TelegramChatID)
+	}
+}
+
+func TestTelegramRunAndNotify(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	api := newFakeBotAPI(t, s)
+	defer api.Close()
+	user := &User{ID: "u1", TelegramChatID: 77}
+	s.userList[user.ID] = user
+	update := &telegramUpdate{UpdateID: 41, Message: &telegramMessage{Text: "/status"}}
+	update.Message.Chat.ID = 77
+	api.updates = []*telegramUpdate{update}
+
+	done := make(chan struct{})
+	go func() {
+		s.telegram.Run()
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(api.lastMessage(77)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reply := api.lastMessage(77); !strings.HasPrefix(reply, "Обновления включены") {
+		t.Errorf("reply to the polled message %q", reply)
+	}
+
+	event := &Event{Type: EventResumeBlocked, Message: "Резюме заблокировано", URL: "https://hh.example.com"}
+	if err := s.telegram.Notify(user, event); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := api.lastMessage(77), "Резюме заблокировано\nhttps://hh.example.com"; got != want {
+		t.Errorf("event message %q, want %q", got, want)
+	}
+	if err := s.telegram.Notify(user, &Event{Type: EventResumeEdited, Message: "not pushed"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.lastMessage(77); strings.Contains(got, "not pushed") {
+		t.Errorf("event not meant for telegram sent: %q", got)
+	}
+
+	s.cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not stop")
+	}
+	if s.telegram.offset != update.UpdateID+1 {
+		t.Errorf("offset %d, want %d", s.telegram.offset, update.UpdateID+1)
+	}
+}
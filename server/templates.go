@@ -0,0 +1,255 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/artkescha/hh-updater/hhclient"
+	"github.com/sirupsen/logrus"
+)
+
+// MutatorTemplate is the name under which a per resume description template
+// is recorded as the applied mutator.
+const MutatorTemplate = "template"
+
+var ErrEmptyTemplate = errors.New("Empty template")
+
+// ResumeTemplate is a text/template rendered into every experience
+// description of the resume. Originals keeps the descriptions as they were
+// before the template was applied, so they can be restored.
+type ResumeTemplate struct {
+	Source    string    `json:"source"`
+	Originals []string  `json:"originals"`
+	SavedAt   time.Time `json:"saved_at"`
+}
+
+// TemplateData is available to description templates.
+type TemplateData struct {
+	Today       string
+	Now         time.Time
+	UpdateCount int
+	Title       string
+	Company     hhclient.Company
+	// Original is the description before the template was applied.
+	Original string
+}
+
+func parseDescriptionTemplate(source string) (*template.Template, error) {
+	if len(strings.TrimSpace(source)) == 0 {
+		return nil, ErrEmptyTemplate
+	}
+	return template.New("description").Option("missingkey=error").Parse(source)
+}
+
+// TemplateMutator renders the description template for every company of
+// the resume. It is built per update since the data depends on the user.
+type TemplateMutator struct {
+	tmpl        *template.Template
+	originals   []string
+	updateCount int
+	now         time.Time
+}
+
+func newTemplateMutator(rt *ResumeTemplate, updateCount int, now time.Time) (*TemplateMutator, error) {
+	tmpl, err := parseDescriptionTemplate(rt.Source)
+	if err != nil {
+		return nil, err
+	}
+	return &TemplateMutator{tmpl: tmpl, originals: rt.Originals, updateCount: updateCount, now: now}, nil
+}
+
+func (m *TemplateMutator) Name() string {
+	return MutatorTemplate
+}
+
+func (m *TemplateMutator) Mutate(resume *hhclient.Resume) ([]FieldChange, error) {
+	if m.tmpl == nil {
+		return nil, ErrEmptyTemplate
+	}
+	if len(m.originals) != len(resume.Experience) {
+		return nil, errors.New("experience list changed since the template was saved")
+	}
+	rendered := make([]string, len(resume.Experience))
+	for idx, company := range resume.Experience {
+		desc, err := m.render(resume, company, m.originals[idx])
+		if err != nil {
+			return nil, err
+		}
+		rendered[idx] = desc
+	}
+	idx := -1
+	return mutateDescriptions(resume, func(string) string {
+		idx++
+		return rendered[idx]
+	}), nil
+}
+
+func (m *TemplateMutator) Revert(resume *hhclient.Resume) ([]FieldChange, error) {
+	if len(m.originals) != len(resume.Experience) {
+		return nil, errors.New("experience list changed since the template was saved")
+	}
+	idx := -1
+	return mutateDescriptions(resume, func(string) string {
+		idx++
+		return m.originals[idx]
+	}), nil
+}
+
+func (m *TemplateMutator) render(resume *hhclient.Resume, company hhclient.Company, original string) (string, error) {
+	company.Description = original
+	data := &TemplateData{
+		Today:       m.now.Format("02.01.2006"),
+		Now:         m.now,
+		UpdateCount: m.updateCount,
+		Title:       resume.Title,
+		Company:     company,
+		Original:    original,
+	}
+	var buf bytes.Buffer
+	if err := m.tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	desc := buf.String()
+	if len(strings.TrimSpace(desc)) == 0 {
+		return "", fmt.Errorf("template renders an empty description for %s", company.Name)
+	}
+	return desc, nil
+}
+
+// TemplateHandler manages the description template of a resume: GET shows
+// it, POST validates and saves it and DELETE restores the original
+// descriptions on hh and removes the template.
+func (s *Server) TemplateHandler(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromContext(r)
+	if user == nil {
+		http.Error(w, "Empty user data", http.StatusInternalServerError)
+		return
+	}
+	resumeID := r.FormValue("resume_id")
+	if len(resumeID) == 0 {
+		http.Error(w, "Empty resume_id", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := s.saveTemplate(user, resumeID, r.FormValue("template")); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid template: %v", err), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		if err := s.removeTemplate(user, resumeID); err != nil {
+			logrus.Errorf("Error restoring resume %s: %v", resumeID, err)
+			http.Error(w, fmt.Sprintf("Cannot restore resume: %v", err), http.StatusBadGateway)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var rt *ResumeTemplate
+	if state, ok := user.Resumes[resumeID]; ok {
+		rt = state.Template
+	}
+	if err := json.NewEncoder(w).Encode(rt); err != nil {
+		http.Error(w, fmt.Sprintf("Cannot encode response data: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// saveTemplate validates the template by rendering it against the current
+// resume, so a broken template is rejected before it is used for an edit.
+func (s *Server) saveTemplate(user *User, resumeID, source string) error {
+	s.mu.RLock()
+	client := s.newClient(user.Token)
+	updateCount := user.UpdateCount
+	var current *ResumeTemplate
+	var applied string
+	if state, ok := user.Resumes[resumeID]; ok {
+		current = state.Template
+		applied = state.AppliedMutator
+	}
+	s.mu.RUnlock()
+	tmpl, err := parseDescriptionTemplate(source)
+	if err != nil {
+		return err
+	}
+	resume, err := client.Resume.ReadResume(resumeID)
+	if err != nil {
+		return err
+	}
+	var originals []string
+	if current != nil && applied == MutatorTemplate {
+		originals = current.Originals
+	} else {
+		if previous, ok := s.mutator(applied); ok {
+			if _, err := previous.Revert(resume); err != nil {
+				return err
+			}
+		}
+		for _, company := range resume.Experience {
+			originals = append(originals, company.Description)
+		}
+	}
+	m := &TemplateMutator{tmpl: tmpl, originals: originals, updateCount: updateCount, now: time.Now()}
+	if _, err := m.Mutate(resume); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	user.resumeState(resumeID).Template = &ResumeTemplate{
+		Source:    source,
+		Originals: originals,
+		SavedAt:   time.Now().UTC(),
+	}
+	s.userListChanged = true
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Server) removeTemplate(user *User, resumeID string) error {
+	s.mu.RLock()
+	client := s.newClient(user.Token)
+	var rt *ResumeTemplate
+	var applied string
+	if state, ok := user.Resumes[resumeID]; ok {
+		rt = state.Template
+		applied = state.AppliedMutator
+	}
+	s.mu.RUnlock()
+	if rt == nil {
+		return nil
+	}
+	if applied == MutatorTemplate {
+		resume, err := client.Resume.ReadResume(resumeID)
+		if err != nil {
+			return err
+		}
+		m := &TemplateMutator{originals: rt.Originals}
+		changes, err := m.Revert(resume)
+		if err != nil {
+			return err
+		}
+		if len(changes) != 0 {
+			if err := client.Resume.EditResume(resume); err != nil {
+				return err
+			}
+		}
+	}
+	s.mu.Lock()
+	state := user.resumeState(resumeID)
+	state.Template = nil
+	if state.AppliedMutator == MutatorTemplate {
+		state.AppliedMutator = ""
+	}
+	s.userListChanged = true
+	s.mu.Unlock()
+	return nil
+}
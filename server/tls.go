@@ -0,0 +1,142 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// certCheckInterval limits how often the certificate files are checked for
+// changes.
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves the certificate from the files and reloads it once
+// they change, so a renewed certificate is used without a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// filesModTime returns the latest modification time of the files.
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// load reads the certificate. The caller holds r.mu unless r is not in use
+// yet.
+func (r *certReloader) load() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert, r.modTime, r.checkedAt = &cert, modTime, time.Now()
+	return nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate. If the changed files
+// can not be loaded, e.g. while they are being replaced, the previous
+// certificate is kept.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checkedAt) < certCheckInterval {
+		return r.cert, nil
+	}
+	r.checkedAt = time.Now()
+	modTime, err := r.filesModTime()
+	if err != nil {
+		logrus.Errorf("Error checking TLS certificate: %v", err)
+		return r.cert, nil
+	}
+	if !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+	if err := r.load(); err != nil {
+		logrus.Errorf("Error reloading TLS certificate, keeping the previous one: %v", err)
+		return r.cert, nil
+	}
+	logrus.Info("TLS certificate reloaded")
+	return r.cert, nil
+}
+
+// initTLS loads the certificate and prepares the redirect listener if TLS
+// is configured.
+func (s *Server) initTLS() error {
+	conf := s.conf().TLS
+	if len(conf.CertFile) == 0 {
+		return nil
+	}
+	certs, err := newCertReloader(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return err
+	}
+	s.httpServer.TLSConfig = &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if len(conf.RedirectListenAddress) != 0 {
+		s.redirectServer = &http.Server{
+			Addr:    conf.RedirectListenAddress,
+			Handler: http.HandlerFunc(s.RedirectHandler),
+		}
+	}
+	return nil
+}
+
+// RedirectHandler sends plain HTTP requests to the https public URL. The
+// request path is put under the path of the public URL, unless it is there
+// already. Escaped characters of the path, e.g. %2F, are kept.
+func (s *Server) RedirectHandler(w http.ResponseWriter, r *http.Request) {
+	target := *s.conf().PublicURL
+	prefix := strings.TrimSuffix(target.Path, "/")
+	rawPrefix := strings.TrimSuffix(target.EscapedPath(), "/")
+	target.Path, target.RawPath = r.URL.Path, r.URL.RawPath
+	if len(prefix) != 0 && r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, prefix+"/") {
+		target.Path = prefix + r.URL.Path
+		if len(r.URL.RawPath) != 0 {
+			target.RawPath = rawPrefix + r.URL.RawPath
+		}
+	}
+	target.RawQuery = r.URL.RawQuery
+	http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+}
+
+func (s *Server) startRedirect() {
+	s.goLoop(LoopRedirect, func() {
+		if err := s.redirectServer.ListenAndServe(); err != http.ErrServerClosed {
+			logrus.Errorf("HTTP redirect server failed: %v", err)
+		}
+	})
+	logrus.Infof("Redirecting HTTP from %s", s.redirectServer.Addr)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRedirectHandler(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	tests := []struct {
+		publicURL string
+		target    string
+		want      string
+	}{
+		{"https://hh.example.com", "/", "https://hh.example.com/"},
+		{"https://hh.example.com", "/logged.html?tab=1", "https://hh.example.com/logged.html?tab=1"},
+		{"https://hh.example.com/", "/logged.html", "https://hh.example.com/logged.html"},
+		{"https://example.com/hh/", "/", "https://example.com/hh/"},
+		{"https://example.com/hh/", "/logged.html?tab=1", "https://example.com/hh/logged.html?tab=1"},
+		{"https://example.com/hh/", "/hh/logged.html", "https://example.com/hh/logged.html"},
+		{"https://example.com/hh", "/hh", "https://example.com/hh"},
+		{"https://example.com/hh", "/hhx/logged.html", "https://example.com/hh/hhx/logged.html"},
+		{"https://example.com/hh", "/a%2Fb", "https://example.com/hh/a%2Fb"},
+		{"https://example.com/hh", "/hh/a%2Fb", "https://example.com/hh/a%2Fb"},
+		{"https://example.com/h%20h/", "/a%2Fb", "https://example.com/h%20h/a%2Fb"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.publicURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.c.PublicURLRaw, s.c.PublicURL = tt.publicURL, u
+		w := httptest.NewRecorder()
+		s.RedirectHandler(w, httptest.NewRequest(http.MethodGet, "http://hh.example.com"+tt.target, nil))
+		if w.Code != http.StatusMovedPermanently {
+			t.Errorf("%s%s: status %d", tt.publicURL, tt.target, w.Code)
+		}
+		if got := w.Header().Get("Location"); got != tt.want {
+			t.Errorf("%s%s: redirect to %s, want %s", tt.publicURL, tt.target, got, tt.want)
+		}
+	}
+}
+
+// writeCert writes a self-signed certificate for name and its key.
+func writeCert(t *testing.T, certFile, keyFile, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hh-updater")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, "old.example.com")
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := func() string {
+		cert, err := r.GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+	// touch moves the files a minute past the time they were loaded.
+	later := time.Now().Add(time.Minute)
+	touch := func() {
+		later = later.Add(time.Minute)
+		for _, file := range []string{certFile, keyFile} {
+			if err := os.Chtimes(file, later, later); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if got := served(); got != "old.example.com" {
+		t.Fatalf("served %s", got)
+	}
+	writeCert(t, certFile, keyFile, "new.example.com")
+	touch()
+	if got := served(); got != "old.example.com" {
+		t.Errorf("files checked again within %s: served %s", certCheckInterval, got)
+	}
+	r.checkedAt = time.Time{}
+	if got := served(); got != "new.example.com" {
+		t.Errorf("renewed certificate not reloaded: served %s", got)
+	}
+
+	// A half written renewal keeps the previous certificate.
+	if err := ioutil.WriteFile(keyFile, []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	touch()
+	r.checkedAt = time.Time{}
+	if got := served(); got != "new.example.com" {
+		t.Errorf("broken files: served %s", got)
+	}
+	os.Remove(keyFile)
+	r.checkedAt = time.Time{}
+	if got := served(); got != "new.example.com" {
+		t.Errorf("missing key file: served %s", got)
+	}
+}
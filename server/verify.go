@@ -0,0 +1,196 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/artkescha/hh-updater/hhclient"
+	"github.com/artkescha/hh-updater/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// volatileFields are changed by hh on its own and are never reported as
+// unexpected changes.
+var volatileFields = []string{
+	"updated_at", "created_at", "next_publish_at", "can_publish_or_update",
+	"total_views", "new_views", "views_url", "status", "access", "actions",
+	"alternate_url", "download", "paid_services", "photo", "blocked",
+	"finished", "publish_url", "moderation_note", "similar_vacancies",
+	"negotiations_history", "hidden_fields", "auto_hide_time",
+}
+
+// Verification is the result of re-reading the resume after an edit.
+// Mismatches are targeted fields stored differently than intended (Old is the
+// intended value, New the stored one), Unexpected are other fields changed by
+// the edit.
+type Verification struct {
+	At         time.Time     `json:"at"`
+	Mismatches []FieldChange `json:"mismatches,omitempty"`
+	Unexpected []FieldChange `json:"unexpected,omitempty"`
+	RolledBack bool          `json:"rolled_back,omitempty"`
+}
+
+// PublishVerification is the result of checking the resume status after a
+// publish.
+type PublishVerification struct {
+	At            time.Time `json:"at"`
+	Confirmed     bool      `json:"confirmed"`
+	NextPublishAt string    `json:"next_publish_at,omitempty"`
+}
+
+// resumeField returns the value of a field named the way mutators report
+// their changes.
+func resumeField(resume *hhclient.Resume, field string) (string, bool) {
+	switch field {
+	case "title":
+		return resume.Title, true
+	case "skill_set":
+		return strings.Join(resume.SkillSet, ", "), true
+	}
+	parts := strings.Split(field, ".")
+	if len(parts) == 3 && parts[0] == "experience" && parts[2] == "description" {
+		idx, err := strconv.Atoi(parts[1])
+		if err != nil || idx < 0 || idx >= len(resume.Experience) {
+			return "", false
+		}
+		return resume.Experience[idx].Description, true
+	}
+	return "", false
+}
+
+func isIgnoredField(field string, changes []FieldChange) bool {
+	for _, volatile := range volatileFields {
+		if field == volatile || strings.HasPrefix(field, volatile+".") {
+			return true
+		}
+	}
+	for _, change := range changes {
+		if field == change.Field || strings.HasPrefix(field, change.Field+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyEdit re-reads the resume and compares it with what was intended. If
+// the edit changed something it was not supposed to, the resume is restored
+// from before, which is the resume as read prior to the edit, and read again
+// to make sure the restore took.
+func (s *Server) verifyEdit(client *hhclient.Client, resumeID string, before json.RawMessage,
+	changes []FieldChange) (*Verification, error) {
+	after, err := client.Resume.ReadResume(resumeID)
+	if err != nil {
+		return nil, fmt.Errorf("error re-reading resume fail %s", err)
+	}
+	v := &Verification{At: time.Now().UTC()}
+	for _, change := range changes {
+		stored, ok := resumeField(after, change.Field)
+		if !ok || stored != change.New {
+			v.Mismatches = append(v.Mismatches, FieldChange{Field: change.Field, Old: change.New, New: stored})
+		}
+	}
+	diff, err := diffResumes(before, after.Raw)
+	if err != nil {
+		return v, err
+	}
+	for _, change := range diff {
+		if !isIgnoredField(change.Field, changes) {
+			v.Unexpected = append(v.Unexpected, change)
+		}
+	}
+	if len(v.Unexpected) == 0 {
+		return v, nil
+	}
+	if err := client.Resume.EditResumeRaw(resumeID, before); err != nil {
+		return v, fmt.Errorf("error restoring resume fail %s", err)
+	}
+	restored, err := client.Resume.ReadResume(resumeID)
+	if err != nil {
+		return v, fmt.Errorf("error re-reading restored resume fail %s", err)
+	}
+	diff, err = diffResumes(before, restored.Raw)
+	if err != nil {
+		return v, err
+	}
+	var left []string
+	for _, change := range diff {
+		if !isIgnoredField(change.Field, nil) {
+			left = append(left, change.Field)
+		}
+	}
+	if len(left) != 0 {
+		return v, fmt.Errorf("rollback failed, fields still changed: %s", strings.Join(left, ", "))
+	}
+	v.RolledBack = true
+	return v, nil
+}
+
+// verifyPublish checks that hh accepted the publish: the resume can not be
+// published again right away.
+func (s *Server) verifyPublish(client *hhclient.Client, resume *hhclient.Resume) (*PublishVerification, error) {
+	status, err := client.Resume.ResumesStatus(resume)
+	if err != nil {
+		return nil, err
+	}
+	v := &PublishVerification{At: time.Now().UTC(), Confirmed: !status.CanPublishOrUpdate}
+	if after, err := client.Resume.ReadResume(resume.ID); err == nil {
+		v.NextPublishAt = after.NextPublishAt
+		if len(resume.NextPublishAt) != 0 && after.NextPublishAt == resume.NextPublishAt {
+			v.Confirmed = false
+		}
+	}
+	return v, nil
+}
+
+func (s *Server) recordVerification(user *User, resumeID string, v *Verification) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := user.resumeState(resumeID)
+	state.LastVerification = v
+	if len(v.Unexpected) != 0 {
+		state.NeedsReview = true
+		fields := make([]string, 0, len(v.Unexpected))
+		for _, change := range v.Unexpected {
+			fields = append(fields, change.Field)
+		}
+		state.ReviewReason = "Unexpected fields changed: " + strings.Join(fields, ", ")
+	}
+	s.userListChanged = true
+}
+
+func (s *Server) recordPublishVerification(user *User, resumeID string, v *PublishVerification) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user.resumeState(resumeID).LastPublish = v
+	s.userListChanged = true
+}
+
+// ReviewHandler clears the manual review flag of a resume, allowing the
+// updater to edit it again.
+func (s *Server) ReviewHandler(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromContext(r)
+	if user == nil {
+		http.Error(w, "Empty user data", http.StatusInternalServerError)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resumeID := r.FormValue("resume_id")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := user.Resumes[resumeID]
+	if !ok {
+		http.Error(w, "Resume not found", http.StatusNotFound)
+		return
+	}
+	state.NeedsReview = false
+	state.ReviewReason = ""
+	s.userListChanged = true
+	logrus.WithFields(logrus.Fields{logging.FieldUserID: user.ID, logging.FieldResumeID: resumeID}).Info("Resume reviewed")
+}
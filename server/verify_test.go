@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artkescha/hh-updater/hhclient"
+	"golang.org/x/oauth2"
+)
+
+func TestVerifyEdit(t *testing.T) {
+	const (
+		before   = `{"id":"r1","updated_at":"2024-01-01","title":"Go developer","skill_set":["Go","SQL"],"experience":[{"description":"old"}]}`
+		intended = `{"id":"r1","updated_at":"2024-01-02","title":"Go developer","skill_set":["Go","SQL"],"experience":[{"description":"new"}]}`
+		// hh dropped a skill along with the edit.
+		unexpected = `{"id":"r1","updated_at":"2024-01-02","title":"Go developer","skill_set":["Go"],"experience":[{"description":"new"}]}`
+		mismatched = `{"id":"r1","updated_at":"2024-01-02","title":"Go developer","skill_set":["Go","SQL"],"experience":[{"description":"new "}]}`
+	)
+	changes := []FieldChange{{Field: "experience.0.description", Old: "old", New: "new"}}
+	// The restore sends the resume from before without the read-only fields.
+	restore, err := hhclient.EditableResume(json.RawMessage(before))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		// stored is the resume on hh after the edit.
+		stored string
+		// restoreFails makes hh ignore the restore.
+		restoreFails   bool
+		wantMismatches []string
+		wantUnexpected []string
+		wantRestore    bool
+		wantRolledBack bool
+		wantErr        string
+	}{
+		{name: "as intended", stored: intended},
+		{name: "stored differently", stored: mismatched, wantMismatches: []string{"experience.0.description"}},
+		{name: "unexpected change", stored: unexpected, wantUnexpected: []string{"skill_set.1"}, wantRestore: true, wantRolledBack: true},
+		{name: "restore ignored", stored: unexpected, restoreFails: true,
+			wantUnexpected: []string{"skill_set.1"}, wantRestore: true,
+			wantErr: "rollback failed, fields still changed: experience.0.description, skill_set.1"},
+	}
+	for _, tt := range tests {
+		s, cleanup := newTestServer(t)
+		hh := newFakeHH(t, s, map[string]string{"r1": tt.stored})
+		if tt.restoreFails {
+			hh.onPut = func(id string, body json.RawMessage) json.RawMessage {
+				return json.RawMessage(tt.stored)
+			}
+		}
+		client := s.newClient(&oauth2.Token{AccessToken: "token", Expiry: time.Now().Add(time.Hour)})
+		v, err := s.verifyEdit(client, "r1", json.RawMessage(before), changes)
+		switch {
+		case len(tt.wantErr) == 0 && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case len(tt.wantErr) != 0 && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.wantErr)
+		}
+		if v == nil {
+			t.Fatalf("%s: no verification", tt.name)
+		}
+		fields := func(list []FieldChange) []string {
+			var names []string
+			for _, change := range list {
+				names = append(names, change.Field)
+			}
+			return names
+		}
+		if got := fields(v.Mismatches); strings.Join(got, ",") != strings.Join(tt.wantMismatches, ",") {
+			t.Errorf("%s: mismatches %v, want %v", tt.name, got, tt.wantMismatches)
+		}
+		if got := fields(v.Unexpected); strings.Join(got, ",") != strings.Join(tt.wantUnexpected, ",") {
+			t.Errorf("%s: unexpected changes %v, want %v", tt.name, got, tt.wantUnexpected)
+		}
+		edits := hh.edits()
+		switch {
+		case !tt.wantRestore && len(edits) != 0:
+			t.Errorf("%s: %d edits sent, want none", tt.name, len(edits))
+		case tt.wantRestore && len(edits) != 1:
+			t.Errorf("%s: %d edits sent, want the restore", tt.name, len(edits))
+		case tt.wantRestore && !jsonEqual(t, edits[0], restore):
+			t.Errorf("%s: restore sent %s, want %s", tt.name, edits[0], restore)
+		}
+		if v.RolledBack != tt.wantRolledBack {
+			t.Errorf("%s: rolled back %v, want %v", tt.name, v.RolledBack, tt.wantRolledBack)
+		}
+		hh.Close()
+		cleanup()
+	}
+}
@@ -0,0 +1,747 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/artkescha/hh-updater/logging"
+	"github.com/boltdb/bolt"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// The headers of a webhook request. The signature is the hex HMAC-SHA256
+	// of the timestamp, a dot and the body, keyed by the webhook secret.
+	WebhookSignatureHeader = "X-HH-Updater-Signature"
+	WebhookTimestampHeader = "X-HH-Updater-Timestamp"
+	WebhookEventHeader     = "X-HH-Updater-Event"
+	WebhookDeliveryHeader  = "X-HH-Updater-Delivery"
+
+	DeliveryDelivered = "delivered"
+	DeliveryRetrying  = "retrying"
+	DeliveryFailed    = "failed"
+
+	webhookPollInterval = 10 * time.Second
+	webhookBatchSize    = 100
+	webhookMinBackoff   = 30 * time.Second
+	webhookMaxBackoff   = 6 * time.Hour
+	// webhookLogLimit is the number of deliveries kept per webhook.
+	webhookLogLimit = 50
+)
+
+var (
+	ErrWebhookNotFound = errors.New("Webhook not found")
+	ErrTooManyWebhooks = errors.New("Too many webhooks")
+	ErrPrivateAddress  = errors.New("Webhook address is not public")
+
+	WebhooksBucket   = []byte("webhooksv1")
+	OutboxBucket     = []byte("outboxv1")
+	DeliveriesBucket = []byte("deliveriesv1")
+)
+
+// WebhookEvents are the events a webhook may subscribe to.
+var WebhookEvents = []string{
+	EventResumePublished, EventResumeEdited, EventResumeFailed, EventResumeFailing,
+	EventResumeBlocked, EventResumeRestored, EventTokenExpired, EventInvitation, EventUserDeleted,
+}
+
+// Webhook receives the events of its user, or of all the users if it is a
+// global one registered by an admin. Empty Events means all of them.
+type Webhook struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id,omitempty"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret"`
+	Events    []string  `json:"events,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (h *Webhook) wants(eventType string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookEvent is the body of a webhook request.
+type WebhookEvent struct {
+	ID string `json:"id"`
+	*Event
+}
+
+// outboxEntry is an event waiting to be delivered to a webhook. The URL and
+// the secret are copied, so the events of a deleted user still go out.
+type outboxEntry struct {
+	WebhookID     string          `json:"webhook_id"`
+	Global        bool            `json:"global"`
+	URL           string          `json:"url"`
+	Secret        string          `json:"secret"`
+	EventID       string          `json:"event_id"`
+	EventType     string          `json:"event_type"`
+	Payload       json.RawMessage `json:"payload"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+// WebhookDelivery is an attempt to deliver an event, as shown in the
+// delivery log.
+type WebhookDelivery struct {
+	ID         uint64    `json:"id"`
+	EventID    string    `json:"event_id"`
+	EventType  string    `json:"event_type"`
+	Attempt    int       `json:"attempt"`
+	Status     string    `json:"status"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Duration   string    `json:"duration"`
+	At         time.Time `json:"at"`
+}
+
+// WebhookNotifier puts the events into the outbox of the matching webhooks,
+// the delivery loop sends them.
+type WebhookNotifier struct {
+	s *Server
+}
+
+func (n *WebhookNotifier) Notify(user *User, event *Event) error {
+	// Most events have no webhook, so the write transaction is only opened
+	// when something is queued.
+	var hooks []Webhook
+	err := n.s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(WebhooksBucket).ForEach(func(k, v []byte) error {
+			var hook Webhook
+			if err := json.Unmarshal(v, &hook); err != nil {
+				return err
+			}
+			if (len(hook.UserID) == 0 || hook.UserID == user.ID) && hook.wants(event.Type) {
+				hooks = append(hooks, hook)
+			}
+			return nil
+		})
+	})
+	if err != nil || len(hooks) == 0 {
+		return err
+	}
+	eventID := newJobID()
+	payload, err := json.Marshal(&WebhookEvent{ID: eventID, Event: event})
+	if err != nil {
+		return err
+	}
+	err = n.s.db.Update(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(OutboxBucket)
+		for _, hook := range hooks {
+			id, err := outbox.NextSequence()
+			if err != nil {
+				return err
+			}
+			encoded, err := json.Marshal(&outboxEntry{
+				WebhookID:     hook.ID,
+				Global:        len(hook.UserID) == 0,
+				URL:           hook.URL,
+				Secret:        hook.Secret,
+				EventID:       eventID,
+				EventType:     event.Type,
+				Payload:       payload,
+				NextAttemptAt: time.Now().UTC(),
+				CreatedAt:     time.Now().UTC(),
+			})
+			if err != nil {
+				return err
+			}
+			if err := outbox.Put(itob(id), encoded); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	n.s.wakeWebhooks()
+	return nil
+}
+
+func (s *Server) wakeWebhooks() {
+	select {
+	case s.webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// webhookBackoff returns the delay before the next attempt, doubling from
+// webhookMinBackoff.
+func webhookBackoff(attempts int) time.Duration {
+	d := webhookMinBackoff
+	for i := 1; i < attempts && d < webhookMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > webhookMaxBackoff {
+		d = webhookMaxBackoff
+	}
+	return d
+}
+
+// signWebhook returns the signature of the body sent at timestamp.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// publicAddress refuses the connections to loopback, private and link
+// local addresses, after the host name is resolved.
+func publicAddress(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+// nonPublicNetworks are the networks a webhook of a user may not reach:
+// "this" network, private, carrier-grade NAT, loopback, link local,
+// IETF protocol assignments, benchmarking, reserved, broadcast, multicast
+// and unique local addresses, and the IPv6 prefixes embedding IPv4
+// addresses: IPv4-compatible, NAT64, 6to4 and Teredo.
+var nonPublicNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4",
+	"240.0.0.0/4", "::/96", "64:ff9b::/96", "64:ff9b:1::/48", "2001::/32", "2002::/16",
+	"fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// isPublicIP reports whether the address is a global unicast one outside
+// nonPublicNetworks. IPv4-mapped IPv6 addresses are checked as IPv4.
+func isPublicIP(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	if !ip.IsGlobalUnicast() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookClient returns the client delivering to the webhook. Redirects
+// are not followed, so a webhook can not send the request elsewhere.
+func (s *Server) webhookClient(entry *outboxEntry) *http.Client {
+	conf := s.conf().Webhooks
+	dialer := &net.Dialer{Timeout: conf.Timeout}
+	if !entry.Global && !conf.AllowPrivateNetworks {
+		dialer.Control = publicAddress
+	}
+	return &http.Client{
+		Timeout: conf.Timeout,
+		// The client is built for each delivery, so the connections are
+		// not kept.
+		Transport: &http.Transport{DialContext: dialer.DialContext, DisableKeepAlives: true},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// deliver sends the event once and returns the status code of the
+// response.
+func (s *Server) deliver(entry *outboxEntry) (int, error) {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, entry.URL, bytes.NewReader(entry.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "hh-updater")
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookEventHeader, entry.EventType)
+	req.Header.Set(WebhookDeliveryHeader, entry.EventID)
+	req.Header.Set(WebhookSignatureHeader, signWebhook(entry.Secret, timestamp, entry.Payload))
+	resp, err := s.webhookClient(entry).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// WebhookLoop delivers the due events of the outbox, waking up early when
+// new events are queued.
+func (s *Server) WebhookLoop() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-timer.C:
+		case <-s.webhookWake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+		s.health.beat(LoopWebhooks)
+		if err := s.deliverDue(time.Now()); err != nil {
+			logrus.Errorf("Error delivering webhooks: %v", err)
+		}
+		timer.Reset(webhookPollInterval)
+	}
+}
+
+// deliverDue delivers the outbox entries due at now.
+func (s *Server) deliverDue(now time.Time) error {
+	type due struct {
+		key   []byte
+		entry *outboxEntry
+	}
+	var batch []due
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(OutboxBucket).Cursor()
+		for k, v := c.First(); k != nil && len(batch) < webhookBatchSize; k, v = c.Next() {
+			var entry outboxEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if !entry.NextAttemptAt.After(now) {
+				batch = append(batch, due{key: append([]byte(nil), k...), entry: &entry})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, d := range batch {
+		if s.stopping() {
+			return nil
+		}
+		s.health.beat(LoopWebhooks)
+		if err := s.attemptDelivery(d.key, d.entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attemptDelivery delivers the entry and records the attempt. The entry is
+// removed once delivered or out of attempts, otherwise it is rescheduled.
+func (s *Server) attemptDelivery(key []byte, entry *outboxEntry) error {
+	start := time.Now()
+	code, err := s.deliver(entry)
+	if err != nil && s.stopping() {
+		// Retried on the next start.
+		return nil
+	}
+	entry.Attempts++
+	delivery := &WebhookDelivery{
+		EventID:    entry.EventID,
+		EventType:  entry.EventType,
+		Attempt:    entry.Attempts,
+		Status:     DeliveryDelivered,
+		StatusCode: code,
+		Duration:   time.Since(start).Round(time.Millisecond).String(),
+		At:         start.UTC(),
+	}
+	log := logrus.WithFields(logrus.Fields{"webhook_id": entry.WebhookID, "event_id": entry.EventID})
+	switch {
+	case err == nil:
+		log.Debugf("Webhook %s delivered", entry.EventType)
+	case entry.Attempts >= s.conf().Webhooks.MaxAttempts:
+		delivery.Status, delivery.Error = DeliveryFailed, err.Error()
+		log.Warnf("Webhook %s dropped after %d attempts: %v", entry.EventType, entry.Attempts, err)
+	default:
+		delivery.Status, delivery.Error = DeliveryRetrying, err.Error()
+		entry.NextAttemptAt = time.Now().Add(webhookBackoff(entry.Attempts)).UTC()
+		log.Infof("Webhook %s failed, retrying at %s: %v", entry.EventType, entry.NextAttemptAt.Format(time.RFC3339), err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(OutboxBucket)
+		if delivery.Status == DeliveryRetrying {
+			encoded, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := outbox.Put(key, encoded); err != nil {
+				return err
+			}
+		} else if err := outbox.Delete(key); err != nil {
+			return err
+		}
+		return logDelivery(tx, entry.WebhookID, delivery)
+	})
+}
+
+// logDelivery keeps the delivery in the log of the webhook, if the webhook
+// still exists.
+func logDelivery(tx *bolt.Tx, webhookID string, delivery *WebhookDelivery) error {
+	if tx.Bucket(WebhooksBucket).Get([]byte(webhookID)) == nil {
+		return nil
+	}
+	b, err := tx.Bucket(DeliveriesBucket).CreateBucketIfNotExists([]byte(webhookID))
+	if err != nil {
+		return err
+	}
+	id, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	delivery.ID = id
+	encoded, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	// Stats only counts the committed keys, so it is read before the Put.
+	count := b.Stats().KeyN + 1
+	if err := b.Put(itob(id), encoded); err != nil {
+		return err
+	}
+	var stale [][]byte
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && count-len(stale) > webhookLogLimit; k, _ = c.Next() {
+		stale = append(stale, k)
+	}
+	for _, k := range stale {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// webhooks returns the webhooks of the user, or the global ones if userID
+// is empty.
+func (s *Server) webhooks(userID string) ([]*Webhook, error) {
+	list := []*Webhook{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(WebhooksBucket).ForEach(func(k, v []byte) error {
+			var hook Webhook
+			if err := json.Unmarshal(v, &hook); err != nil {
+				return err
+			}
+			if hook.UserID == userID {
+				list = append(list, &hook)
+			}
+			return nil
+		})
+	})
+	return list, err
+}
+
+// validateWebhookURL checks the URL of a webhook. The addresses the user
+// webhooks may not reach are rejected here if given literally, and on
+// every delivery after the name is resolved.
+func (s *Server) validateWebhookURL(userID, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	if len(userID) == 0 || s.conf().Webhooks.AllowPrivateNetworks {
+		return nil
+	}
+	if ip := net.ParseIP(u.Hostname()); (ip != nil && !isPublicIP(ip)) || u.Hostname() == "localhost" {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+// createWebhook registers a webhook of the user, or a global one if userID
+// is empty, with a new secret.
+func (s *Server) createWebhook(userID, rawURL string, events []string) (*Webhook, error) {
+	if err := s.validateWebhookURL(userID, rawURL); err != nil {
+		return nil, err
+	}
+	for _, e := range events {
+		known := false
+		for _, w := range WebhookEvents {
+			known = known || e == w
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown event %s", e)
+		}
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	hook := &Webhook{
+		ID:        newJobID(),
+		UserID:    userID,
+		URL:       rawURL,
+		Secret:    hex.EncodeToString(secret),
+		Events:    events,
+		CreatedAt: time.Now().UTC(),
+	}
+	list, err := s.webhooks(userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(userID) != 0 && len(list) >= s.conf().Webhooks.MaxPerUser {
+		return nil, ErrTooManyWebhooks
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		encoded, err := json.Marshal(hook)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(WebhooksBucket).Put([]byte(hook.ID), encoded)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+// deleteWebhook removes the webhook of the user, or the global one if
+// userID is empty, with its delivery log and pending events.
+func (s *Server) deleteWebhook(userID, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(WebhooksBucket)
+		v := b.Get([]byte(id))
+		if v == nil {
+			return ErrWebhookNotFound
+		}
+		var hook Webhook
+		if err := json.Unmarshal(v, &hook); err != nil {
+			return err
+		}
+		if hook.UserID != userID {
+			return ErrWebhookNotFound
+		}
+		if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+		if tx.Bucket(DeliveriesBucket).Bucket([]byte(id)) != nil {
+			if err := tx.Bucket(DeliveriesBucket).DeleteBucket([]byte(id)); err != nil {
+				return err
+			}
+		}
+		var pending [][]byte
+		outbox := tx.Bucket(OutboxBucket)
+		err := outbox.ForEach(func(k, v []byte) error {
+			var entry outboxEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if entry.WebhookID == id {
+				pending = append(pending, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range pending {
+			if err := outbox.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// deleteUserWebhooks removes the webhooks of a deleted user. Their pending
+// events, such as user.deleted itself, are still delivered.
+func (s *Server) deleteUserWebhooks(userID string) error {
+	list, err := s.webhooks(userID)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, hook := range list {
+			if err := tx.Bucket(WebhooksBucket).Delete([]byte(hook.ID)); err != nil {
+				return err
+			}
+			if tx.Bucket(DeliveriesBucket).Bucket([]byte(hook.ID)) != nil {
+				if err := tx.Bucket(DeliveriesBucket).DeleteBucket([]byte(hook.ID)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// webhookDeliveries returns the delivery log of the webhook, newest first.
+func (s *Server) webhookDeliveries(userID, id string) ([]*WebhookDelivery, error) {
+	list := []*WebhookDelivery{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(WebhooksBucket).Get([]byte(id))
+		if v == nil {
+			return ErrWebhookNotFound
+		}
+		var hook Webhook
+		if err := json.Unmarshal(v, &hook); err != nil {
+			return err
+		}
+		if hook.UserID != userID {
+			return ErrWebhookNotFound
+		}
+		b := tx.Bucket(DeliveriesBucket).Bucket([]byte(id))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var delivery WebhookDelivery
+			if err := json.Unmarshal(v, &delivery); err != nil {
+				return err
+			}
+			list = append(list, &delivery)
+		}
+		return nil
+	})
+	return list, err
+}
+
+// webhooksHandler lists the webhooks of the owner on GET, registers one
+// from the url and events values on POST and removes the one given by id
+// on DELETE. The owner is a user ID, or empty for the global webhooks.
+// audit, if set, is called with the action and its target before the
+// webhook is changed, and refuses the change by returning an error.
+func (s *Server) webhooksHandler(w http.ResponseWriter, r *http.Request, ownerID string,
+	audit func(action, targetID string) error) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if audit != nil && !s.auditWebhook(w, r, audit, AuditWebhookCreate, r.FormValue("url")) {
+			return
+		}
+		hook, err := s.createWebhook(ownerID, r.FormValue("url"), splitList(r.FormValue("events")))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid webhook: %v", err), http.StatusBadRequest)
+			return
+		}
+		requestLog(r).WithFields(logrus.Fields{logging.FieldUserID: ownerID, "webhook_id": hook.ID}).Info("Webhook registered")
+	case http.MethodDelete:
+		id := r.FormValue("id")
+		if audit != nil && !s.auditWebhook(w, r, audit, AuditWebhookDelete, id) {
+			return
+		}
+		if err := s.deleteWebhook(ownerID, id); err != nil {
+			status := http.StatusInternalServerError
+			if err == ErrWebhookNotFound {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		requestLog(r).WithFields(logrus.Fields{logging.FieldUserID: ownerID, "webhook_id": id}).Info("Webhook deleted")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	list, err := s.webhooks(ownerID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Cannot read webhooks: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, list)
+}
+
+// auditWebhook writes the audit entry of a webhook change, answering 500
+// if it can not be written.
+func (s *Server) auditWebhook(w http.ResponseWriter, r *http.Request, audit func(action, targetID string) error,
+	action, targetID string) bool {
+	if err := audit(action, targetID); err != nil {
+		requestLog(r).Errorf("Error writing audit log: %v", err)
+		http.Error(w, fmt.Sprintf("Cannot write audit log: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+func (s *Server) webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request, ownerID string) {
+	list, err := s.webhookDeliveries(ownerID, r.FormValue("id"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrWebhookNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSON(w, list)
+}
+
+// WebhooksHandler manages the webhooks of the user.
+func (s *Server) WebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromContext(r)
+	if user == nil {
+		http.Error(w, "Empty user data", http.StatusInternalServerError)
+		return
+	}
+	s.webhooksHandler(w, r, user.ID, nil)
+}
+
+// WebhookDeliveriesHandler shows the delivery log of a webhook of the user.
+func (s *Server) WebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	user := GetUserFromContext(r)
+	if user == nil {
+		http.Error(w, "Empty user data", http.StatusInternalServerError)
+		return
+	}
+	s.webhookDeliveriesHandler(w, r, user.ID)
+}
+
+// AdminWebhooksHandler manages the global webhooks, receiving the events
+// of all the users. Every change is written to the audit log first and is
+// refused if the audit log can not be written.
+func (s *Server) AdminWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	admin := GetUserFromContext(r)
+	if admin == nil {
+		http.Error(w, "Empty user data", http.StatusInternalServerError)
+		return
+	}
+	s.webhooksHandler(w, r, "", func(action, targetID string) error {
+		return s.audit(admin, action, targetID)
+	})
+}
+
+// AdminWebhookDeliveriesHandler shows the delivery log of a global webhook.
+func (s *Server) AdminWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	s.webhookDeliveriesHandler(w, r, "")
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// verifyWebhook checks a signature the way a receiver does, following the
+// description of WebhookSignatureHeader.
+func verifyWebhook(secret, timestamp string, body []byte, signature string) bool {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hmac.Equal([]byte(signature), []byte("sha256="+hex.EncodeToString(mac.Sum(nil))))
+}
+
+func TestSignWebhook(t *testing.T) {
+	const (
+		secret    = "whsec-test"
+		timestamp = "1700000000"
+	)
+	body := []byte(`{"id":"e1"}`)
+	signature := signWebhook(secret, timestamp, body)
+	if want := "sha256=f49b81a5e23956df3f1a460f99185bcaaba87e1f98e3ac0f099adb3eaab2cb1c"; signature != want {
+		t.Fatalf("signWebhook = %s, want %s", signature, want)
+	}
+	tests := []struct {
+		name              string
+		secret, timestamp string
+		body              []byte
+		want              bool
+	}{
+		{"valid", secret, timestamp, body, true},
+		{"other secret", "whsec-other", timestamp, body, false},
+		{"other timestamp", secret, "1700000001", body, false},
+		{"modified body", secret, timestamp, []byte(`{"id":"e2"}`), false},
+		{"empty body", secret, timestamp, nil, false},
+	}
+	for _, tt := range tests {
+		if got := verifyWebhook(tt.secret, tt.timestamp, tt.body, signature); got != tt.want {
+			t.Errorf("%s: verify = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDeliverSignsRequest(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan received, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- received{r.Header, body}
+	}))
+	defer receiver.Close()
+	entry := &outboxEntry{
+		WebhookID: "w1",
+		// The receiver listens on the loopback.
+		Global:    true,
+		URL:       receiver.URL,
+		Secret:    "whsec-test",
+		EventID:   "e1",
+		EventType: EventResumePublished,
+		Payload:   json.RawMessage(`{"id":"e1","type":"resume.published"}`),
+	}
+	if code, err := s.deliver(entry); err != nil || code != http.StatusOK {
+		t.Fatalf("deliver = %d, %v", code, err)
+	}
+	got := <-requests
+	if string(got.body) != string(entry.Payload) {
+		t.Errorf("body = %s, want %s", got.body, entry.Payload)
+	}
+	headers := []struct {
+		name, want string
+	}{
+		{WebhookEventHeader, entry.EventType},
+		{WebhookDeliveryHeader, entry.EventID},
+		{"Content-Type", "application/json"},
+	}
+	for _, h := range headers {
+		if v := got.header.Get(h.name); v != h.want {
+			t.Errorf("%s = %q, want %q", h.name, v, h.want)
+		}
+	}
+	timestamp := got.header.Get(WebhookTimestampHeader)
+	if !verifyWebhook(entry.Secret, timestamp, got.body, got.header.Get(WebhookSignatureHeader)) {
+		t.Errorf("signature %q does not verify", got.header.Get(WebhookSignatureHeader))
+	}
+
+	// A user webhook may not reach the loopback.
+	entry.Global = false
+	if _, err := s.deliver(entry); err == nil || !strings.Contains(err.Error(), ErrPrivateAddress.Error()) {
+		t.Errorf("deliver of a user webhook to %s = %v, want %v", receiver.URL, err, ErrPrivateAddress)
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"8.8.8.8", true},
+		{"2606:4700:4700::1111", true},
+		{"100.63.255.255", true},
+		{"100.128.0.0", true},
+		{"172.32.0.1", true},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"10.0.0.1", false},
+		{"100.64.0.1", false},
+		{"100.127.255.255", false},
+		{"127.0.0.1", false},
+		{"127.10.0.1", false},
+		{"169.254.169.254", false},
+		{"172.16.0.1", false},
+		{"172.31.255.255", false},
+		{"192.168.1.1", false},
+		{"224.0.0.1", false},
+		{"::", false},
+		{"::1", false},
+		{"fc00::1", false},
+		{"fd12:3456::1", false},
+		{"fe80::1", false},
+		{"ff02::1", false},
+		// IPv4-mapped IPv6 addresses are checked as IPv4.
+		{"::ffff:8.8.8.8", true},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.1.2.3", false},
+		{"::ffff:169.254.169.254", false},
+		{"::ffff:100.64.0.1", false},
+		{"::ffff:0.0.0.0", false},
+		// Reserved and special purpose IPv4 ranges.
+		{"192.0.0.8", false},
+		{"192.0.1.1", true},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"198.20.0.1", true},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		// Multicast beyond link local.
+		{"224.0.1.1", false},
+		{"239.255.255.250", false},
+		{"ff05::2", false},
+		{"ff0e::1", false},
+		// IPv6 prefixes reaching IPv4 addresses.
+		{"64:ff9b::a00:1", false},
+		{"64:ff9b::808:808", false},
+		{"64:ff9b:1::1", false},
+		{"2002:a00:1::1", false},
+		{"2001:0:4136:e378::1", false},
+		{"::10.0.0.1", false},
+		{"2a00:1450:4010::1", true},
+	}
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.ip)
+		if ip == nil {
+			t.Fatalf("invalid test address %s", tt.ip)
+		}
+		if got := isPublicIP(ip); got != tt.want {
+			t.Errorf("isPublicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookNotify(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	hooks := []struct {
+		userID string
+		events []string
+	}{
+		{"", nil},
+		{"u1", []string{EventResumePublished}},
+		{"u1", []string{EventTokenExpired}},
+		{"u2", nil},
+	}
+	for _, h := range hooks {
+		if _, err := s.createWebhook(h.userID, "https://example.com/hook", h.events); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		userID, event string
+		want          int
+	}{
+		{"u1", EventResumePublished, 2},
+		{"u1", EventResumeEdited, 1},
+		{"u2", EventResumeEdited, 2},
+		{"u3", EventTokenExpired, 1},
+	}
+	notifier := &WebhookNotifier{s: s}
+	for _, tt := range tests {
+		before := outboxLen(t, s)
+		event := &Event{Type: tt.event, UserID: tt.userID, At: time.Now()}
+		if err := notifier.Notify(&User{ID: tt.userID}, event); err != nil {
+			t.Fatal(err)
+		}
+		if got := outboxLen(t, s) - before; got != tt.want {
+			t.Errorf("%s of %s queued %d events, want %d", tt.event, tt.userID, got, tt.want)
+		}
+	}
+}
+
+func outboxLen(t *testing.T, s *Server) int {
+	var n int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(OutboxBucket).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestLogDeliveryKeepsLimit(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	hook, err := s.createWebhook("", "https://example.com/hook", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < webhookLogLimit+5; i++ {
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			return logDelivery(tx, hook.ID, &WebhookDelivery{EventID: "e", Status: DeliveryDelivered})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deliveries, err := s.webhookDeliveries("", hook.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != webhookLogLimit {
+		t.Fatalf("%d deliveries kept, want %d", len(deliveries), webhookLogLimit)
+	}
+	for _, d := range deliveries {
+		if d.ID <= 5 {
+			t.Errorf("delivery %d kept, want the oldest ones pruned", d.ID)
+		}
+	}
+}
+
+func TestAdminWebhooksAuditFirst(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	admin := &User{ID: "admin"}
+	hook, err := s.createWebhook("", "https://example.com/old", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(method, query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/admin/webhooks?"+query, nil)
+		w := httptest.NewRecorder()
+		s.AdminWebhooksHandler(w, SetUserToContext(r, admin))
+		return w
+	}
+	if w := request(http.MethodPost, "url=https://example.com/new"); w.Code != http.StatusOK {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	entries, _, err := s.auditLog(1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Action != AuditWebhookCreate || entries[0].TargetID != "https://example.com/new" {
+		t.Errorf("audit log %+v, want the creation", entries)
+	}
+
+	// Without the audit log the changes are refused.
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(AuditBucket)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method, query string
+	}{
+		{http.MethodPost, "url=https://example.com/unaudited"},
+		{http.MethodDelete, "id=" + hook.ID},
+	}
+	for _, tt := range tests {
+		if w := request(tt.method, tt.query); w.Code != http.StatusInternalServerError {
+			t.Errorf("%s %s without the audit log: status %d, want %d", tt.method, tt.query, w.Code, http.StatusInternalServerError)
+		}
+	}
+	list, err := s.webhooks("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var urls []string
+	for _, h := range list {
+		urls = append(urls, h.URL)
+	}
+	if len(urls) != 2 || strings.Contains(strings.Join(urls, " "), "unaudited") {
+		t.Errorf("webhooks %v, want the unaudited changes refused", urls)
+	}
+}